@@ -0,0 +1,34 @@
+package stego
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+// ErrAuthFailed is returned by Decode when the hidden message does not match its
+// HMAC tag, because the key is wrong or the image has been modified.
+var ErrAuthFailed = errors.New("message failed HMAC authentication (wrong key, or the image was modified)")
+
+// ErrAuthKeyRequired is returned by Decode when the message has an HMAC tag but
+// no key was given to check it with.
+var ErrAuthKeyRequired = errors.New("message is authenticated: an HMAC key is required")
+
+// Length of an HMAC-SHA256 tag
+const hmac_len = 32
+
+// newMAC returns an HMAC-SHA256 keyed with key, for tagging the message as it is
+// hidden in the image (after any compression and encryption).
+func newMAC(key string) hash.Hash {
+	return hmac.New(sha256.New, []byte(key))
+}
+
+// checkMAC reports whether mac matches the tag recorded in h.
+func checkMAC(h Header, mac hash.Hash) error {
+	if !hmac.Equal(mac.Sum(nil), h.Tag[:]) {
+		return ErrAuthFailed
+	}
+
+	return nil
+}
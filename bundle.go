@@ -0,0 +1,220 @@
+package stego
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// ErrNotFiles is returned by DecodeFiles if the message is not a set of files
+// hidden by EncodeFiles, or its manifest is damaged.
+var ErrNotFiles = errors.New("message is not a set of files")
+
+// A set of files is hidden as one message, starting with a manifest,
+// serialised big-endian as
+//
+//	count uint16 | count × (name_len uint8 | name [name_len]byte | length uint32)
+//
+// followed by the contents of each file in turn, so each starts at the sum of
+// the lengths before it.  It is all compressed and encrypted together, so the
+// names are as secret as the contents.
+
+// Most files that can be hidden together
+const max_files = 0xffff
+
+// File is one of a set of files hidden together by EncodeFiles.
+type File struct {
+	Name string // base name, up to 255 bytes
+	Data []byte
+}
+
+// EncodeFiles hides files in img as one message, with a manifest of their names
+// and lengths, so DecodeFiles can give them back separately.  The names must
+// be different, and opts.Filename must not be set.
+func EncodeFiles(img image.Image, files []File, opts Options) (image.Image, error) {
+	if opts.Filename != "" {
+		return nil, optionsErrorf("a set of files stores the names of its own")
+	}
+	msg, err := bundleFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	opts.files = true
+	return Encode(img, msg, opts)
+}
+
+// DecodeFiles recovers the files hidden in img by EncodeFiles, in the order
+// they were given.  It returns an error wrapping ErrNotFiles for any other
+// message.
+func DecodeFiles(img image.Image, opts Options) ([]File, error) {
+	h, err := ReadSlotHeader(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	if h.ExtFlags&ExtFlagFiles == 0 {
+		return nil, ErrNotFiles
+	}
+	msg, err := Decode(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	return unbundleFiles(msg)
+}
+
+// FileInfo describes one of a set of files hidden together by EncodeFiles.
+type FileInfo struct {
+	Name string
+	Size int
+}
+
+// ListFiles returns the names and sizes of the files hidden in img by
+// EncodeFiles, in the order they were given, without recovering their
+// contents.  Only as much of a plain message as holds the manifest is read, so
+// its checksum is not checked; an encrypted, compressed or error corrected
+// message has to be recovered in full first.  It returns an error wrapping
+// ErrNotFiles for any other message.
+func ListFiles(img image.Image, opts Options) ([]FileInfo, error) {
+	h, err := ReadSlotHeader(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	if h.ExtFlags&ExtFlagFiles == 0 {
+		return nil, ErrNotFiles
+	}
+
+	// Stop decoding once the manifest has been read
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := &manifestWriter{done: cancel}
+	err = decodeTo(ctx, img, mw, opts)
+	if mw.err != nil {
+		return nil, mw.err
+	}
+	if mw.files == nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: manifest is damaged", ErrNotFiles)
+	}
+
+	// The lengths of a plain message are known from the header
+	if h.Flags&(FlagEncrypted|FlagCompressed) == 0 && h.ExtFlags&ExtFlagECC == 0 {
+		total := mw.n
+		for _, f := range mw.files {
+			total += f.Size
+		}
+		if total != int(h.PayloadLen) {
+			return nil, fmt.Errorf("%w: manifest is damaged", ErrNotFiles)
+		}
+	}
+	return mw.files, nil
+}
+
+// manifestWriter collects the start of a message made by bundleFiles, and
+// calls done once it holds the whole manifest.
+type manifestWriter struct {
+	b     []byte
+	files []FileInfo
+	n     int // length of the manifest
+	err   error
+	done  func()
+}
+
+func (mw *manifestWriter) Write(p []byte) (int, error) {
+	if mw.files != nil || mw.err != nil {
+		return len(p), nil
+	}
+	mw.b = append(mw.b, p...)
+	mw.files, mw.n, mw.err = readManifest(mw.b)
+	if mw.files != nil || mw.err != nil {
+		mw.done()
+	}
+	return len(p), nil
+}
+
+// readManifest parses the manifest at the start of b, returning the files it
+// lists and its length, or no files if b holds only part of it.
+func readManifest(b []byte) ([]FileInfo, int, error) {
+	if len(b) < 2 {
+		return nil, 0, nil
+	}
+	files := make([]FileInfo, binary.BigEndian.Uint16(b))
+	n := 2
+	for i := range files {
+		if len(b) > n && b[n] == 0 {
+			return nil, 0, fmt.Errorf("%w: manifest is damaged", ErrNotFiles)
+		}
+		if len(b) < n+1 || len(b) < n+1+int(b[n])+4 {
+			return nil, 0, nil
+		}
+		name_len := int(b[n])
+		files[i].Name = string(b[n+1 : n+1+name_len])
+		files[i].Size = int(binary.BigEndian.Uint32(b[n+1+name_len:]))
+		n += 1 + name_len + 4
+	}
+	return files, n, nil
+}
+
+// bundleFiles returns the manifest of files followed by their contents.
+func bundleFiles(files []File) ([]byte, error) {
+	if len(files) > max_files {
+		return nil, optionsErrorf("at most %d files can be hidden together", max_files)
+	}
+	names := make(map[string]bool, len(files))
+	size := 2
+	for _, f := range files {
+		if f.Name == "" || len(f.Name) > max_filename_len {
+			return nil, optionsErrorf("invalid file name %q (want 1 to %d bytes)", f.Name, max_filename_len)
+		}
+		if names[f.Name] {
+			return nil, optionsErrorf("file name %q given twice", f.Name)
+		}
+		if int64(len(f.Data)) > int64(^uint32(0)) {
+			return nil, optionsErrorf("file %s is too big (%d bytes)", f.Name, len(f.Data))
+		}
+		names[f.Name] = true
+		size += 1 + len(f.Name) + 4 + len(f.Data)
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(files)))
+	for _, f := range files {
+		b = append(b, byte(len(f.Name)))
+		b = append(b, f.Name...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(f.Data)))
+	}
+	for _, f := range files {
+		b = append(b, f.Data...)
+	}
+	return b, nil
+}
+
+// unbundleFiles splits a message made by bundleFiles back into its files.
+func unbundleFiles(b []byte) ([]File, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("%w: no manifest", ErrNotFiles)
+	}
+	list, n, err := readManifest(b)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		return nil, fmt.Errorf("%w: manifest is damaged", ErrNotFiles)
+	}
+	b = b[n:]
+
+	files := make([]File, len(list))
+	for i, f := range list {
+		files[i].Name = f.Name
+		if int64(f.Size) > int64(len(b)) {
+			return nil, fmt.Errorf("%w: file %s is cut short", ErrNotFiles, f.Name)
+		}
+		files[i].Data, b = b[:f.Size:f.Size], b[f.Size:]
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%w: %d bytes past the last file", ErrNotFiles, len(b))
+	}
+	return files, nil
+}
@@ -0,0 +1,71 @@
+package stego
+
+import (
+	"image"
+	"math"
+)
+
+// Fewest colour values expected in each of a pair of values for the pair to be
+// counted in the chi-square test
+const min_chi_expected = 5
+
+// ChiSquareLSB runs the classic chi-square attack of Westfeld and Pfitzmann on
+// the least significant bits of img, as a measure of how detectable a message
+// hidden in it is.  Overwriting low bits with message bits evens out the counts
+// of each pair of values 2k and 2k+1, which in a natural image differ; the
+// test gives the probability that the counts are that even by chance.  It
+// returns a suspicion score from 0 (untouched) to 1 (the low bits look like a
+// message), the highest over the R, G, B and A values, since a message may be
+// hidden in just some of them.  An 8 bit image is tested at 8 bits.  A
+// synthetic image, such as a gradient using every value equally, can score
+// high untouched, so compare the score with the carrier's.
+func ChiSquareLSB(img image.Image) float64 {
+	bounds := img.Bounds()
+	shift := 8
+	if is16Bit(img) {
+		shift = 0
+	}
+
+	var hist [4][]int
+	for ch := range hist {
+		hist[ch] = make([]int, 0x10000>>shift)
+	}
+	for i := range bounds.Dx() * bounds.Dy() {
+		c := colourAt(img, pixelPoint(bounds, i))
+		for ch := range c {
+			hist[ch][c[ch]>>shift]++
+		}
+	}
+
+	var score float64
+	for _, h := range hist {
+		score = max(score, chiSquarePairs(h))
+	}
+	return score
+}
+
+// chiSquarePairs returns the probability of the counts of each pair of values
+// in the histogram h being at least as even as they are by chance.
+func chiSquarePairs(h []int) float64 {
+	var chi float64
+	df := 0
+	for v := 0; v < len(h); v += 2 {
+		expected := float64(h[v]+h[v+1]) / 2
+		if expected < min_chi_expected {
+			continue
+		}
+		d := float64(h[v]) - expected
+		chi += d * d / expected
+		df++
+	}
+	if df < 2 {
+		return 0
+	}
+	df--
+
+	// The upper tail of the chi-square distribution, by the Wilson-Hilferty
+	// approximation
+	k := float64(df)
+	z := (math.Cbrt(chi/k) - (1 - 2/(9*k))) / math.Sqrt(2/(9*k))
+	return math.Erfc(z/math.Sqrt2) / 2
+}
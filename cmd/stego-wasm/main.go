@@ -0,0 +1,52 @@
+//go:build js && wasm
+
+// Command stego-wasm makes the stego encoder available to JavaScript, when
+// built with GOOS=js GOARCH=wasm.  It defines two global functions, which take
+// and return Uint8Arrays of file contents:
+//
+//	stegoEncode(image, message) // returns {image} (a PNG), or {error}
+//	stegoDecode(image)          // returns {message}, or {error}
+package main
+
+import (
+	"syscall/js"
+
+	"github.com/henrythewasp/stego/wasm"
+)
+
+// bytesFrom copies the contents of the Uint8Array v.
+func bytesFrom(v js.Value) []byte {
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+// result returns {name: b} as a JavaScript object, or {error} if err is set.
+func result(name string, b []byte, err error) any {
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	arr := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(arr, b)
+	return map[string]any{name: arr}
+}
+
+func main() {
+	js.Global().Set("stegoEncode", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 2 {
+			return map[string]any{"error": "stegoEncode needs an image and a message"}
+		}
+		out, err := wasm.Encode(bytesFrom(args[0]), bytesFrom(args[1]))
+		return result("image", out, err)
+	}))
+	js.Global().Set("stegoDecode", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 1 {
+			return map[string]any{"error": "stegoDecode needs an image"}
+		}
+		msg, err := wasm.Decode(bytesFrom(args[0]))
+		return result("message", msg, err)
+	}))
+
+	// Keep the functions available to the page
+	select {}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/henrythewasp/stego"
+)
+
+// An animated PNG (APNG) is a PNG whose IHDR is followed by an acTL chunk
+// giving the number of frames and plays, and then, for each frame, an fcTL
+// chunk giving its size, position, delay and how it is drawn, followed by its
+// image data: the IDAT chunks of the default image for the first frame, and
+// fdAT chunks (IDAT data with a sequence number in front) for the others.
+// fcTL and fdAT chunks share one sequence, from 0.
+
+// animation is an animated GIF or PNG, as each of its frames in full, as shown
+// at that point of the animation.
+type animation struct {
+	frames []image.Image
+	delays [][2]uint16 // each frame's delay, as the numerator and denominator of seconds
+	plays  uint32      // times the animation plays, or 0 for forever
+}
+
+// APNG frame drawing operations
+const (
+	apng_dispose_none       = 0
+	apng_dispose_background = 1
+	apng_dispose_previous   = 2
+	apng_blend_source       = 0
+)
+
+// apngFrame is one frame of an animated PNG, as stored.
+type apngFrame struct {
+	rect    image.Rectangle
+	delay   [2]uint16
+	dispose byte
+	blend   byte
+	data    []byte // the zlib compressed image data
+}
+
+// readAnimation decodes every frame of the animated GIF or PNG name in fsys,
+// once it has checked that all of them together are within -maxpixels.
+func readAnimation(fsys fs.FS, name string) (animation, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return animation{}, fmt.Errorf("cannot open input image: %w", err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return animation{}, fmt.Errorf("cannot read input image: %w", err)
+	}
+
+	if bytes.HasPrefix(b, []byte("GIF8")) {
+		// Check the size and number of frames before decoding them
+		cfg, err := gif.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			return animation{}, fmt.Errorf("cannot decode input image: %w", err)
+		}
+		n, err := gifFrames(b)
+		if err != nil {
+			return animation{}, err
+		}
+		if err := checkFrames(n, cfg.Width, cfg.Height); err != nil {
+			return animation{}, err
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			return animation{}, fmt.Errorf("cannot decode input image: %w", err)
+		}
+		return gifAnimation(g), nil
+	}
+	if bytes.HasPrefix(b, png_signature) {
+		return pngAnimation(b)
+	}
+	return animation{}, errors.New("input image is not an animated GIF or PNG")
+}
+
+// checkFrames returns an error matching stego.ErrCarrierTooLarge if n frames
+// of a width x height animation, each rendered in full, have more pixels
+// between them than -maxpixels.
+func checkFrames(n, width, height int) error {
+	if *max_pixels <= 0 {
+		return nil
+	}
+	if pixels := int64(width) * int64(height); pixels > 0 && int64(n) > int64(*max_pixels)/pixels {
+		return fmt.Errorf("%w: %d frames of %dx%d have more pixels than -maxpixels %d", stego.ErrCarrierTooLarge, n, width, height, *max_pixels)
+	}
+	return nil
+}
+
+// gifFrames counts the frames of the GIF b from its blocks, without decoding
+// them.  A GIF is a header and logical screen descriptor, a colour table if
+// flagged, and then extensions (0x21) and image descriptors (0x2c), each
+// followed by data sub-blocks, until the trailer (0x3b).
+func gifFrames(b []byte) (int, error) {
+	invalid := errors.New("cannot decode input image: gif: invalid block")
+	if len(b) < 13 {
+		return 0, invalid
+	}
+	pos := 13
+	if b[10]&0x80 != 0 {
+		pos += 3 << (b[10]&7 + 1)
+	}
+	n := 0
+	for pos < len(b) && b[pos] != 0x3b {
+		switch b[pos] {
+		case 0x21:
+			pos += 2
+		case 0x2c:
+			if pos+10 > len(b) {
+				return 0, invalid
+			}
+			flags := b[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos++ // LZW minimum code size
+			n++
+		default:
+			return 0, invalid
+		}
+		for pos < len(b) {
+			size := int(b[pos])
+			pos += 1 + size
+			if size == 0 {
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// gifAnimation renders each frame of g in full.
+func gifAnimation(g *gif.GIF) animation {
+	var a animation
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		a.frames = append(a.frames, cloneNRGBA(canvas))
+		a.delays = append(a.delays, [2]uint16{uint16(g.Delay[i]), 100})
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	// A GIF loops LoopCount times after the first play, or plays just once if
+	// it is -1
+	switch {
+	case g.LoopCount < 0:
+		a.plays = 1
+	case g.LoopCount > 0:
+		a.plays = uint32(g.LoopCount) + 1
+	}
+	return a
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	c := *img
+	c.Pix = append([]byte{}, img.Pix...)
+	return &c
+}
+
+// pngAnimation decodes and renders each frame of the animated PNG b, checking
+// the number of frames against -maxpixels before decoding any.
+func pngAnimation(b []byte) (animation, error) {
+	var a animation
+	var ihdr, before_data []byte
+	var frames []*apngFrame
+	animated := false
+	for b = b[len(png_signature):]; ; {
+		if len(b) < 12 || len(b)-12 < int(binary.BigEndian.Uint32(b)) {
+			return a, errors.New("cannot decode input image: png: truncated chunk")
+		}
+		length := int(binary.BigEndian.Uint32(b))
+		kind, data := string(b[4:8]), b[8:8+length]
+		if crc32.ChecksumIEEE(b[4:8+length]) != binary.BigEndian.Uint32(b[8+length:]) {
+			return a, fmt.Errorf("cannot decode input image: png: bad checksum in %s chunk", kind)
+		}
+		b = b[12+length:]
+
+		switch kind {
+		case "IHDR":
+			ihdr = data
+		case "acTL":
+			animated = true
+			if len(data) == 8 {
+				a.plays = binary.BigEndian.Uint32(data[4:])
+			}
+		case "PLTE", "tRNS":
+			before_data = append(before_data, pngChunk(kind, data)...)
+		case "fcTL":
+			if len(data) != 26 {
+				return a, errors.New("cannot decode input image: png: invalid fcTL chunk")
+			}
+			x, y := int(binary.BigEndian.Uint32(data[12:])), int(binary.BigEndian.Uint32(data[16:]))
+			w, h := int(binary.BigEndian.Uint32(data[4:])), int(binary.BigEndian.Uint32(data[8:]))
+			frames = append(frames, &apngFrame{
+				rect:    image.Rect(x, y, x+w, y+h),
+				delay:   [2]uint16{binary.BigEndian.Uint16(data[20:]), binary.BigEndian.Uint16(data[22:])},
+				dispose: data[24],
+				blend:   data[25],
+			})
+		case "IDAT":
+			// The default image is the first frame only if an fcTL comes first
+			if len(frames) == 1 {
+				frames[0].data = append(frames[0].data, data...)
+			}
+		case "fdAT":
+			if len(frames) == 0 || len(data) < 4 {
+				return a, errors.New("cannot decode input image: png: fdAT chunk before its fcTL")
+			}
+			f := frames[len(frames)-1]
+			f.data = append(f.data, data[4:]...)
+		}
+		if kind == "IEND" {
+			break
+		}
+	}
+	if !animated || len(ihdr) != 13 || len(frames) == 0 {
+		return a, errors.New("input image is not an animated GIF or PNG")
+	}
+
+	bounds := image.Rect(0, 0, int(binary.BigEndian.Uint32(ihdr)), int(binary.BigEndian.Uint32(ihdr[4:])))
+	if err := checkFrames(len(frames), bounds.Dx(), bounds.Dy()); err != nil {
+		return a, err
+	}
+	canvas := image.NewNRGBA64(bounds)
+	for i, f := range frames {
+		if f.rect.Empty() || !f.rect.In(bounds) {
+			return a, fmt.Errorf("cannot decode input image: frame %d at %v is outside the image", i, f.rect)
+		}
+
+		// Each frame is a PNG of its own, with the IHDR of the file resized
+		frame_ihdr := append([]byte{}, ihdr...)
+		binary.BigEndian.PutUint32(frame_ihdr, uint32(f.rect.Dx()))
+		binary.BigEndian.PutUint32(frame_ihdr[4:], uint32(f.rect.Dy()))
+		var single []byte
+		single = append(single, png_signature...)
+		single = append(single, pngChunk("IHDR", frame_ihdr)...)
+		single = append(single, before_data...)
+		single = append(single, pngChunk("IDAT", f.data)...)
+		single = append(single, pngChunk("IEND", nil)...)
+		img, err := png.Decode(bytes.NewReader(single))
+		if err != nil {
+			return a, fmt.Errorf("cannot decode input image: frame %d: %w", i, err)
+		}
+
+		var previous *image.NRGBA64
+		if f.dispose == apng_dispose_previous && i > 0 {
+			previous = cloneNRGBA64(canvas)
+		}
+		op := draw.Over
+		if f.blend == apng_blend_source {
+			op = draw.Src
+		}
+		draw.Draw(canvas, f.rect, img, image.Point{}, op)
+
+		// A frame replacing all of the canvas, or drawn over all of it while it
+		// is still blank, is shown as it is, so take it unchanged rather than
+		// from the canvas
+		if f.rect == bounds && (op == draw.Src || i == 0) {
+			a.frames = append(a.frames, img)
+		} else {
+			a.frames = append(a.frames, cloneNRGBA64(canvas))
+		}
+		a.delays = append(a.delays, f.delay)
+
+		// Leave the canvas as the next frame is to be drawn on
+		switch {
+		case f.dispose == apng_dispose_background, f.dispose == apng_dispose_previous && i == 0:
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		case f.dispose == apng_dispose_previous:
+			canvas = previous
+		}
+	}
+	return a, nil
+}
+
+func cloneNRGBA64(img *image.NRGBA64) *image.NRGBA64 {
+	c := *img
+	c.Pix = append([]byte{}, img.Pix...)
+	return &c
+}
+
+// pngChunk returns a PNG chunk of the given type and data, as stored.
+func pngChunk(kind string, data []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(c, kind...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+// writeAnimation writes a to the file name as an animated PNG, each frame in
+// full, replacing the one before it.  The frames are stored as 16 bit values if
+// any of them has 16 bits per colour value, and as grayscale if all of them
+// are grayscale, so the values of each frame are kept exactly.
+func writeAnimation(name string, a animation) error {
+	output_writer, err := createFile(name)
+	if err != nil {
+		return fmt.Errorf("cannot create output image: %w", err)
+	}
+	if err := encodeAnimation(output_writer, a); err != nil {
+		output_writer.Close()
+		return fmt.Errorf("cannot write output image: %w", err)
+	}
+	if err := output_writer.Close(); err != nil {
+		return fmt.Errorf("cannot write output image: %w", err)
+	}
+	return nil
+}
+
+// encodeAnimation writes a to w as an animated PNG.
+func encodeAnimation(w io.Writer, a animation) error {
+	gray, deep := true, false
+	for _, frame := range a.frames {
+		switch frame.(type) {
+		case *image.Gray:
+		case *image.Gray16:
+			deep = true
+		case *image.NRGBA64, *image.RGBA64:
+			gray, deep = false, true
+		default:
+			gray = false
+		}
+	}
+
+	// Colour type and bit depth, and each frame as an image of that type, whose
+	// pixels are laid out as PNG stores them
+	bounds := a.frames[0].Bounds()
+	var colour_type, depth byte = 6, 8
+	var convert func(img image.Image) ([]byte, int)
+	switch {
+	case gray && deep:
+		colour_type, depth = 0, 16
+		convert = func(img image.Image) ([]byte, int) {
+			stored, ok := img.(*image.Gray16)
+			if !ok {
+				stored = image.NewGray16(bounds)
+				draw.Draw(stored, bounds, img, img.Bounds().Min, draw.Src)
+			}
+			return stored.Pix, stored.Stride
+		}
+	case gray:
+		colour_type = 0
+		convert = func(img image.Image) ([]byte, int) {
+			stored, ok := img.(*image.Gray)
+			if !ok {
+				stored = image.NewGray(bounds)
+				draw.Draw(stored, bounds, img, img.Bounds().Min, draw.Src)
+			}
+			return stored.Pix, stored.Stride
+		}
+	case deep:
+		depth = 16
+		convert = func(img image.Image) ([]byte, int) {
+			stored, ok := img.(*image.NRGBA64)
+			if !ok {
+				stored = image.NewNRGBA64(bounds)
+				draw.Draw(stored, bounds, img, img.Bounds().Min, draw.Src)
+			}
+			return stored.Pix, stored.Stride
+		}
+	default:
+		convert = func(img image.Image) ([]byte, int) {
+			stored, ok := img.(*image.NRGBA)
+			if !ok {
+				stored = image.NewNRGBA(bounds)
+				draw.Draw(stored, bounds, img, img.Bounds().Min, draw.Src)
+			}
+			return stored.Pix, stored.Stride
+		}
+	}
+
+	var out []byte
+	out = append(out, png_signature...)
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(bounds.Dx()))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(bounds.Dy()))
+	ihdr = append(ihdr, depth, colour_type, 0, 0, 0)
+	out = append(out, pngChunk("IHDR", ihdr)...)
+	actl := binary.BigEndian.AppendUint32(nil, uint32(len(a.frames)))
+	actl = binary.BigEndian.AppendUint32(actl, a.plays)
+	out = append(out, pngChunk("acTL", actl)...)
+	if _, err := w.Write(out); err != nil {
+		return err
+	}
+
+	seq := uint32(0)
+	row_len := bounds.Dx() * int(depth) / 8
+	if colour_type == 6 {
+		row_len *= 4
+	}
+	for i, frame := range a.frames {
+		if frame.Bounds().Size() != bounds.Size() {
+			return fmt.Errorf("frame %d is %v, not the size of the first", i, frame.Bounds())
+		}
+		fctl := binary.BigEndian.AppendUint32(nil, seq)
+		fctl = binary.BigEndian.AppendUint32(fctl, uint32(bounds.Dx()))
+		fctl = binary.BigEndian.AppendUint32(fctl, uint32(bounds.Dy()))
+		fctl = binary.BigEndian.AppendUint32(fctl, 0)
+		fctl = binary.BigEndian.AppendUint32(fctl, 0)
+		fctl = binary.BigEndian.AppendUint16(fctl, a.delays[i][0])
+		fctl = binary.BigEndian.AppendUint16(fctl, a.delays[i][1])
+		fctl = append(fctl, apng_dispose_none, apng_blend_source)
+		seq++
+
+		// Each row is stored unfiltered
+		pix, stride := convert(frame)
+		var data bytes.Buffer
+		zw, err := zlib.NewWriterLevel(&data, zlibLevel(png_levels[*png_level]))
+		if err != nil {
+			return err
+		}
+		for y := range bounds.Dy() {
+			zw.Write([]byte{0})
+			zw.Write(pix[y*stride : y*stride+row_len])
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		chunks := pngChunk("fcTL", fctl)
+		if i == 0 {
+			chunks = append(chunks, pngChunk("IDAT", data.Bytes())...)
+		} else {
+			chunks = append(chunks, pngChunk("fdAT", append(binary.BigEndian.AppendUint32(nil, seq), data.Bytes()...))...)
+			seq++
+		}
+		if _, err := w.Write(chunks); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(pngChunk("IEND", nil))
+	return err
+}
+
+// zlibLevel returns the zlib compression level for the PNG one.
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	}
+	return zlib.DefaultCompression
+}
+
+// framesEncode hides the message over the frames of the animated -i image, as
+// many as it needs, and writes them all out as an animated PNG.
+func framesEncode() error {
+	info("encoding!\n")
+
+	r, length, err := openMessage(input_files)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read message: %w", err)
+	}
+	info("message is %v bytes\n", length)
+
+	a, err := readAnimation(input_files, *input_filename)
+	if err != nil {
+		return err
+	}
+	info("animation has %v frames\n", len(a.frames))
+
+	// Remember the file name, so decode can recreate the file
+	opts := options()
+	if messageFromFile() {
+		opts.Filename = filepath.Base(*message_filename)
+	}
+
+	a.frames, err = stego.EncodeFrames(a.frames, msg, opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		return fmt.Errorf("%w (%s, or more frames)", err, capacityHint())
+	}
+	if err != nil {
+		return err
+	}
+	return writeAnimation(*output_filename, a)
+}
+
+// framesDecode recovers a message hidden over the frames of the animated -i
+// image, and writes it out as decode does.
+func framesDecode() error {
+	a, err := readAnimation(input_files, *input_filename)
+	if err != nil {
+		return err
+	}
+	msg, err := stego.DecodeFrames(a.frames, options())
+	if err != nil {
+		return err
+	}
+
+	// Each part is hidden with the same file name
+	var h stego.Header
+	for _, frame := range a.frames {
+		if h, err = stego.ReadSlotHeader(frame, options()); err == nil {
+			break
+		}
+	}
+	return writeJoined(h, msg, fmt.Sprintf("%v frames", len(a.frames)))
+}
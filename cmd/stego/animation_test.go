@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/henrythewasp/stego"
+)
+
+// testGIF returns an animated GIF of three frames: a full one, a smaller one
+// over it that is then cleared, and a last over what is left.
+func testGIF(t *testing.T) []byte {
+	t.Helper()
+	g := &gif.GIF{LoopCount: 2}
+	for i, r := range []image.Rectangle{image.Rect(0, 0, 48, 32), image.Rect(8, 8, 24, 24), image.Rect(16, 0, 48, 16)} {
+		frame := image.NewPaletted(r, palette.Plan9)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				frame.SetColorIndex(x, y, uint8(x*5+y*3+i*40))
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10*(i+1))
+		g.Disposal = append(g.Disposal, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone}[i])
+	}
+	var b bytes.Buffer
+	if err := gif.EncodeAll(&b, g); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestAnimation(t *testing.T) {
+	a, err := readAnimation(fstest.MapFS{"anim.gif": {Data: testGIF(t)}}, "anim.gif")
+	if err != nil {
+		t.Fatalf("readAnimation of a GIF: %v", err)
+	}
+	if len(a.frames) != 3 || a.plays != 3 || a.delays[1] != [2]uint16{20, 100} {
+		t.Fatalf("readAnimation of a GIF gave %d frames, %d plays and delays %v", len(a.frames), a.plays, a.delays)
+	}
+
+	// The second frame is drawn over the first, and cleared before the third
+	first, second, third := a.frames[0].At(10, 10), a.frames[1].At(10, 10), a.frames[2].At(10, 10)
+	if first == second || third != (color.NRGBA{}) || a.frames[2].At(40, 8) == first {
+		t.Errorf("readAnimation of a GIF rendered pixel 10,10 as %v, %v and %v", first, second, third)
+	}
+
+	// Written as an animated PNG, the frames read back the same
+	msg := make([]byte, stego.Capacity(a.frames[0], stego.Options{})+100)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	a.frames, err = stego.EncodeFrames(a.frames, msg, stego.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := encodeAnimation(&b, a); err != nil {
+		t.Fatalf("encodeAnimation: %v", err)
+	}
+	if img, err := png.Decode(bytes.NewReader(b.Bytes())); err != nil || !reflect.DeepEqual(img, a.frames[0]) {
+		t.Errorf("the animated PNG as a plain PNG is not the first frame: %v", err)
+	}
+	back, err := pngAnimation(b.Bytes())
+	if err != nil {
+		t.Fatalf("pngAnimation: %v", err)
+	}
+	if len(back.frames) != 3 || back.plays != a.plays || !reflect.DeepEqual(back.delays, a.delays) {
+		t.Fatalf("pngAnimation gave %d frames, %d plays and delays %v", len(back.frames), back.plays, back.delays)
+	}
+	for i := range 2 {
+		if !reflect.DeepEqual(back.frames[i], a.frames[i]) {
+			t.Errorf("frame %d of the animated PNG differs from the one written", i)
+		}
+	}
+	if got, err := stego.DecodeFrames(back.frames, stego.Options{}); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("DecodeFrames of the animated PNG gave %d bytes, %v", len(got), err)
+	}
+
+	// Grayscale frames stay grayscale
+	gray := image.NewGray16(image.Rect(0, 0, 5, 3))
+	for i := range gray.Pix {
+		gray.Pix[i] = byte(i * 13)
+	}
+	b.Reset()
+	if err := encodeAnimation(&b, animation{frames: []image.Image{gray, gray}, delays: make([][2]uint16, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if back, err := pngAnimation(b.Bytes()); err != nil || len(back.frames) != 2 || !reflect.DeepEqual(back.frames[1], gray) {
+		t.Errorf("pngAnimation of grayscale frames gave %d frames, %v", len(back.frames), err)
+	}
+
+	// A still image is not an animation
+	b.Reset()
+	if err := png.Encode(&b, gray); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pngAnimation(b.Bytes()); err == nil {
+		t.Error("pngAnimation of a still PNG succeeded")
+	}
+}
+
+func TestAnimationMaxPixels(t *testing.T) {
+	defer func(n int) { *max_pixels = n }(*max_pixels)
+
+	// Many small frames, each well within the limit, but not all of them
+	g := &gif.GIF{}
+	for range 2000 {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9))
+		g.Delay = append(g.Delay, 1)
+	}
+	var b bytes.Buffer
+	if err := gif.EncodeAll(&b, g); err != nil {
+		t.Fatal(err)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 16, 16))
+	a := animation{frames: make([]image.Image, 2000), delays: make([][2]uint16, 2000)}
+	for i := range a.frames {
+		a.frames[i] = gray
+	}
+	var p bytes.Buffer
+	if err := encodeAnimation(&p, a); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"many.gif": {Data: b.Bytes()}, "many.png": {Data: p.Bytes()}}
+	if n, err := gifFrames(testGIF(t)); err != nil || n != 3 {
+		t.Errorf("gifFrames of a GIF of 3 frames gave %d, %v", n, err)
+	}
+
+	for _, name := range []string{"many.gif", "many.png"} {
+		*max_pixels = 100000
+		if _, err := readAnimation(fsys, name); !errors.Is(err, stego.ErrCarrierTooLarge) {
+			t.Errorf("readAnimation of %s with 2000 frames of 256 pixels and -maxpixels %d returned %v, want ErrCarrierTooLarge", name, *max_pixels, err)
+		}
+		*max_pixels = 2000 * 256
+		if a, err := readAnimation(fsys, name); err != nil || len(a.frames) != 2000 {
+			t.Errorf("readAnimation of %s with -maxpixels %d gave %d frames, %v", name, *max_pixels, len(a.frames), err)
+		}
+	}
+}
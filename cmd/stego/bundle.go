@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/henrythewasp/stego"
+)
+
+// fileList is the value of -f, which can be given more than once on encode to
+// hide several files together.  message_filename holds the first.
+type fileList []string
+
+func (l *fileList) String() string {
+	if l == nil || len(*l) == 0 {
+		return ""
+	}
+	return (*l)[0]
+}
+
+func (l *fileList) Set(s string) error {
+	*l = append(*l, s)
+	*message_filename = (*l)[0]
+	return nil
+}
+
+// encodeFiles hides each of the -f files, with their names, as one message.
+func encodeFiles() error {
+	info("encoding!\n")
+
+	files := make([]stego.File, len(message_files))
+	total := 0
+	for i, name := range message_files {
+		data, err := fs.ReadFile(input_files, name)
+		if err != nil {
+			return fmt.Errorf("cannot read message file: %w", err)
+		}
+		files[i] = stego.File{Name: filepath.Base(name), Data: data}
+		total += len(data)
+	}
+	info("message is %v files of %v bytes in all\n", len(files), total)
+
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+	info("can hide up to %v bytes\n", stego.Capacity(img, options()))
+
+	opts := options()
+	output_image, err := stego.EncodeFiles(img, files, opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		if *dry_run {
+			fmt.Printf("does not fit: payload is %v bytes\n", ce.Payload)
+		}
+		return fmt.Errorf("%w (%s)", err, capacityHint())
+	}
+	if err != nil {
+		return err
+	}
+	if *dry_run {
+		h, err := stego.ReadSlotHeader(output_image, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("fits: payload is %v bytes\n", h.PayloadLen)
+		reportMetrics(img, output_image)
+		return reportUsage(output_image, opts)
+	}
+	reportMetrics(img, output_image)
+
+	chunks, err := readColourChunks(input_files, *input_filename)
+	if err != nil {
+		return err
+	}
+	return writeImageFile(output_image, chunks)
+}
+
+// decodeFiles writes each of the files hidden together in img under its
+// stored name, in the -f directory if given, or the current one.
+func decodeFiles(img image.Image) error {
+	if *message_filename != "" {
+		if fi, err := os.Stat(*message_filename); err != nil || !fi.IsDir() {
+			return fmt.Errorf("image holds several files, so -f must name a directory to write them to, not %s", *message_filename)
+		}
+	}
+
+	files, err := stego.DecodeFiles(img, options())
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name, err := decodeOutput(f.Name)
+		if err != nil {
+			return err
+		}
+		info("Decoding %v bytes to %v\n", len(f.Data), name)
+		w, err := createFile(name)
+		if err != nil {
+			return fmt.Errorf("cannot create message file: %w", err)
+		}
+		if err := writeMessage(w, f.Data); err != nil {
+			w.Close()
+			os.Remove(name)
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("cannot write message file: %w", err)
+		}
+	}
+	return nil
+}
+
+// listResult is one entry of the JSON printed by list.
+type listResult struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// listFiles prints the names and sizes of the files hidden together in the
+// input image, without writing them out.
+func listFiles() error {
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	files, err := stego.ListFiles(img, options())
+	if errors.Is(err, stego.ErrNotFiles) {
+		return fmt.Errorf("%w (decode it instead)", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *json_output {
+		r := make([]listResult, len(files))
+		for i, f := range files {
+			r[i] = listResult{Name: f.Name, Size: f.Size}
+		}
+		return printJSON(r)
+	}
+
+	width := 1
+	for _, f := range files {
+		width = max(width, len(strconv.Itoa(f.Size)))
+	}
+	for _, f := range files {
+		fmt.Printf("%*d  %s\n", width, f.Size, f.Name)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// PNG file signature
+var png_signature = []byte("\x89PNG\r\n\x1a\n")
+
+// Length of the signature plus the IHDR chunk that always follows it
+const png_ihdr_end = 8 + 8 + 13 + 4
+
+// Ancillary chunks describing how the colour values are to be shown.  Go's PNG
+// encoder never writes these, so without them the stego image would look
+// different from the original in colour managed viewers.
+var colour_chunks = map[string]bool{
+	"cHRM": true,
+	"gAMA": true,
+	"iCCP": true,
+	"sRGB": true,
+	"cICP": true,
+}
+
+// readColourChunks returns the colour chunks of the PNG file name in fsys, as
+// stored (length, type, data and CRC), or nil if it is not a PNG.  Only the
+// chunks before the image data are read.
+func readColourChunks(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open input image: %w", err)
+	}
+	defer f.Close()
+
+	sig := make([]byte, len(png_signature))
+	if _, err := io.ReadFull(f, sig); err != nil || !bytes.Equal(sig, png_signature) {
+		return nil, nil
+	}
+
+	var chunks []byte
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			return nil, fmt.Errorf("cannot read colour profile from input image: %w", err)
+		}
+		length, kind := binary.BigEndian.Uint32(hdr[0:4]), string(hdr[4:8])
+
+		// Colour chunks must come before the image data
+		if kind == "IDAT" || kind == "IEND" {
+			return chunks, nil
+		}
+		if !colour_chunks[kind] {
+			if _, err := io.CopyN(io.Discard, f, int64(length)+4); err != nil {
+				return nil, fmt.Errorf("cannot read colour profile from input image: %w", err)
+			}
+			continue
+		}
+
+		chunk := make([]byte, 8+int64(length)+4)
+		copy(chunk, hdr[:])
+		if _, err := io.ReadFull(f, chunk[8:]); err != nil {
+			return nil, fmt.Errorf("cannot read colour profile from input image: %w", err)
+		}
+		chunks = append(chunks, chunk...)
+	}
+}
+
+// chunkWriter passes a PNG file through to w, adding chunks straight after its
+// IHDR chunk.
+type chunkWriter struct {
+	w      io.Writer
+	n      int // bytes passed through so far
+	chunks []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	if cw.n < png_ihdr_end {
+		head := min(len(p), png_ihdr_end-cw.n)
+		if _, err := cw.w.Write(p[:head]); err != nil {
+			return 0, err
+		}
+		cw.n += head
+		written, p = head, p[head:]
+
+		if cw.n == png_ihdr_end {
+			if _, err := cw.w.Write(cw.chunks); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return written + n, err
+}
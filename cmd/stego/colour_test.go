@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+	"testing/fstest"
+)
+
+// testChunk returns a PNG chunk of the given type and data.
+func testChunk(kind string, data []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(c, kind...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func TestColourChunks(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	iccp := testChunk("iCCP", []byte("profile\x00\x00not really zlib"))
+	gama := testChunk("gAMA", []byte{0, 0, 0xb1, 0x8f})
+	text := testChunk("tEXt", []byte("Comment\x00hello"))
+
+	// A source PNG carrying a profile, a gamma and a comment
+	var src []byte
+	src = append(src, b.Bytes()[:png_ihdr_end]...)
+	src = append(src, iccp...)
+	src = append(src, text...)
+	src = append(src, gama...)
+	src = append(src, b.Bytes()[png_ihdr_end:]...)
+	chunks, err := readColourChunks(fstest.MapFS{"src.png": {Data: src}}, "src.png")
+	if err != nil {
+		t.Fatalf("readColourChunks: %v", err)
+	}
+	if want := append(append([]byte{}, iccp...), gama...); !bytes.Equal(chunks, want) {
+		t.Fatalf("readColourChunks returned %q, want the iCCP and gAMA chunks %q", chunks, want)
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&chunkWriter{w: &out, chunks: chunks}, image.NewNRGBA64(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	if i := bytes.Index(out.Bytes(), chunks); i != png_ihdr_end {
+		t.Errorf("colour chunks written at offset %d, want %d", i, png_ihdr_end)
+	}
+	if _, err := png.Decode(&out); err != nil {
+		t.Errorf("output with colour chunks does not decode: %v", err)
+	}
+}
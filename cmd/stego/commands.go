@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/henrythewasp/stego"
+)
+
+// Flags each operation takes when run as a subcommand, such as stego encode,
+// which has a flag set of its own holding just these
+var command_flags = map[string][]string{
+	"encode": {
+		"i", "o", "f", "m", "hex", "bits", "bits-r", "bits-g", "bits-b", "bits-a", "plane", "pass", "mode", "channels", "hmac", "xor",
+		"minalpha", "region", "stride", "matrix", "interleave", "match", "opaque", "pad", "ecc", "slots", "slot", "compress",
+		"keepdepth", "scatter", "stealth", "split", "frames", "force", "selftest", "metrics", "pnglevel",
+		"dry-run", "decoy", "decoypass", "seed", "timestamp", "comment", "progress", "maxpixels", "quiet", "q",
+	},
+	"decode": {
+		"i", "f", "pass", "hmac", "xor", "slots", "slot", "join", "frames", "b64", "strict",
+		"progress", "maxpixels", "quiet", "q",
+	},
+	"append": {
+		"i", "o", "f", "m", "hex", "pass", "hmac", "xor", "slots", "slot", "pnglevel",
+		"seed", "progress", "maxpixels", "quiet", "q",
+	},
+	"capacity": {
+		"i", "bits", "bits-r", "bits-g", "bits-b", "bits-a", "plane", "pass", "mode", "channels", "hmac", "xor", "minalpha", "region",
+		"stride", "matrix", "interleave", "match", "opaque", "ecc", "slots", "slot", "keepdepth", "stealth", "timestamp", "comment", "json",
+		"maxpixels", "quiet", "q",
+	},
+	"detect": {"i", "json", "maxpixels", "quiet", "q"},
+	"verify": {
+		"i", "f", "pass", "hmac", "xor", "slots", "slot", "json",
+		"progress", "maxpixels", "quiet", "q",
+	},
+	"diff": {"i", "with", "o", "maxpixels", "quiet", "q"},
+	"list": {"i", "pass", "hmac", "xor", "slots", "slot", "json", "maxpixels", "quiet", "q"},
+	"cover": {
+		"o", "f", "m", "hex", "bits", "bits-r", "bits-g", "bits-b", "bits-a", "plane", "pass", "mode", "channels", "hmac", "xor", "stride",
+		"matrix", "interleave", "match", "opaque", "pad", "ecc", "slots", "slot", "compress", "keepdepth",
+		"scatter", "stealth", "pnglevel", "seed", "timestamp", "comment", "progress", "quiet", "q",
+	},
+}
+
+// Operations in the order usage lists them
+var command_names = []string{"encode", "decode", "append", "capacity", "detect", "verify", "diff", "cover", "list"}
+
+// command_line is the flag set the command line was parsed with: the global
+// one for -op, or that of the subcommand
+var command_line = flag.CommandLine
+
+// newCommand returns the flag set of the subcommand op, sharing the variables
+// of the global flags so the operations need not know how they were run.
+func newCommand(op string) *flag.FlagSet {
+	fs := flag.NewFlagSet("stego "+op, flag.ExitOnError)
+	for _, name := range command_flags[op] {
+		f := flag.CommandLine.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: stego %s [flags]\n", op)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandLine parses the command line, either as a subcommand (stego
+// encode -i ...) or with the operation given by -op.
+func parseCommandLine(args []string) error {
+	if len(args) == 0 || command_flags[args[0]] == nil {
+		flag.CommandLine.Parse(args)
+		return nil
+	}
+
+	op := args[0]
+	command_line = newCommand(op)
+	command_line.Parse(args[1:])
+	*operation = op
+	if command_line.NArg() > 0 {
+		return usageError{fmt.Sprintf("unexpected argument %q to %s", command_line.Arg(0), op)}
+	}
+	return nil
+}
+
+// usage describes the subcommands, and the flags of the -op form.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: stego <command> [flags], where command is one of:\n\n")
+	for _, op := range command_names {
+		fmt.Fprintf(w, "\t%s\n", op)
+	}
+	fmt.Fprintf(w, "\nRun stego <command> -h for the flags of each.  Or: stego -op <command> [flags], with any of:\n")
+	flag.PrintDefaults()
+}
+
+// printVersion prints the version of the module stego was built from, its
+// commit if known, and the version of the stego format it writes.
+func printVersion() {
+	version, commit := "unknown", ""
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				commit = s.Value
+			}
+		}
+	}
+	if commit != "" {
+		version += " (" + commit + ")"
+	}
+	fmt.Printf("stego %s\nstego format version %d (%d when extension flags are used)\n", version, stego.FormatVersion, stego.FormatVersion+1)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/henrythewasp/stego"
+)
+
+// cover generates a noise image just large enough for the message, hides the
+// message in it, and writes it to -o.
+func cover() error {
+	if err := checkOutputFormat(); err != nil {
+		return err
+	}
+
+	msg, length, err := openMessage(input_files)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+	info("message is %v bytes\n", length)
+
+	opts := options()
+	if messageFromFile() {
+		opts.Filename = filepath.Base(*message_filename)
+	}
+	img, err := stego.NewCover(length, opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		return fmt.Errorf("%w, even in the largest cover image", err)
+	}
+	if err != nil {
+		return err
+	}
+	info("generated a %vx%v noise cover image\n", img.Bounds().Dx(), img.Bounds().Dy())
+
+	output_image, err := stego.EncodeFrom(img, msg, length, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeImageFile(output_image, nil); err != nil {
+		return err
+	}
+	return reportUsage(output_image, opts)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/henrythewasp/stego"
+)
+
+// decoyEncode hides the -decoy file under -decoypass, and the message under
+// -pass behind it, so either password gives back its own message.
+func decoyEncode() error {
+	info("encoding!\n")
+
+	r, _, err := openMessage(input_files)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read message: %w", err)
+	}
+	decoy, err := fs.ReadFile(input_files, *decoy_filename)
+	if err != nil {
+		return fmt.Errorf("cannot read decoy file: %w", err)
+	}
+	info("message is %v bytes, behind a decoy of %v bytes\n", len(msg), len(decoy))
+
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	// No file name is stored, as it would be the decoy's, and the message has
+	// no header to keep one of its own
+	opts := options()
+	opts.Password = *decoy_password
+
+	output_image, err := stego.EncodeDecoy(img, decoy, msg, *password, opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		return fmt.Errorf("%w (%s)", err, capacityHint())
+	}
+	if err != nil {
+		return err
+	}
+	reportMetrics(img, output_image)
+
+	chunks, err := readColourChunks(input_files, *input_filename)
+	if err != nil {
+		return err
+	}
+	return writeImageFile(output_image, chunks)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/henrythewasp/stego"
+)
+
+// diff compares the input image with the -with image, prints how many pixels
+// differ, and writes an image highlighting them to -o, if given.
+func diff() error {
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+	other, err := readImage(input_files, *with_filename)
+	if err != nil {
+		return err
+	}
+
+	out, n, err := stego.Diff(img, other)
+	if err != nil {
+		return err
+	}
+	total := img.Bounds().Dx() * img.Bounds().Dy()
+	fmt.Printf("%d of %d pixels differ (%.2f%%)\n", n, total, 100*float64(n)/float64(max(total, 1)))
+
+	if *output_filename == "" {
+		return nil
+	}
+	return writeImage(*output_filename, out, nil)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/henrythewasp/stego"
+)
+
+// buildStego builds the stego command into dir and returns its path.
+func buildStego(t *testing.T, dir string) string {
+	t.Helper()
+	bin := filepath.Join(dir, "stego")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	cmd := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-o", bin, ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// runStego runs the stego command bin with args in dir, and returns what it
+// wrote to STDOUT and its exit code.
+func runStego(t *testing.T, bin, dir string, args ...string) (string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	cmd.Dir, cmd.Stdout, cmd.Stderr = dir, &stdout, &stderr
+	err := cmd.Run()
+	code := 0
+	if ee := (*exec.ExitError)(nil); errors.As(err, &ee) {
+		code = ee.ExitCode()
+	} else if err != nil {
+		t.Fatalf("stego %v: %v", args, err)
+	}
+	t.Logf("stego %v exited %d\n%s", args, code, stderr.String())
+	return stdout.String(), code
+}
+
+// TestEndToEnd builds the command and runs it on real files, covering the flag
+// handling and file I/O the library tests do not.
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the command")
+	}
+	dir := t.TempDir()
+	bin := buildStego(t, dir)
+
+	// An 8 bit carrier, and a message to hide in it
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "carrier.png"), b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("the quick brown fox\x00\xff"), 50)
+	if err := os.WriteFile(filepath.Join(dir, "msg.bin"), msg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file round trips, and is recreated under its stored name
+	if _, code := runStego(t, bin, dir, "-op", "encode", "-bits", "2", "-pass", "pw", "-i", "carrier.png", "-o", "steg.png", "-f", "msg.bin"); code != 0 {
+		t.Fatalf("encode exited %d", code)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runStego(t, bin, dir, "-op", "decode", "-pass", "pw", "-i", "steg.png", "-f", "out"); code != 0 {
+		t.Fatalf("decode exited %d", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "out", "msg.bin")); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("decode wrote %d bytes, %v; want the %d hidden", len(got), err, len(msg))
+	}
+	if _, code := runStego(t, bin, dir, "-op", "verify", "-pass", "pw", "-i", "steg.png", "-f", "msg.bin"); code != 0 {
+		t.Errorf("verify exited %d, want 0", code)
+	}
+
+	// A message given with -m comes back on STDOUT
+	if _, code := runStego(t, bin, dir, "-op", "encode", "-q", "-i", "carrier.png", "-o", "text.png", "-m", "meet at 5"); code != 0 {
+		t.Fatalf("encode -m exited %d", code)
+	}
+	if out, code := runStego(t, bin, dir, "-op", "decode", "-q", "-i", "text.png"); code != 0 || out != "meet at 5" {
+		t.Errorf("decode to STDOUT gave %q, exit %d; want %q", out, code, "meet at 5")
+	}
+	if out, code := runStego(t, bin, dir, "-op", "decode", "-q", "-strict", "-i", "text.png"); code != 0 || out != "meet at 5" {
+		t.Errorf("strict decode to STDOUT gave %q, exit %d; want %q", out, code, "meet at 5")
+	}
+
+	// The same as subcommands, each taking only its own flags
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-i", "carrier.png", "-o", "sub.png", "-m", "meet at 6"); code != 0 {
+		t.Fatalf("encode subcommand exited %d", code)
+	}
+	if out, code := runStego(t, bin, dir, "decode", "-q", "-i", "sub.png"); code != 0 || out != "meet at 6" {
+		t.Errorf("decode subcommand gave %q, exit %d; want %q", out, code, "meet at 6")
+	}
+	if _, code := runStego(t, bin, dir, "encode", "-h"); code != 0 {
+		t.Errorf("encode -h exited %d, want 0", code)
+	}
+
+	// A message behind a decoy comes back with its own password
+	if err := os.WriteFile(filepath.Join(dir, "decoy.txt"), []byte("shopping list"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-i", "carrier.png", "-o", "decoy.png", "-m", "meet at 7", "-pass", "real", "-decoy", "decoy.txt", "-decoypass", "fake"); code != 0 {
+		t.Fatalf("encode -decoy exited %d", code)
+	}
+	for pass, want := range map[string]string{"fake": "shopping list", "real": "meet at 7"} {
+		if out, code := runStego(t, bin, dir, "decode", "-q", "-pass", pass, "-i", "decoy.png"); code != 0 || out != want {
+			t.Errorf("decode -pass %s of a decoy gave %q, exit %d; want %q", pass, out, code, want)
+		}
+	}
+
+	// Several files hidden together come back under their own names
+	if err := os.WriteFile(filepath.Join(dir, "second.txt"), []byte("and the lazy dog"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-i", "carrier.png", "-o", "files.png", "-f", "msg.bin", "-f", "second.txt"); code != 0 {
+		t.Fatalf("encode of two files exited %d", code)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "files"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-i", "files.png", "-f", "files"); code != 0 {
+		t.Fatalf("decode of two files exited %d", code)
+	}
+	for name, want := range map[string][]byte{"msg.bin": msg, "second.txt": []byte("and the lazy dog")} {
+		if got, err := os.ReadFile(filepath.Join(dir, "files", name)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("decode of two files gave %s as %q, %v", name, got, err)
+		}
+	}
+	if out, code := runStego(t, bin, dir, "list", "-i", "files.png"); code != 0 || !strings.Contains(out, "  msg.bin\n") || !strings.Contains(out, "16  second.txt\n") {
+		t.Errorf("list of two files gave %q, exit %d", out, code)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-i", "carrier.png", "-f", "a.txt", "-f", "b.txt"); code != 2 {
+		t.Errorf("decode with two -f exited %d, want 2", code)
+	}
+
+	// -seed makes the output file the same every time
+	var seeded [2][]byte
+	for i := range seeded {
+		name := fmt.Sprintf("seed%d.png", i)
+		if _, code := runStego(t, bin, dir, "encode", "-q", "-seed", "7", "-pass", "pw", "-pad", "2000", "-i", "carrier.png", "-o", name, "-m", "meet at 8"); code != 0 {
+			t.Fatalf("encode -seed exited %d", code)
+		}
+		var err error
+		if seeded[i], err = os.ReadFile(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(seeded[0], seeded[1]) {
+		t.Error("encode -seed twice gave different files")
+	}
+
+	// diff counts the pixels the message changed, and shows them
+	if out, code := runStego(t, bin, dir, "diff", "-i", "carrier.png", "-with", "sub.png", "-o", "diff.png"); code != 0 || out != "9 of 3072 pixels differ (0.29%)\n" {
+		t.Errorf("diff gave %q, exit %d", out, code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "diff.png")); err != nil {
+		t.Errorf("diff did not write its image: %v", err)
+	}
+
+	// detect shows the time and comment recorded by encode
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-timestamp", "-comment", "batch 2024", "-i", "carrier.png", "-o", "meta.png", "-m", "meet at 8"); code != 0 {
+		t.Fatalf("encode -timestamp -comment exited %d", code)
+	}
+	if out, code := runStego(t, bin, dir, "detect", "-i", "meta.png"); code != 0 || !strings.Contains(out, "hidden at: 20") || !strings.Contains(out, "comment: batch 2024\n") {
+		t.Errorf("detect of an image with a comment gave %q, exit %d", out, code)
+	}
+
+	// An empty file round trips to an empty file, and to nothing on STDOUT
+	if err := os.WriteFile(filepath.Join(dir, "empty.bin"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-pass", "pw", "-i", "carrier.png", "-o", "empty.png", "-f", "empty.bin"); code != 0 {
+		t.Fatalf("encode of an empty file exited %d", code)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-pass", "pw", "-i", "empty.png", "-f", "empty_out.bin"); code != 0 {
+		t.Errorf("decode of an empty message exited %d", code)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "empty_out.bin")); err != nil || fi.Size() != 0 {
+		t.Errorf("decode of an empty message wrote %v, %v", fi, err)
+	}
+	if out, code := runStego(t, bin, dir, "decode", "-q", "-pass", "pw", "-i", "empty.png", "-f", "-"); code != 0 || out != "" {
+		t.Errorf("decode of an empty message to STDOUT gave %q, exit %d", out, code)
+	}
+
+	// cover needs no carrier, and makes one the message just fits in
+	if _, code := runStego(t, bin, dir, "cover", "-q", "-pass", "pw", "-f", "msg.bin", "-o", "cover.png"); code != 0 {
+		t.Fatalf("cover exited %d", code)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-pass", "pw", "-i", "cover.png", "-f", "cover_out.bin"); code != 0 {
+		t.Errorf("decode of a generated cover exited %d", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "cover_out.bin")); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("decode of a generated cover gave %d bytes, %v", len(got), err)
+	}
+
+	// append hides the longer message with LSB matching again, as recorded
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-match", "-i", "carrier.png", "-o", "match.png", "-m", "meet at 9"); code != 0 {
+		t.Fatalf("encode -match exited %d", code)
+	}
+	if _, code := runStego(t, bin, dir, "append", "-q", "-i", "match.png", "-o", "match2.png", "-m", " sharp"); code != 0 {
+		t.Fatalf("append to a matched message exited %d", code)
+	}
+	if out, code := runStego(t, bin, dir, "decode", "-q", "-i", "match2.png"); code != 0 || out != "meet at 9 sharp" {
+		t.Errorf("decode after append gave %q, exit %d", out, code)
+	}
+	if f, err := os.Open(filepath.Join(dir, "match2.png")); err != nil {
+		t.Error(err)
+	} else {
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, err := stego.ReadHeader(img); err != nil || h.ExtFlags&stego.ExtFlagMatch == 0 {
+			t.Errorf("append dropped LSB matching: extension flags %#02x, %v", h.ExtFlags, err)
+		}
+	}
+
+	// Bits per channel are recorded in the header, so decode needs no flag
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-bits-r", "1", "-bits-b", "2", "-i", "carrier.png", "-o", "chan.png", "-f", "msg.bin"); code != 0 {
+		t.Fatalf("encode with -bits-r and -bits-b exited %d", code)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-i", "chan.png", "-f", "chan_out.bin"); code != 0 {
+		t.Errorf("decode of bits per channel exited %d", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "chan_out.bin")); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("decode of bits per channel gave %d bytes, %v", len(got), err)
+	}
+
+	// Error correction is recorded in the header, so decode needs no flag
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-ecc", "16", "-i", "carrier.png", "-o", "ecc.png", "-f", "msg.bin"); code != 0 {
+		t.Fatalf("encode with -ecc exited %d", code)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-i", "ecc.png", "-f", "ecc_out.bin"); code != 0 {
+		t.Errorf("decode of an error corrected message exited %d", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "ecc_out.bin")); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("decode of an error corrected message gave %d bytes, %v", len(got), err)
+	}
+
+	// A message too long for one frame is spread over those of an animation
+	if err := os.WriteFile(filepath.Join(dir, "anim.gif"), testGIF(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runStego(t, bin, dir, "encode", "-q", "-frames", "-i", "anim.gif", "-o", "anim.png", "-f", "msg.bin"); code != 0 {
+		t.Fatalf("encode with -frames exited %d", code)
+	}
+	if _, code := runStego(t, bin, dir, "decode", "-q", "-frames", "-i", "anim.png", "-f", "anim_out.bin"); code != 0 {
+		t.Errorf("decode with -frames exited %d", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "anim_out.bin")); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("decode with -frames gave %d bytes, %v", len(got), err)
+	}
+
+	// -version needs no other flags, and gives the format version written
+	if out, code := runStego(t, bin, dir, "-version"); code != 0 || !strings.Contains(out, "stego format version 3") {
+		t.Errorf("-version gave %q, exit %d", out, code)
+	}
+
+	// Results for scripts
+	out, code := runStego(t, bin, dir, "-op", "capacity", "-json", "-i", "carrier.png")
+	var c capacityResult
+	if err := json.Unmarshal([]byte(out), &c); code != 0 || err != nil || c.CapacityBytes <= len(msg) {
+		t.Errorf("capacity -json gave %q, exit %d, %v", out, code, err)
+	}
+	if _, code := runStego(t, bin, dir, "-op", "detect", "-i", "steg.png"); code != 0 {
+		t.Errorf("detect on a stego image exited %d, want 0", code)
+	}
+	if _, code := runStego(t, bin, dir, "-op", "detect", "-i", "carrier.png"); code != 1 {
+		t.Errorf("detect on the carrier exited %d, want 1", code)
+	}
+
+	// Mistakes on the command line exit 2, and other failures 1
+	for _, args := range [][]string{
+		{"-op", "encdoe", "-i", "carrier.png", "-o", "x.png", "-m", "x"},
+		{"-op", "encode", "-o", "x.png", "-m", "x"},
+		{"-op", "encode", "-i", "carrier.png", "-o", "carrier.png", "-m", "x"},
+		{"-op", "encode", "-i", "carrier.png", "-o", "x.png", "-m", "x", "-f", "msg.bin"},
+		{"-op", "decode", "-i", "steg.png", "-json"},
+		{"decode", "-i", "steg.png", "-o", "x.png"},
+		{"detect", "-i", "steg.png", "steg.png"},
+		{"-op", "cover", "-i", "carrier.png", "-o", "x.png", "-m", "x"},
+		{"-op", "decode", "-i", "steg.png", "-ecc", "8"},
+		{"encode", "-strict", "-i", "carrier.png", "-o", "x.png", "-m", "x"},
+		{"encode", "-frames", "-i", "anim.gif", "-o", "anim.tif", "-m", "x"},
+		{"encode", "-op", "decode", "-i", "carrier.png", "-o", "x.png", "-m", "x"},
+	} {
+		if _, code := runStego(t, bin, dir, args...); code != 2 {
+			t.Errorf("stego %v exited %d, want 2", args, code)
+		}
+	}
+	for _, args := range [][]string{
+		{"-op", "decode", "-pass", "wrong", "-i", "steg.png", "-f", "wrong.bin"},
+		{"-op", "decode", "-i", "missing.png"},
+		{"-op", "encode", "-i", "carrier.png", "-o", "x.png", "-f", "missing.bin"},
+		{"-op", "decode", "-maxpixels", "1000", "-i", "steg.png"},
+	} {
+		if _, code := runStego(t, bin, dir, args...); code != 1 {
+			t.Errorf("stego %v exited %d, want 1", args, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wrong.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("decode with the wrong password left wrong.bin behind: %v", err)
+	}
+}
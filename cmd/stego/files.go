@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// input_files is where input images and message files are read from: the
+// operating system's files, named as on the command line.
+var input_files fs.FS = osFS{}
+
+// osFS opens files by the paths given on the command line, absolute or
+// relative to the working directory, which os.DirFS does not allow.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
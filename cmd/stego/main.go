@@ -0,0 +1,1296 @@
+// Command stego hides binary content in PNG image files, and extracts it again.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/henrythewasp/stego"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// Cmd line options
+var input_filename = flag.String("i", "", "input image file (PNG, TIFF, BMP, JPEG or GIF)")
+var output_filename = flag.String("o", "", "output image file (written as TIFF if named .tif or .tiff, otherwise PNG)")
+var message_filename = new(string) // the first -f
+var message_files fileList
+var message_text = flag.String("m", "", "message text to hide, instead of reading it from -f")
+var message_hex = flag.String("hex", "", "message bytes to hide, as hex (such as 48656c6c6f), instead of reading them from -f")
+var operation = flag.String("op", "encode", "encode, decode, append, capacity, detect, verify, diff, cover or list, unless given as a subcommand (stego encode ...)")
+var bits_per_channel = flag.Int("bits", 0, "bits of each colour value used to hide the message (1, 2, 4 or 8, or 0 for 8, or 4 with -keepdepth); decode reads it from the image")
+var channel_bits = [4]*int{
+	flag.Int("bits-r", 0, "bits of each red value used to hide the message, with -bits-g, -bits-b and -bits-a instead of -bits, so blue can hold more than red and green (0, 1, 2, 4 or 8; 0 leaves it alone)"),
+	flag.Int("bits-g", 0, "bits of each green value used to hide the message, with -bits-r, -bits-b and -bits-a"),
+	flag.Int("bits-b", 0, "bits of each blue value used to hide the message, with -bits-r, -bits-g and -bits-a"),
+	flag.Int("bits-a", 0, "bits of each alpha value used to hide the message, with -bits-r, -bits-g and -bits-b"),
+}
+var bit_plane = flag.Int("plane", 0, "lowest bit of each colour value used to hide the message (-bits + -plane at most 8)")
+var password = flag.String("pass", "", "password to encrypt the message with on encode, or decrypt it with on decode")
+var mode = flag.String("mode", stego.ModeSequential, "sequential (a byte per colour value, or -bits of one) or spread (2 bits of each byte in each of R, G, B & A)")
+var channels = flag.String("channels", stego.ChannelsRGBA, "colour values to hide the message in: rgba, rgb to leave alpha untouched, or b for blue only")
+var hmac_key = flag.String("hmac", "", "key to tag the message with an HMAC on encode, or check the tag with on decode")
+var xor_key = flag.String("xor", "", "key to XOR the hidden data with on encode, or undo it with on decode, as light obfuscation (not encryption: use -pass for that)")
+var with_filename = flag.String("with", "", "on diff, the image to compare the input image with, such as the stego image made from it")
+var decoy_filename = flag.String("decoy", "", "on encode, a decoy file to hide under -decoypass, with the message hidden behind it under -pass, so each password reveals just its own")
+var decoy_password = flag.String("decoypass", "", "password to encrypt the -decoy file with, and to give up if forced to")
+var min_alpha = flag.Int("minalpha", 0, "leave alone the alpha of pixels whose alpha (0-255) is below this, so transparency is kept")
+var region = flag.String("region", "", "x,y,w,h of the rectangle of the image to hide the message in, such as a busy part of the picture")
+var stride = flag.Int("stride", 0, "hide the message in every Nth pixel, spreading a small message over the whole image")
+var matrix = flag.Int("matrix", 0, "matrix embed k bits (2 to 8) in each 2^k-1 low bits, changing at most one of them, so far fewer values change (at the cost of capacity)")
+var frames = flag.Bool("frames", false, "hide the message over the frames of an animated GIF or PNG input image, as many as it needs, writing an animated PNG; decode reads it back from all of them")
+var interleave = flag.Bool("interleave", false, "fill each row with the message a colour value at a time (the red of every pixel, then the green...), so a short message spreads along the row")
+var match = flag.Bool("match", false, "LSB matching: change a colour value whose low bit must change by 1 up or down at random, rather than setting the bit, so the message is harder to detect (1 bit per value)")
+var opaque = flag.Bool("opaque", false, "write a fully opaque output image, with the message kept out of alpha (-channels rgb unless given)")
+var pad = flag.Int("pad", 0, "pad the hidden data with random bytes to this many bytes, so messages of any length alter the same pixels")
+var ecc = flag.Int("ecc", 0, "add this many Reed-Solomon parity bytes (2 to 254) to each 255 byte block hidden, so up to half as many damaged bytes in each can be corrected")
+var slots = flag.Int("slots", 1, "number of equal slots the image is divided into, each holding its own message")
+var slot = flag.Int("slot", 0, "slot (from 0) to hide the message in or extract it from, with -slots")
+var compress_message = flag.Bool("compress", false, "gzip the message before hiding it")
+var keep_depth = flag.Bool("keepdepth", false, "keep an 8 bit input image at 8 bits per colour value in the output (with -bits 1, 2 or 4)")
+var scatter = flag.Bool("scatter", false, "hide the message in a password-seeded order of pixels (needs -pass)")
+var show_progress = flag.Bool("progress", false, "show the percentage of the message hidden or recovered so far on STDERR")
+var stealth = flag.Bool("stealth", false, "hide the message as imperceptibly as possible: 1 bit of blue per pixel, scattered (needs -pass; holds a byte per 8 pixels)")
+var strict = flag.Bool("strict", false, "on decode, check the whole message before writing any of it, and refuse one hidden with -ecc that needed correcting")
+var base64_output = flag.Bool("b64", false, "write the decoded message as Base64 text, so binary data is safe to show in a terminal")
+var json_output = flag.Bool("json", false, "print the result of capacity, detect, verify or list as JSON")
+var split = flag.Bool("split", false, "encode a message too big for one image over the images matching the -i pattern, written to -o with %d for each number (from 0)")
+var join = flag.Bool("join", false, "decode a message split over the images matching the -i pattern, in any order")
+var force = flag.Bool("force", false, "on encode, hide as much of a message too big for the image as fits, and write -o as JPEG, GIF or BMP if asked, with warnings instead of errors")
+var self_test = flag.Bool("selftest", false, "on encode, decode the output image in memory, as written, and check it gives back the message before writing it")
+var metrics = flag.Bool("metrics", false, "print the PSNR of the output image against the input, and the chi-square LSB suspicion of each, on encode, to STDERR, as measures of how much it was altered and how detectably")
+var quiet = flag.Bool("quiet", false, "print only results and errors, not informational messages (which go to STDERR)")
+var png_level = flag.String("pnglevel", "default", "compression of a PNG output image: best, default, fast or none, trading file size for speed")
+var max_pixels = flag.Int("maxpixels", 0, "refuse input images with more than this many pixels, checked before decoding them, so a huge image cannot exhaust memory")
+var show_version = flag.Bool("version", false, "print the version of stego and of the stego format it writes, and exit")
+var seed = flag.Uint64("seed", 0, "on encode, draw the random padding, salt and nonce from a generator with this seed, so the same input always gives a byte-identical image, for reproducible builds (not for secrets)")
+var timestamp = flag.Bool("timestamp", false, "on encode, record the time the message was hidden in the header (in the clear), for detect and decode to show")
+var comment = flag.String("comment", "", "on encode, a comment of up to 255 bytes, such as where the image came from, to record in the header (in the clear), for detect and decode to show")
+var dry_run = flag.Bool("dry-run", false, "encode without writing the output image, just to report whether the message fits")
+
+// Example encode usage: go run ./cmd/stego encode -i test.png -o steg.png -f hide.txt
+// Example encode from STDIN: echo hello | go run ./cmd/stego encode -i test.png -o steg.png
+// Example encode of a short message: go run ./cmd/stego encode -i test.png -o steg.png -m "meet at 5"
+// Example decode usage: go run ./cmd/stego decode -i steg.png -f out.txt
+// Example decode to STDOUT: go run ./cmd/stego decode -i steg.png > out.bin
+// Example decode as Base64: go run ./cmd/stego decode -i steg.png -b64
+// Example decode to the stored file name: go run ./cmd/stego decode -i steg.png -f outdir/
+// Example of hiding raw bytes: go run ./cmd/stego encode -i test.png -o steg.png -hex 48656c6c6f
+// Example of checking a message fits: go run ./cmd/stego encode -dry-run -compress -i test.png -f hide.txt
+// Example capacity usage: go run ./cmd/stego capacity -bits 2 -i test.png
+// Example of hiding in part of the image: go run ./cmd/stego encode -region 100,50,200,150 -i test.png -o steg.png -f hide.txt
+// Example of spreading a short message evenly: go run ./cmd/stego encode -stride 16 -i test.png -o steg.png -m "meet at 5"
+// Example of changing as few values as possible: go run ./cmd/stego encode -matrix 4 -i test.png -o steg.png -m "meet at 5"
+// Example of surviving a few edited pixels: go run ./cmd/stego encode -ecc 32 -i test.png -o steg.png -f hide.txt
+// Example of a fixed size footprint: go run ./cmd/stego encode -pad 4096 -i test.png -o steg.png -f hide.txt
+// Example of a second message in its own slot: go run ./cmd/stego encode -slots 2 -slot 1 -i steg.png -o steg2.png -f other.txt
+// Example of splitting over several images: go run ./cmd/stego encode -split -i "img*.png" -o "out%d.png" -f big.bin
+// Example of joining it again: go run ./cmd/stego decode -join -i "out*.png" -f big.bin
+// Example of hiding over the frames of an animation: go run ./cmd/stego encode -frames -i anim.gif -o steg.png -f big.bin
+// Example of decoding only a message that checks out: go run ./cmd/stego decode -strict -i steg.png > out.txt
+// Example detect usage: go run ./cmd/stego detect -i steg.png
+// Example verify usage: go run ./cmd/stego verify -i steg.png -f hide.txt
+// Example append usage: go run ./cmd/stego append -i steg.png -o steg2.png -f more.txt
+// Example diff usage: go run ./cmd/stego diff -i test.png -with steg.png -o diff.png
+// Example cover usage: go run ./cmd/stego cover -f hide.txt -o noise.png
+// Example list usage: go run ./cmd/stego list -i steg.png
+
+func init() {
+	flag.Var(&message_files, "f", "message input `file` (encode reads STDIN if omitted or -; give -f more than once to hide several files together), decode output file or directory, or file verify expects")
+	flag.BoolVar(quiet, "q", false, "shorthand for -quiet")
+	flag.Usage = usage
+}
+
+// info prints an informational message to STDERR, so it never mixes with a
+// message decoded to STDOUT, unless -quiet was given.
+func info(format string, args ...any) {
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// Rectangle parsed from -region by checkFlags
+var region_rect image.Rectangle
+
+// Message bytes parsed from -hex by checkFlags
+var message_hex_bytes []byte
+
+// PNG compression levels -pnglevel can name
+var png_levels = map[string]png.CompressionLevel{
+	"best":    png.BestCompression,
+	"default": png.DefaultCompression,
+	"fast":    png.BestSpeed,
+	"none":    png.NoCompression,
+}
+
+// parseRect parses a rectangle given as x,y,w,h.
+func parseRect(s string) (image.Rectangle, error) {
+	var x, y, w, h int
+	if n, err := fmt.Sscanf(s, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil || n != 4 || x < 0 || y < 0 || w <= 0 || h <= 0 {
+		return image.Rectangle{}, fmt.Errorf("invalid rectangle %q (want x,y,w,h)", s)
+	}
+	return image.Rect(x, y, x+w, y+h), nil
+}
+
+// options builds the library options from the command line flags.
+func options() stego.Options {
+	opts := stego.Options{
+		Bits:       *bits_per_channel,
+		Plane:      *bit_plane,
+		Mode:       *mode,
+		Channels:   *channels,
+		Password:   *password,
+		HMACKey:    *hmac_key,
+		XORKey:     *xor_key,
+		Compress:   *compress_message,
+		Scatter:    *scatter,
+		KeepDepth:  *keep_depth,
+		Slots:      *slots,
+		Slot:       *slot,
+		MinAlpha:   *min_alpha,
+		Rect:       region_rect,
+		Stride:     *stride,
+		Matrix:     *matrix,
+		Interleave: *interleave,
+		Match:      *match,
+		Pad:        *pad,
+		ECC:        *ecc,
+		Comment:    *comment,
+		MaxPixels:  *max_pixels,
+		Strict:     *strict,
+	}
+	for ch, bits := range channel_bits {
+		opts.ChannelBits[ch] = *bits
+	}
+	if *timestamp {
+		opts.Time = time.Now()
+	}
+	if isFlagSet("seed") {
+		var s [32]byte
+		binary.BigEndian.PutUint64(s[:], *seed)
+		opts.Rand = rand.NewChaCha8(s)
+	}
+	if *stealth {
+		s := stego.StealthOptions(*password)
+		opts.Bits, opts.Channels, opts.Scatter = s.Bits, s.Channels, s.Scatter
+	}
+	if *opaque {
+		opts.Opaque = true
+		if !isFlagSet("channels") && !*stealth && opts.ChannelBits == [4]int{} {
+			opts.Channels = stego.ChannelsRGB
+		}
+	}
+	if *show_progress {
+		opts.Progress = progressReporter(*operation)
+	}
+	return opts
+}
+
+// hiddenAt returns the time the message described by h was hidden, in RFC 3339
+// form, or "" if it was not recorded.
+func hiddenAt(h stego.Header) string {
+	if h.Time == 0 {
+		return ""
+	}
+	return time.Unix(int64(h.Time), 0).UTC().Format(time.RFC3339)
+}
+
+// printMeta prints the time the message described by h was hidden and its
+// comment to w, if they were recorded.
+func printMeta(w io.Writer, h stego.Header) {
+	if t := hiddenAt(h); t != "" {
+		fmt.Fprintf(w, "hidden at: %v\n", t)
+	}
+	if h.Comment != "" {
+		fmt.Fprintf(w, "comment: %v\n", h.Comment)
+	}
+}
+
+// progressReporter returns a progress callback that shows the percentage done
+// on STDERR, rewriting the line as it changes.
+func progressReporter(op string) func(done, total int) {
+	last := -1
+	return func(done, total int) {
+		percent := 100
+		if total > 0 {
+			percent = done * 100 / total
+		}
+		if percent == last {
+			return
+		}
+		last = percent
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%%", op, percent)
+		if done == total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+// messageFromFile reports whether encode reads the message from a named file
+// (rather than -m or STDIN).
+func messageFromFile() bool {
+	return !isFlagSet("m") && !isFlagSet("hex") && *message_filename != "" && *message_filename != "-"
+}
+
+// readImageFile decodes the -i image file from fsys.
+func readImageFile(fsys fs.FS) (image.Image, error) {
+	return readImage(fsys, *input_filename)
+}
+
+// readImage decodes the image file name from fsys.
+func readImage(fsys fs.FS, name string) (image.Image, error) {
+	input_reader, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open input image: %w", err)
+	}
+	defer input_reader.Close()
+
+	// Check the size from the image header before decoding the pixels
+	if *max_pixels > 0 {
+		cfg, _, err := image.DecodeConfig(input_reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode input image: %w", err)
+		}
+		if n := int64(cfg.Width) * int64(cfg.Height); n > int64(*max_pixels) {
+			return nil, fmt.Errorf("%w: %dx%d image has %d pixels, more than -maxpixels %d", stego.ErrCarrierTooLarge, cfg.Width, cfg.Height, n, *max_pixels)
+		}
+		input_reader.Close()
+		if input_reader, err = fsys.Open(name); err != nil {
+			return nil, fmt.Errorf("cannot open input image: %w", err)
+		}
+		defer input_reader.Close()
+	}
+
+	img, _, err := image.Decode(input_reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode input image: %w", err)
+	}
+
+	return img, nil
+}
+
+// openMessage opens the message to hide, from -m or -hex if given, otherwise
+// from STDIN if no file (or -) was given, or else the -f file from fsys, and
+// returns it with its length.  STDIN has no size, so it is read in full before
+// encoding starts; a file is streamed.
+func openMessage(fsys fs.FS) (io.ReadCloser, int, error) {
+	if isFlagSet("m") {
+		return io.NopCloser(strings.NewReader(*message_text)), len(*message_text), nil
+	}
+	if isFlagSet("hex") {
+		return io.NopCloser(bytes.NewReader(message_hex_bytes)), len(message_hex_bytes), nil
+	}
+
+	if !messageFromFile() {
+		msg, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot read message from STDIN: %w", err)
+		}
+		return io.NopCloser(bytes.NewReader(msg)), len(msg), nil
+	}
+
+	f, err := fsys.Open(*message_filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read message file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("cannot read message file: %w", err)
+	}
+	return f, int(fi.Size()), nil
+}
+
+// checkOutputFormat rejects output file names that ask for a format that
+// cannot hold the hidden message.  The output is written as a PNG or TIFF, since
+// re-encoding as JPEG (or quantising to a GIF palette) would destroy it, and
+// BMP cannot store 16 bits per colour value.  With -force it only warns.
+func checkOutputFormat() error {
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(*output_filename)); ext {
+	case ".jpg", ".jpeg", ".gif":
+		err = fmt.Errorf("cannot write output image as %s: lossy output would destroy the hidden message (use .png or .tif)", ext)
+	case ".bmp":
+		err = fmt.Errorf("cannot write output image as %s: it cannot hold 16 bits per colour value (use .png or .tif)", ext)
+	}
+	if err != nil && *force {
+		fmt.Fprintf(os.Stderr, "warning: %v; writing it anyway (-force)\n", err)
+		return nil
+	}
+
+	return err
+}
+
+// fitMessage returns as much of the start of msg as can be hidden in img with
+// opts, which is all of it if it fits.  A compressed message is tried at
+// different lengths, since how well it compresses depends on its content.
+func fitMessage(img image.Image, msg []byte, opts stego.Options) []byte {
+	if !opts.Compress {
+		return msg[:min(len(msg), stego.Capacity(img, opts))]
+	}
+
+	fits := func(n int) bool {
+		_, err := stego.Encode(img, msg[:n], opts)
+		return err == nil
+	}
+	if fits(len(msg)) {
+		return msg
+	}
+	return msg[:sort.Search(len(msg), func(n int) bool { return !fits(n + 1) })]
+}
+
+// createFile creates the file name, reporting a missing directory plainly
+// rather than as the failure of the create.
+func createFile(name string) (*os.File, error) {
+	dir := filepath.Dir(name)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("directory %q does not exist", dir)
+	}
+	return os.Create(name)
+}
+
+// writeImageFile writes img to the output file as a TIFF or a PNG, with the
+// colour chunks copied from the input image if it is a PNG.
+func writeImageFile(img image.Image, chunks []byte) error {
+	return writeImage(*output_filename, img, chunks)
+}
+
+// writeImage writes img to the file name as a TIFF or a PNG, with the colour
+// chunks given.
+func writeImage(name string, img image.Image, chunks []byte) error {
+	output_writer, err := createFile(name)
+	if err != nil {
+		return fmt.Errorf("cannot create output image: %w", err)
+	}
+
+	if err := encodeImage(output_writer, name, img, chunks); err != nil {
+		output_writer.Close()
+		return fmt.Errorf("cannot write output image: %w", err)
+	}
+
+	if err := output_writer.Close(); err != nil {
+		return fmt.Errorf("cannot write output image: %w", err)
+	}
+
+	return nil
+}
+
+// encodeImage writes img to w in the format the file name asks for: a TIFF
+// (losslessly compressed) or a PNG with the colour chunks given, or, only with
+// -force, a lossy format.
+func encodeImage(w io.Writer, name string, img image.Image, chunks []byte) error {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tif", ".tiff":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 100})
+	case ".gif":
+		return gif.Encode(w, img, nil)
+	case ".bmp":
+		return bmp.Encode(w, img)
+	}
+	enc := png.Encoder{CompressionLevel: png_levels[*png_level]}
+	return enc.Encode(&chunkWriter{w: w, chunks: chunks}, img)
+}
+
+// selfTest writes the stego image img in memory, as it would be written to the
+// output file, reads it back and checks that it gives back msg.
+func selfTest(img image.Image, msg []byte, opts stego.Options) error {
+	var b bytes.Buffer
+	if err := encodeImage(&b, *output_filename, img, nil); err != nil {
+		return fmt.Errorf("self-test: cannot write output image: %w", err)
+	}
+	saved, _, err := image.Decode(&b)
+	if err != nil {
+		return fmt.Errorf("self-test: cannot read back output image: %w", err)
+	}
+
+	opts.Progress = nil
+	got, err := stego.Decode(saved, opts)
+	if err != nil {
+		return fmt.Errorf("self-test failed: the message cannot be recovered from the output image as written: %w", err)
+	}
+	if !bytes.Equal(got, msg) {
+		return errors.New("self-test failed: the message recovered from the output image as written differs from the one hidden")
+	}
+	info("self-test passed: the message survives being written and read back\n")
+	return nil
+}
+
+// capacityHint suggests how to fit a message that is too big for the image.
+func capacityHint() string {
+	hint := "try "
+	if *matrix > 2 {
+		hint += "a lower -matrix or "
+	}
+	if *ecc > 2 {
+		hint += "a lower -ecc or "
+	}
+	if *mode != stego.ModeSpread && *bits_per_channel != 0 && *bits_per_channel < 8 {
+		hint += "-bits 8 or "
+	}
+	if *channels == stego.ChannelsRGB {
+		hint += "-channels rgba or "
+	}
+	if !*compress_message {
+		hint += "-compress or "
+	}
+	return hint + "a larger carrier"
+}
+
+func encode() error {
+	if err := checkOutputFormat(); err != nil {
+		return err
+	}
+	if *split {
+		return splitEncode()
+	}
+	if *frames {
+		return framesEncode()
+	}
+	if *decoy_filename != "" {
+		return decoyEncode()
+	}
+	if len(message_files) > 1 {
+		return encodeFiles()
+	}
+
+	info("encoding!\n")
+
+	msg, length, err := openMessage(input_files)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+	info("message is %v bytes\n", length)
+
+	// Decode the image
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	// Remember the file name, so decode can recreate the file
+	opts := options()
+	if messageFromFile() {
+		opts.Filename = filepath.Base(*message_filename)
+	}
+
+	info("can hide up to %v bytes\n", stego.Capacity(img, opts))
+	if *stealth {
+		fmt.Fprintf(os.Stderr, "warning: -stealth hides just 1 bit per pixel, so the image holds only %v bytes\n", stego.Capacity(img, opts))
+	}
+
+	// With -force, cut a message that is too big down to what fits; the self
+	// test needs the whole message to compare against
+	var r io.Reader = msg
+	var data []byte
+	if *force || *self_test {
+		if data, err = io.ReadAll(msg); err != nil {
+			return fmt.Errorf("cannot read message: %w", err)
+		}
+		if *force {
+			if fit := fitMessage(img, data, opts); len(fit) < len(data) {
+				fmt.Fprintf(os.Stderr, "warning: hiding only the first %v of the %v bytes of the message, which is all that fits (-force)\n", len(fit), len(data))
+				data = fit
+			}
+		}
+		r, length = bytes.NewReader(data), len(data)
+	}
+
+	output_image, err := stego.EncodeFrom(img, r, length, opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		if *dry_run {
+			fmt.Printf("does not fit: payload is %v bytes\n", ce.Payload)
+		}
+		return fmt.Errorf("%w (%s)", err, capacityHint())
+	}
+	if err != nil {
+		return err
+	}
+	if *self_test {
+		if err := selfTest(output_image, data, opts); err != nil {
+			return err
+		}
+	}
+
+	// Report the payload actually stored (after compression and encryption)
+	// instead of writing the image
+	if *dry_run {
+		h, err := stego.ReadSlotHeader(output_image, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("fits: payload is %v bytes\n", h.PayloadLen)
+		reportMetrics(img, output_image)
+		return reportUsage(output_image, opts)
+	}
+
+	// Keep the original's colour profile, so the output looks the same
+	chunks, err := readColourChunks(input_files, *input_filename)
+	if err != nil {
+		return err
+	}
+
+	// Write the new file out
+	if err := writeImageFile(output_image, chunks); err != nil {
+		return err
+	}
+	reportMetrics(img, output_image)
+	return reportUsage(output_image, opts)
+}
+
+// reportMetrics prints the PSNR of the stego image out against the carrier img,
+// and how suspicious the low bits of each look, to STDERR, if -metrics was
+// given.
+func reportMetrics(img, out image.Image) {
+	if *metrics {
+		fmt.Fprintf(os.Stderr, "PSNR: %.1f dB\n", stego.PSNR(img, out))
+		fmt.Fprintf(os.Stderr, "chi-square LSB suspicion: %.2f (carrier %.2f)\n", stego.ChiSquareLSB(out), stego.ChiSquareLSB(img))
+	}
+}
+
+// reportUsage prints how much of the stego image img carries the message, to
+// STDERR, to help judge how detectable it is.
+func reportUsage(img image.Image, opts stego.Options) error {
+	h, err := stego.ReadSlotHeader(img, opts)
+	if err != nil {
+		return err
+	}
+	used, err := stego.PixelsUsed(img, opts)
+	if err != nil {
+		return err
+	}
+
+	total := img.Bounds().Dx() * img.Bounds().Dy()
+	padded := ""
+	if h.Flags&stego.FlagPadded != 0 {
+		padded = fmt.Sprintf(" padded to %v", h.PaddedLen)
+	}
+	info("embedded %v bytes%s using %v pixels (%.1f%% of image)\n", h.PayloadLen, padded, used, float64(used)*100/float64(max(total, 1)))
+	return nil
+}
+
+// decodeFilename picks the file to write the decoded message to, given the file
+// name stored in the image (if any).  -f names the file, unless it is a
+// directory, in which case the stored name is used within it, or is -, for
+// STDOUT.  Without -f the stored name is used in the current directory, and if
+// there is none the message goes to STDOUT ("").
+func decodeFilename(stored string) (string, error) {
+	// The stored name comes from the image, so never let it leave the directory
+	if stored != "" {
+		stored = filepath.Base(stored)
+		if stored == "." || stored == ".." || stored == string(filepath.Separator) {
+			return "", fmt.Errorf("invalid file name %q stored in image", stored)
+		}
+	}
+
+	if *message_filename == "" {
+		return stored, nil
+	}
+	if *message_filename == "-" {
+		// As for encode, where it is STDIN
+		return "", nil
+	}
+
+	fi, err := os.Stat(*message_filename)
+	if err != nil || !fi.IsDir() {
+		return *message_filename, nil
+	}
+	if stored == "" {
+		return "", fmt.Errorf("no file name stored in image to write into directory %s", *message_filename)
+	}
+
+	return filepath.Join(*message_filename, stored), nil
+}
+
+// decodeOutput is decodeFilename, with .b64 added to the name if it is the
+// stored one and -b64 was given.
+func decodeOutput(stored string) (string, error) {
+	output_filename, err := decodeFilename(stored)
+	if err != nil {
+		return "", err
+	}
+
+	// A file named after the stored name holds Base64, not the original file
+	if *base64_output && output_filename != "" && output_filename != *message_filename {
+		output_filename += ".b64"
+	}
+	return output_filename, nil
+}
+
+func decode() error {
+	if *join {
+		return joinDecode()
+	}
+	if *frames {
+		return framesDecode()
+	}
+
+	// Decode the image
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	h, err := stego.ReadSlotHeader(img, options())
+	if err != nil {
+		return err
+	}
+	if !*quiet {
+		printMeta(os.Stderr, h)
+	}
+	if h.ExtFlags&stego.ExtFlagFiles != 0 {
+		return decodeFiles(img)
+	}
+
+	output_filename, err := decodeOutput(h.Filename)
+	if err != nil {
+		return err
+	}
+
+	// Write message out, either to STDOUT or file (if -f opt used, or a file
+	// name was stored), as it is recovered
+	if output_filename == "" {
+		// STDOUT gets the raw message bytes only, so report progress on STDERR
+		info("Decoding to STDOUT\n")
+		return decodeMessage(img, os.Stdout)
+	}
+
+	info("Decoding contents to %v\n", output_filename)
+	output_writer, err := createFile(output_filename)
+	if err != nil {
+		return fmt.Errorf("cannot create message file: %w", err)
+	}
+
+	if err := decodeMessage(img, output_writer); err != nil {
+		// Don't leave a partial or damaged message behind
+		output_writer.Close()
+		os.Remove(output_filename)
+		return err
+	}
+
+	if err := output_writer.Close(); err != nil {
+		return fmt.Errorf("cannot write message file: %w", err)
+	}
+
+	return nil
+}
+
+// decodeMessage writes the message hidden in img to w, as it is recovered, and
+// Base64 encoded (ending with a newline) if -b64 was given.
+func decodeMessage(img image.Image, w io.Writer) error {
+	if !*base64_output {
+		_, err := stego.DecodeTo(img, w, options())
+		return err
+	}
+
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := stego.DecodeTo(img, enc, options()); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// headerOptions returns the options from the command line, with the layout,
+// LSB matching, compression, scattering, padding, error correction, file name,
+// time and comment changed to those the message described by h was hidden
+// with, so it can be hidden again the same way.  The keys (-pass, -hmac and
+// -xor), the slot, -opaque and -seed are not in the header, so are left as
+// given on the command line.
+func headerOptions(h stego.Header) stego.Options {
+	opts := options()
+	opts.Bits = int(h.Bits)
+	opts.Plane = int(h.Plane)
+	opts.Mode = stego.ModeSequential
+	if h.Flags&stego.FlagSpread != 0 {
+		opts.Mode = stego.ModeSpread
+	}
+	opts.Channels = stego.ChannelsRGBA
+	if h.Flags&stego.FlagRGB != 0 {
+		opts.Channels = stego.ChannelsRGB
+	}
+	if h.Flags&stego.FlagBlue != 0 {
+		opts.Channels = stego.ChannelsBlue
+	}
+	opts.ChannelBits = [4]int{}
+	if h.ExtFlags&stego.ExtFlagChannelBits != 0 {
+		for ch, bits := range h.ChannelBits {
+			opts.ChannelBits[ch] = int(bits)
+		}
+		opts.Bits = 0
+	}
+	opts.Compress = h.Flags&stego.FlagCompressed != 0
+	opts.Scatter = h.Flags&stego.FlagScatter != 0
+	opts.KeepDepth = h.Flags&stego.FlagDepth8 != 0
+	opts.MinAlpha = int(h.MinAlpha)
+	opts.Rect = h.Rect
+	opts.Stride = int(h.Stride)
+	opts.Matrix = int(h.Matrix)
+	opts.Interleave = h.ExtFlags&stego.ExtFlagInterleave != 0
+	opts.Match = h.ExtFlags&stego.ExtFlagMatch != 0
+	opts.Pad = int(h.PaddedLen)
+	opts.ECC = int(h.ECC)
+	opts.Filename = h.Filename
+	opts.Time = time.Time{}
+	if h.Time != 0 {
+		opts.Time = time.Unix(int64(h.Time), 0)
+	}
+	opts.Comment = h.Comment
+	return opts
+}
+
+// appendMessage adds the message to the end of the one already hidden in the
+// input image, and hides the whole lot again, the same way, in the output.
+func appendMessage() error {
+	if err := checkOutputFormat(); err != nil {
+		return err
+	}
+
+	// Decode the image, and the message already in it
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+	h, err := stego.ReadSlotHeader(img, options())
+	if errors.Is(err, stego.ErrNotStego) {
+		return fmt.Errorf("%w (append needs the stego image, not the original)", err)
+	}
+	if err != nil {
+		return err
+	}
+	if h.ExtFlags&stego.ExtFlagFiles != 0 {
+		return errors.New("image holds a set of files, which append cannot add to (encode them again, with the new one)")
+	}
+	opts := headerOptions(h)
+	existing, err := stego.Decode(img, opts)
+	if err != nil {
+		return err
+	}
+
+	msg, _, err := openMessage(input_files)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+	more, err := io.ReadAll(msg)
+	if err != nil {
+		return fmt.Errorf("cannot read message: %w", err)
+	}
+	info("appending %v bytes to the %v already hidden\n", len(more), len(existing))
+
+	output_image, err := stego.Encode(img, append(existing, more...), opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		return fmt.Errorf("%w (%s)", err, capacityHint())
+	}
+	if err != nil {
+		return err
+	}
+
+	chunks, err := readColourChunks(input_files, *input_filename)
+	if err != nil {
+		return err
+	}
+	return writeImageFile(output_image, chunks)
+}
+
+// printJSON prints v as a line of JSON.
+func printJSON(v any) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// layoutBits returns the bits per colour value the options hide a message in
+// img with, allowing for the default, or 0 in spread mode.
+func layoutBits(img image.Image, opts stego.Options) int {
+	switch {
+	case opts.Mode == stego.ModeSpread, opts.ChannelBits != [4]int{}:
+		return 0
+	case opts.Bits != 0:
+		return opts.Bits
+	}
+
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+	default:
+		if opts.KeepDepth {
+			return 4
+		}
+	}
+	return 8
+}
+
+// channelBits returns the bits of each channel opts choose, or nil if they
+// choose the same for every channel.
+func channelBits(opts stego.Options) *[4]int {
+	if opts.ChannelBits == [4]int{} {
+		return nil
+	}
+	return &opts.ChannelBits
+}
+
+// capacityResult is the JSON printed by capacity.
+type capacityResult struct {
+	CapacityBytes int     `json:"capacity_bytes"`
+	Bits          int     `json:"bits,omitempty"`
+	ChannelBits   *[4]int `json:"channel_bits,omitempty"` // R, G, B and A, if chosen separately
+	Channels      string  `json:"channels"`
+	Mode          string  `json:"mode"`
+	ECC           int     `json:"ecc,omitempty"` // parity bytes per block, if error corrected
+}
+
+func capacity() error {
+	// Decode the image
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	opts := options()
+	if *json_output {
+		return printJSON(capacityResult{
+			CapacityBytes: stego.Capacity(img, opts),
+			Bits:          layoutBits(img, opts),
+			ChannelBits:   channelBits(opts),
+			Channels:      opts.Channels,
+			Mode:          opts.Mode,
+			ECC:           opts.ECC,
+		})
+	}
+
+	fmt.Printf("usable capacity: %v bytes\n", stego.Capacity(img, opts))
+
+	return nil
+}
+
+// errNotDetected makes detect exit with 1 when there is no payload, without
+// printing an error.
+var errNotDetected = errors.New("no stego payload detected")
+
+// errMismatch makes verify exit with 1 when it has printed a JSON mismatch,
+// without printing an error.
+var errMismatch = errors.New("decoded message does not match")
+
+// detectResult is the JSON printed by detect.
+type detectResult struct {
+	Present      bool   `json:"present"`
+	PayloadBytes *int   `json:"payload_bytes,omitempty"` // nil if the format is unknown
+	Error        string `json:"error,omitempty"`
+	HiddenAt     string `json:"hidden_at,omitempty"` // RFC 3339, if recorded
+	Comment      string `json:"comment,omitempty"`
+}
+
+// detect reports whether the input image carries a stego payload.  Only the
+// header is read, so this is cheap even on large images.
+func detect() error {
+	// Decode the image
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	n, err := stego.Detect(img)
+	var h stego.Header
+	if err == nil {
+		h, err = stego.ReadHeader(img)
+	}
+	if *json_output {
+		switch {
+		case err == nil:
+			return printJSON(detectResult{Present: true, PayloadBytes: &n, HiddenAt: hiddenAt(h), Comment: h.Comment})
+		case errors.Is(err, stego.ErrUnsupportedFormat), errors.Is(err, stego.ErrCarrierDowngraded):
+			return printJSON(detectResult{Present: true, Error: err.Error()})
+		case errors.Is(err, stego.ErrNotStego):
+			if err := printJSON(detectResult{}); err != nil {
+				return err
+			}
+			return errNotDetected
+		}
+		return err
+	}
+
+	switch {
+	case err == nil:
+		fmt.Printf("stego payload present: %v bytes\n", n)
+		printMeta(os.Stdout, h)
+	case errors.Is(err, stego.ErrUnsupportedFormat):
+		fmt.Printf("stego payload present: unknown format (%v)\n", err)
+	case errors.Is(err, stego.ErrCarrierDowngraded):
+		fmt.Printf("stego payload present: unreadable (%v)\n", err)
+	case errors.Is(err, stego.ErrNotStego):
+		fmt.Println(errNotDetected)
+		return errNotDetected
+	default:
+		return err
+	}
+
+	return nil
+}
+
+// verifyResult is the JSON printed by verify.
+type verifyResult struct {
+	Match           bool `json:"match"`
+	DecodedBytes    int  `json:"decoded_bytes"`
+	ExpectedBytes   int  `json:"expected_bytes"`
+	FirstDifference *int `json:"first_difference,omitempty"`
+}
+
+// verify checks that the message hidden in the input image is exactly the -f
+// file, reporting the first byte that differs if not.
+func verify() error {
+	expected, err := fs.ReadFile(input_files, *message_filename)
+	if err != nil {
+		return fmt.Errorf("cannot read expected message file: %w", err)
+	}
+
+	// Decode the image
+	img, err := readImageFile(input_files)
+	if err != nil {
+		return err
+	}
+
+	msg, err := stego.Decode(img, options())
+	if err != nil {
+		return err
+	}
+
+	// Find the first byte that differs, if any
+	diff := -1
+	for i := range min(len(msg), len(expected)) {
+		if msg[i] != expected[i] {
+			diff = i
+			break
+		}
+	}
+	if diff < 0 && len(msg) != len(expected) {
+		diff = min(len(msg), len(expected))
+	}
+
+	if *json_output {
+		r := verifyResult{Match: diff < 0, DecodedBytes: len(msg), ExpectedBytes: len(expected)}
+		if diff >= 0 {
+			r.FirstDifference = &diff
+		}
+		if err := printJSON(r); err != nil {
+			return err
+		}
+		if diff >= 0 {
+			return errMismatch
+		}
+		return nil
+	}
+
+	if len(msg) != len(expected) {
+		return fmt.Errorf("decoded message is %d bytes, but %s is %d bytes (first difference at byte %d)", len(msg), *message_filename, len(expected), diff)
+	}
+	if diff >= 0 {
+		return fmt.Errorf("decoded message differs from %s at byte %d", *message_filename, diff)
+	}
+
+	fmt.Printf("verified: decoded message matches %s (%v bytes)\n", *message_filename, len(msg))
+	return nil
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	found := false
+	command_line.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// sameFile reports whether the paths a and b name the same file, either as
+// written or, if both exist, through a link.
+func sameFile(a, b string) bool {
+	abs_a, err_a := filepath.Abs(a)
+	abs_b, err_b := filepath.Abs(b)
+	if err_a == nil && err_b == nil && abs_a == abs_b {
+		return true
+	}
+
+	fi_a, err_a := os.Stat(a)
+	fi_b, err_b := os.Stat(b)
+	return err_a == nil && err_b == nil && os.SameFile(fi_a, fi_b)
+}
+
+// usageError is a mistake on the command line, reported with exit code 2.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+// checkFlags makes sure the flags each operation needs are present.
+func checkFlags() error {
+	switch *operation {
+	case "encode", "decode", "append", "capacity", "detect", "verify", "diff", "cover", "list":
+	default:
+		return usageError{fmt.Sprintf("unknown operation %q (want encode|decode|append|capacity|detect|verify|diff|cover|list)", *operation)}
+	}
+
+	if *operation == "cover" {
+		if *input_filename != "" {
+			return usageError{"cover generates the image to hide the message in, so takes no input image (-i)"}
+		}
+		if *output_filename == "" {
+			return usageError{"cover needs an output image (-o)"}
+		}
+	} else if *input_filename == "" {
+		return usageError{fmt.Sprintf("%s needs an input image (-i)", *operation)}
+	}
+	if *operation == "verify" && *message_filename == "" {
+		return usageError{"verify needs the expected message file (-f)"}
+	}
+	if *operation == "encode" && *output_filename == "" && !*dry_run {
+		return usageError{"encode needs an output image (-o)"}
+	}
+	if *operation == "append" && *output_filename == "" {
+		return usageError{"append needs an output image (-o)"}
+	}
+	if (*operation == "diff") != isFlagSet("with") {
+		if *operation != "diff" {
+			return usageError{"-with can only be used with diff"}
+		}
+		return usageError{"diff needs an image to compare the input image with (-with)"}
+	}
+	if *operation == "diff" && *output_filename != "" && (sameFile(*input_filename, *output_filename) || sameFile(*with_filename, *output_filename)) {
+		return usageError{fmt.Sprintf("output image %s is one of the images compared, which would be lost (choose a different -o)", *output_filename)}
+	}
+	if *split {
+		if *operation != "encode" {
+			return usageError{"-split can only be used with encode"}
+		}
+		if *dry_run {
+			return usageError{"-split and -dry-run cannot be used together"}
+		}
+		if strings.Count(*output_filename, "%d") != 1 || strings.Count(*output_filename, "%") != 1 {
+			return usageError{fmt.Sprintf("-split needs an output image name with a %%d for each number (such as out%%d.png), not %q", *output_filename)}
+		}
+	}
+	if len(message_files) > 1 {
+		if *operation != "encode" {
+			return usageError{"-f can only be given more than once with encode"}
+		}
+		if slices.Contains(message_files, "-") || slices.Contains(message_files, "") {
+			return usageError{"-f cannot name STDIN (-) when given more than once"}
+		}
+		if *split || *force || *self_test || isFlagSet("decoy") {
+			return usageError{"several -f files cannot be hidden with -split, -force, -selftest or -decoy"}
+		}
+	}
+	if *join && *operation != "decode" {
+		return usageError{"-join can only be used with decode"}
+	}
+	if *frames {
+		if *operation != "encode" && *operation != "decode" {
+			return usageError{"-frames can only be used with encode or decode"}
+		}
+		if *split || *join || len(message_files) > 1 || isFlagSet("decoy") || *self_test || *dry_run || *force {
+			return usageError{"-frames cannot be used with -split, -join, -decoy, -selftest, -dry-run, -force or several -f files"}
+		}
+		if *operation == "encode" && strings.ToLower(filepath.Ext(*output_filename)) != ".png" {
+			return usageError{fmt.Sprintf("-frames writes an animated PNG, so the output image must be named .png, not %s", *output_filename)}
+		}
+	}
+	if (*operation == "encode" || *operation == "append") && !*split && *output_filename != "" && sameFile(*input_filename, *output_filename) {
+		return usageError{fmt.Sprintf("output image %s is the input image, which would be lost (choose a different -o)", *output_filename)}
+	}
+	if isFlagSet("pnglevel") {
+		if *operation != "encode" && *operation != "append" && *operation != "cover" {
+			return usageError{"-pnglevel can only be used with encode, append or cover"}
+		}
+		if _, ok := png_levels[*png_level]; !ok {
+			return usageError{fmt.Sprintf("invalid -pnglevel %q (want best, default, fast or none)", *png_level)}
+		}
+	}
+	if *self_test && (*operation != "encode" || *split) {
+		return usageError{"-selftest can only be used with encode, without -split"}
+	}
+	if *force && *operation != "encode" {
+		return usageError{"-force can only be used with encode"}
+	}
+	if *metrics && *operation != "encode" {
+		return usageError{"-metrics can only be used with encode"}
+	}
+	if isFlagSet("seed") && *operation != "encode" && *operation != "append" && *operation != "cover" {
+		return usageError{"-seed can only be used with encode, append or cover"}
+	}
+	if (*timestamp || isFlagSet("comment")) && *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+		return usageError{"-timestamp and -comment can only be used with encode, capacity or cover"}
+	}
+	if len(*comment) > 255 {
+		return usageError{"-comment is longer than 255 bytes"}
+	}
+	if *dry_run && *operation != "encode" {
+		return usageError{"-dry-run can only be used with encode"}
+	}
+	if *scatter && (*operation == "encode" || *operation == "cover") && *password == "" {
+		return usageError{"-scatter needs a password (-pass)"}
+	}
+	if *stealth {
+		if *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+			return usageError{"-stealth can only be used with encode, capacity or cover"}
+		}
+		if *operation != "capacity" && *password == "" {
+			return usageError{"-stealth scatters the message, so needs a password (-pass)"}
+		}
+		for _, name := range []string{"bits", "channels", "mode", "plane"} {
+			if isFlagSet(name) {
+				return usageError{fmt.Sprintf("-stealth chooses the layout itself, so cannot be used with -%s", name)}
+			}
+		}
+	}
+	if isFlagSet("matrix") && *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+		return usageError{"-matrix can only be used with encode, capacity or cover"}
+	}
+	if *interleave && *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+		return usageError{"-interleave can only be used with encode, capacity or cover"}
+	}
+	if *match && *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+		return usageError{"-match can only be used with encode, capacity or cover"}
+	}
+	if isFlagSet("ecc") && *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+		return usageError{"-ecc can only be used with encode, capacity or cover"}
+	}
+	if isFlagSet("decoy") || isFlagSet("decoypass") {
+		if *operation != "encode" {
+			return usageError{"-decoy can only be used with encode"}
+		}
+		if *decoy_filename == "" || *decoy_password == "" || *password == "" {
+			return usageError{"-decoy needs the decoy file, its password (-decoypass) and the message's (-pass)"}
+		}
+		if *split || *force || *self_test || *dry_run || *stealth {
+			return usageError{"-decoy cannot be used with -split, -force, -selftest, -dry-run or -stealth"}
+		}
+	}
+	if isFlagSet("xor") && *xor_key == "" {
+		return usageError{"-xor needs a key"}
+	}
+	if *opaque {
+		if *operation != "encode" && *operation != "capacity" && *operation != "cover" {
+			return usageError{"-opaque can only be used with encode, capacity or cover"}
+		}
+		if *channels == stego.ChannelsRGBA && isFlagSet("channels") {
+			return usageError{"-opaque leaves every alpha full, so cannot hide the message in it (-channels rgb or b)"}
+		}
+	}
+	if isFlagSet("region") {
+		if *operation != "encode" && *operation != "capacity" {
+			return usageError{"-region can only be used with encode or capacity"}
+		}
+		r, err := parseRect(*region)
+		if err != nil {
+			return usageError{err.Error()}
+		}
+		region_rect = r
+	}
+	if *base64_output && *operation != "decode" {
+		return usageError{"-b64 can only be used with decode"}
+	}
+	if *strict && *operation != "decode" {
+		return usageError{"-strict can only be used with decode"}
+	}
+	if *json_output {
+		switch *operation {
+		case "capacity", "detect", "verify", "list":
+		default:
+			return usageError{"-json can only be used with capacity, detect, verify or list"}
+		}
+	}
+	if isFlagSet("m") {
+		if *operation != "encode" && *operation != "append" && *operation != "cover" {
+			return usageError{"-m can only be used with encode, append or cover"}
+		}
+		if isFlagSet("f") {
+			return usageError{"-m and -f cannot be used together"}
+		}
+	}
+	if isFlagSet("hex") {
+		if *operation != "encode" && *operation != "append" && *operation != "cover" {
+			return usageError{"-hex can only be used with encode, append or cover"}
+		}
+		if isFlagSet("m") || isFlagSet("f") {
+			return usageError{"-hex cannot be used together with -m or -f"}
+		}
+		b, err := hex.DecodeString(*message_hex)
+		if err != nil {
+			return usageError{fmt.Sprintf("invalid -hex message: %v", err)}
+		}
+		message_hex_bytes = b
+	}
+
+	return nil
+}
+
+func main() {
+	// Parse the command line
+	err := parseCommandLine(os.Args[1:])
+	if err == nil && *show_version {
+		printVersion()
+		return
+	}
+	if err == nil {
+		err = checkFlags()
+	}
+	if err == nil {
+		switch *operation {
+		case "encode":
+			err = encode()
+		case "decode":
+			err = decode()
+		case "append":
+			err = appendMessage()
+		case "capacity":
+			err = capacity()
+		case "detect":
+			err = detect()
+		case "verify":
+			err = verify()
+		case "diff":
+			err = diff()
+		case "cover":
+			err = cover()
+		case "list":
+			err = listFiles()
+		}
+	}
+
+	if err == errNotDetected || err == errMismatch {
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stego: %v\n", err)
+		if _, ok := err.(usageError); ok {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"image"
+	"image/png"
+	"io"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/henrythewasp/stego"
+)
+
+func TestCreateFileMissingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := createFile(filepath.Join(dir, "decoded", "msg.bin")); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("createFile in a missing directory returned %v, want one saying it does not exist", err)
+	}
+
+	f, err := createFile(filepath.Join(dir, "msg.bin"))
+	if err != nil {
+		t.Fatalf("createFile: %v", err)
+	}
+	f.Close()
+}
+
+func TestFitMessage(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 32, 32))
+	// Random digits, which compress, but not enough to fit
+	r := rand.New(rand.NewPCG(1, 2))
+	msg := make([]byte, 16000)
+	for i := range msg {
+		msg[i] = '0' + byte(r.IntN(10))
+	}
+	for _, opts := range []stego.Options{{}, {Compress: true}, {Bits: 1, Password: "pw"}} {
+		fit := fitMessage(img, msg, opts)
+		if !bytes.HasPrefix(msg, fit) {
+			t.Fatalf("fitMessage with %+v returned %d bytes that are not the start of the message", opts, len(fit))
+		}
+		if _, err := stego.Encode(img, fit, opts); err != nil {
+			t.Errorf("fitMessage with %+v returned %d bytes, which do not fit: %v", opts, len(fit), err)
+		}
+		if _, err := stego.Encode(img, msg[:len(fit)+1], opts); err == nil {
+			t.Errorf("fitMessage with %+v returned %d bytes, but one more fits", opts, len(fit))
+		}
+	}
+	if fit := fitMessage(img, msg[:100], stego.Options{}); len(fit) != 100 {
+		t.Errorf("fitMessage of a message that fits returned %d of its 100 bytes", len(fit))
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	defer func(name string) { *output_filename = name }(*output_filename)
+
+	img := image.NewNRGBA64(image.Rect(0, 0, 32, 32))
+	msg := []byte("meet at 5")
+	out, err := stego.Encode(img, msg, stego.Options{Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"out.png", true},
+		{"out.tif", true},
+		{"out.jpg", false},
+		{"out.gif", false},
+	} {
+		*output_filename = tc.name
+		if err := selfTest(out, msg, stego.Options{Password: "pw"}); (err == nil) != tc.ok {
+			t.Errorf("selfTest writing %s returned %v", tc.name, err)
+		}
+	}
+	*output_filename = "out.png"
+	if err := selfTest(out, []byte("meet at 6"), stego.Options{Password: "pw"}); err == nil {
+		t.Error("selfTest against a different message succeeded")
+	}
+}
+
+func TestReadFromFS(t *testing.T) {
+	defer func(name string, max int) { *message_filename, *max_pixels = name, max }(*message_filename, *max_pixels)
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"carriers/small.png": {Data: b.Bytes()},
+		"msg.txt":            {Data: []byte("meet at 5")},
+	}
+
+	img, err := readImage(fsys, "carriers/small.png")
+	if err != nil || img.Bounds() != image.Rect(0, 0, 8, 4) {
+		t.Fatalf("readImage returned %v, %v", img, err)
+	}
+	*max_pixels = 31
+	if _, err := readImage(fsys, "carriers/small.png"); !errors.Is(err, stego.ErrCarrierTooLarge) {
+		t.Errorf("readImage over -maxpixels returned %v, want ErrCarrierTooLarge", err)
+	}
+	if _, err := readImage(fsys, "missing.png"); err == nil {
+		t.Error("readImage of a missing file succeeded")
+	}
+
+	*message_filename = "msg.txt"
+	r, length, err := openMessage(fsys)
+	if err != nil {
+		t.Fatalf("openMessage: %v", err)
+	}
+	defer r.Close()
+	if msg, err := io.ReadAll(r); err != nil || string(msg) != "meet at 5" || length != len(msg) {
+		t.Errorf("openMessage gave %q of length %d, %v", msg, length, err)
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	for _, op := range command_names {
+		for _, name := range command_flags[op] {
+			if flag.CommandLine.Lookup(name) == nil {
+				t.Errorf("%s takes -%s, which is not a flag", op, name)
+			}
+		}
+	}
+	if len(command_flags) != len(command_names) {
+		t.Errorf("%d operations have flags, but usage lists %d", len(command_flags), len(command_names))
+	}
+	if fs := newCommand("decode"); fs.Lookup("o") != nil || fs.Lookup("f") == nil {
+		t.Error("decode should take -f but not -o")
+	}
+}
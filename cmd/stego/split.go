@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/henrythewasp/stego"
+)
+
+// globImages returns the image files in fsys matching the -i pattern, in name
+// order.
+func globImages(fsys fs.FS) ([]string, error) {
+	names, err := fs.Glob(fsys, *input_filename)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input image pattern %q: %w", *input_filename, err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no input images match %q", *input_filename)
+	}
+	return names, nil
+}
+
+// readImages decodes the image files names from fsys.
+func readImages(fsys fs.FS, names []string) ([]image.Image, error) {
+	imgs := make([]image.Image, len(names))
+	for i, name := range names {
+		img, err := readImage(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		imgs[i] = img
+	}
+	return imgs, nil
+}
+
+// splitEncode hides the message over as many of the images matching -i as it
+// needs, writing each to the -o name with its number in place of %d.
+func splitEncode() error {
+	info("encoding!\n")
+
+	names, err := globImages(input_files)
+	if err != nil {
+		return err
+	}
+
+	r, length, err := openMessage(input_files)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read message: %w", err)
+	}
+	info("message is %v bytes\n", length)
+
+	imgs, err := readImages(input_files, names)
+	if err != nil {
+		return err
+	}
+
+	// Remember the file name, so decode can recreate the file
+	opts := options()
+	if messageFromFile() {
+		opts.Filename = filepath.Base(*message_filename)
+	}
+
+	output_images, err := stego.EncodeSplit(imgs, msg, opts)
+	if ce := (*stego.CapacityError)(nil); errors.As(err, &ce) {
+		return fmt.Errorf("%w (%s, or more images)", err, capacityHint())
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, img := range output_images {
+		name := fmt.Sprintf(*output_filename, i)
+		for _, input := range names {
+			if sameFile(input, name) {
+				return fmt.Errorf("output image %s is an input image, which would be lost (choose a different -o)", name)
+			}
+		}
+
+		// Keep each original's colour profile, so the output looks the same
+		chunks, err := readColourChunks(input_files, names[i])
+		if err != nil {
+			return err
+		}
+		if err := writeImage(name, img, chunks); err != nil {
+			return err
+		}
+		info("wrote part %v of %v from %s to %s\n", i+1, len(output_images), names[i], name)
+	}
+
+	return nil
+}
+
+// joinDecode recovers a message split over the images matching -i, and writes
+// it out as decode does.
+func joinDecode() error {
+	names, err := globImages(input_files)
+	if err != nil {
+		return err
+	}
+	imgs, err := readImages(input_files, names)
+	if err != nil {
+		return err
+	}
+
+	msg, err := stego.DecodeJoin(imgs, options())
+	if err != nil {
+		return err
+	}
+
+	// Each part is hidden with the same file name
+	h, err := stego.ReadSlotHeader(imgs[0], options())
+	if err != nil {
+		return err
+	}
+	return writeJoined(h, msg, fmt.Sprintf("%v images", len(imgs)))
+}
+
+// writeJoined writes msg, joined from the parts in the images described by
+// from, to STDOUT or the file decode would, given the header h of a part.
+func writeJoined(h stego.Header, msg []byte, from string) error {
+	output_filename, err := decodeOutput(h.Filename)
+	if err != nil {
+		return err
+	}
+
+	if output_filename == "" {
+		info("Decoding to STDOUT\n")
+		return writeMessage(os.Stdout, msg)
+	}
+
+	info("Decoding contents of %v to %v\n", from, output_filename)
+	output_writer, err := createFile(output_filename)
+	if err != nil {
+		return fmt.Errorf("cannot create message file: %w", err)
+	}
+	if err := writeMessage(output_writer, msg); err != nil {
+		output_writer.Close()
+		os.Remove(output_filename)
+		return fmt.Errorf("cannot write message file: %w", err)
+	}
+	if err := output_writer.Close(); err != nil {
+		return fmt.Errorf("cannot write message file: %w", err)
+	}
+
+	return nil
+}
+
+// writeMessage writes msg to w, Base64 encoded (ending with a newline) if -b64
+// was given.
+func writeMessage(w io.Writer, msg []byte) error {
+	if !*base64_output {
+		_, err := w.Write(msg)
+		return err
+	}
+
+	_, err := fmt.Fprintln(w, base64.StdEncoding.EncodeToString(msg))
+	return err
+}
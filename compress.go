@@ -0,0 +1,43 @@
+package stego
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+)
+
+// compress gzips msg.
+func compress(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress inflates a message compressed by compress.  Encode never hides a
+// message longer than math.MaxUint32 bytes, so a payload that inflates to more
+// is refused rather than read into memory without end.
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress message: %w", err)
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(zr, math.MaxUint32+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress message: %w", err)
+	}
+	if int64(len(msg)) > math.MaxUint32 {
+		return nil, fmt.Errorf("cannot decompress message: longer than %d bytes", uint64(math.MaxUint32))
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,84 @@
+package stego
+
+import (
+	"image"
+	"io"
+)
+
+// Widest and tallest cover image NewCover makes
+const max_cover_side = 1 << 14
+
+// NewCover returns an opaque image of random noise just large enough to hide
+// length message bytes in with opts, for when the carrier need not show
+// anything: with no original to compare it with, changes to the low bits of
+// noise cannot be seen.  It is as near square as fits the message in the
+// fewest rows, and its noise is read from opts.Rand (or crypto/rand).  Any
+// compression is not allowed for, so a compressible message may leave room to
+// spare.  The message must be hidden with the same opts; opts.Rect and
+// opts.MinAlpha cannot be set, since the image is sized to the message, and
+// opaque.
+func NewCover(length int, opts Options) (*image.NRGBA, error) {
+	if !opts.Rect.Empty() {
+		return nil, optionsErrorf("a cover image is sized to the message, so cannot have a rectangle")
+	}
+	if opts.MinAlpha != 0 {
+		return nil, optionsErrorf("a cover image is opaque, so cannot have a minimum alpha")
+	}
+
+	if err := opts.checkECC(); err != nil {
+		return nil, err
+	}
+
+	// The payload as hidden, after encryption and error correction
+	payload := func(overhead int) int {
+		n := length + overhead
+		if opts.ECC != 0 {
+			n = eccLen(n, opts.ECC)
+		}
+		return max(n, opts.Pad)
+	}
+	fits := func(w, h int) bool {
+		c, overhead := payloadCapacity(&image.NRGBA{Rect: image.Rect(0, 0, w, h)}, opts)
+		return c >= payload(overhead)
+	}
+	if !fits(max_cover_side, max_cover_side) {
+		largest := &image.NRGBA{Rect: image.Rect(0, 0, max_cover_side, max_cover_side)}
+		if _, err := opts.layout(largest); err != nil {
+			return nil, err
+		}
+		if _, err := opts.region(largest); err != nil {
+			return nil, err
+		}
+		c, overhead := payloadCapacity(largest, opts)
+		return nil, &CapacityError{Payload: payload(overhead), Capacity: max(c, 0)}
+	}
+
+	// The smallest square that fits, then the fewest rows of it
+	w := smallest(func(n int) bool { return fits(n, n) })
+	h := smallest(func(n int) bool { return n >= w || fits(w, n) })
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if _, err := io.ReadFull(opts.random(), img.Pix); err != nil {
+		return nil, err
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img, nil
+}
+
+// smallest returns the least n from 1 to max_cover_side for which ok is true,
+// given that it is true for max_cover_side, and for every n above one it is
+// true for.
+func smallest(ok func(n int) bool) int {
+	lo, hi := 1, max_cover_side
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if ok(mid) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
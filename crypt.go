@@ -0,0 +1,96 @@
+package stego
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// ErrDecrypt is returned by Decode when an encrypted message cannot be
+// decrypted, usually because the password is wrong.
+var ErrDecrypt = errors.New("cannot decrypt message (wrong password?)")
+
+// ErrPasswordRequired is returned by Decode when the message is encrypted but no
+// password was given.
+var ErrPasswordRequired = errors.New("message is encrypted: a password is required")
+
+const salt_len = 16
+const nonce_len = 12
+const gcm_tag_len = 16
+
+// PBKDF2 work factor for deriving the AES-256 key from the password
+const kdf_iterations = 600000
+
+// keys are derived from the password: the AES-256 key, and the seed for the
+// order of the message pixels when the message is scattered.
+type keys struct {
+	aes     []byte
+	scatter [32]byte
+}
+
+// deriveKeys derives the keys from password and salt.  They come from a single
+// 64 byte PBKDF2 output; its first 32 bytes are the same as a 32 byte output,
+// so the AES key is unchanged from before scattering was added.
+func deriveKeys(password string, salt []byte) (keys, error) {
+	var k keys
+	b, err := pbkdf2.Key(sha256.New, password, salt, kdf_iterations, 64)
+	if err != nil {
+		return k, err
+	}
+
+	k.aes = b[:32]
+	copy(k.scatter[:], b[32:])
+	return k, nil
+}
+
+// newGCM returns an AES-256-GCM cipher with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals msg under password, recording the salt and nonce it read from
+// rnd in h.  It also returns the keys derived from the password.
+func encrypt(h *Header, msg []byte, password string, rnd io.Reader) ([]byte, keys, error) {
+	if _, err := io.ReadFull(rnd, h.Salt[:]); err != nil {
+		return nil, keys{}, err
+	}
+	if _, err := io.ReadFull(rnd, h.Nonce[:]); err != nil {
+		return nil, keys{}, err
+	}
+
+	k, err := deriveKeys(password, h.Salt[:])
+	if err != nil {
+		return nil, k, err
+	}
+	gcm, err := newGCM(k.aes)
+	if err != nil {
+		return nil, k, err
+	}
+
+	h.Flags |= FlagEncrypted
+	return gcm.Seal(nil, h.Nonce[:], msg, nil), k, nil
+}
+
+// decrypt opens a message sealed by encrypt, with keys derived from the same
+// password and the salt in h.
+func decrypt(h Header, sealed []byte, k keys) ([]byte, error) {
+	gcm, err := newGCM(k.aes)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := gcm.Open(nil, h.Nonce[:], sealed, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return msg, nil
+}
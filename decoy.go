@@ -0,0 +1,148 @@
+package stego
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// A message hidden behind a decoy has no header.  It fills the message pixels
+// after the decoy's, in turn, as
+//
+//	salt [16]byte | nonce [12]byte | sealed
+//
+// where sealed is the AES-GCM sealed
+//
+//	length uint32 | message [length]byte | random filling
+//
+// so every bit of it looks random, whether or not there is a message.
+
+// Bytes of the pixels after the decoy taken up by the hidden message's salt,
+// nonce, tag and length
+const decoy_overhead = salt_len + nonce_len + gcm_tag_len + 4
+
+// EncodeDecoy hides two messages in img, for plausible deniability: decoy,
+// hidden as Encode would with opts, encrypted with opts.Password, and msg,
+// encrypted with password, in all the message pixels after the decoy.  Decode
+// with opts.Password recovers the decoy, and with password recovers msg.
+//
+// The message leaves no header, and the pixels after the decoy are filled
+// with random bits even if msg is empty, so without password an image holding
+// a message cannot be told from one holding just the decoy.  The decoy's
+// pixels must run in turn from the header so the message can be found after
+// them: it cannot be scattered, strided, in a rectangle or slot, matrix
+// embedded, interleaved, kept out of transparent pixels, HMAC tagged, XORed
+// or error corrected.
+func EncodeDecoy(img image.Image, decoy, msg []byte, password string, opts Options) (image.Image, error) {
+	if opts.Password == "" || password == "" || opts.Password == password {
+		return nil, optionsErrorf("a decoy needs a password of its own, different from the message's")
+	}
+	if opts.Scatter || opts.Stride > 1 || !opts.Rect.Empty() || opts.Slots > 1 || opts.Matrix != 0 || opts.Interleave || opts.MinAlpha != 0 || opts.HMACKey != "" || opts.XORKey != "" || opts.ECC != 0 {
+		return nil, optionsErrorf("a decoy must be hidden in the pixels after the header in turn, with only a password")
+	}
+	l, err := opts.layout(img)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.seedMatch(opts.random()); err != nil {
+		return nil, err
+	}
+
+	out, err := Encode(img, decoy, opts)
+	if err != nil {
+		return nil, err
+	}
+	h, err := ReadHeader(out)
+	if err != nil {
+		return nil, err
+	}
+
+	tail := decoyTail(h, slotRegion(out.Bounds(), 0, 1))
+	n := l.capacity(tail.pixels())
+	if n < decoy_overhead+len(msg) {
+		return nil, &CapacityError{Payload: h.embeddedLen() + decoy_overhead + len(msg), Capacity: h.embeddedLen() + max(n-decoy_overhead, 0)}
+	}
+
+	// Seal the message and the random filling after it together
+	record := make([]byte, salt_len+nonce_len, n)
+	if _, err := io.ReadFull(opts.random(), record); err != nil {
+		return nil, err
+	}
+	plain := make([]byte, n-decoy_overhead+4)
+	binary.BigEndian.PutUint32(plain, uint32(len(msg)))
+	copy(plain[4:], msg)
+	if _, err := io.ReadFull(opts.random(), plain[4+len(msg):]); err != nil {
+		return nil, err
+	}
+	k, err := deriveKeys(password, record[:salt_len])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(k.aes)
+	if err != nil {
+		return nil, err
+	}
+	record = gcm.Seal(record, record[salt_len:], plain, nil)
+
+	fb := make(chan []byte, 1)
+	fb <- record
+	close(fb)
+	if err := encodePixels(context.Background(), out, out.(draw.Image), tail, l, n, nil, nil, fb, nil); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decoyTail returns the message pixels of the slot rg after those of the
+// message described by h, where a message hidden behind it would be.
+func decoyTail(h Header, rg region) region {
+	l := h.layout()
+	body := bodyRegion(rg, l, h.size())
+	used := (h.embeddedLen()*8 + l.pixelBits() - 1) / l.pixelBits()
+	return region{start: min(body.start+used, body.end), end: body.end}
+}
+
+// canHideBehind reports whether a message could be hidden behind the message
+// described by h, as EncodeDecoy would.
+func canHideBehind(h Header) bool {
+	return h.Flags&FlagEncrypted != 0 && h.Flags&(FlagScatter|FlagStride|FlagRect|FlagSlot|FlagMinAlpha|FlagHMAC) == 0 && h.Matrix == 0 && h.ExtFlags&^(ExtFlagMeta|ExtFlagChannelBits|ExtFlagMatch) == 0
+}
+
+// decodeHidden recovers the message hidden with password behind the decoy
+// described by h, in the slot rg of img.  It returns ErrDecrypt if there is
+// none, or the password is wrong; the two cannot be told apart.
+func decodeHidden(ctx context.Context, img image.Image, h Header, rg region, password string) ([]byte, error) {
+	tail := decoyTail(h, rg)
+	l := h.layout()
+	n := l.capacity(tail.pixels())
+	if n < decoy_overhead {
+		return nil, ErrDecrypt
+	}
+
+	var b bytes.Buffer
+	if err := streamBits(ctx, img, l, n, tail, nil, &b, default_buffer_len, nil); err != nil {
+		return nil, err
+	}
+	record := b.Bytes()
+	k, err := deriveKeys(password, record[:salt_len])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(k.aes)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, record[salt_len:salt_len+nonce_len], record[salt_len+nonce_len:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	length := binary.BigEndian.Uint32(plain)
+	if int64(length) > int64(len(plain)-4) {
+		return nil, ErrDecrypt
+	}
+	return plain[4 : 4+length], nil
+}
@@ -0,0 +1,44 @@
+package stego
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// ErrSizeMismatch is returned by Diff if the two images are not the same size.
+var ErrSizeMismatch = errors.New("images are not the same size")
+
+// Colour Diff marks the pixels that differ with
+var diff_colour = color.NRGBA{R: 0xff, A: 0xff}
+
+// Diff returns an image showing where b differs from a, for seeing where a
+// message was hidden: every pixel whose R, G, B or A value differs, even in
+// the lowest bit, is shown in red, and the rest in grey, dimmed to a quarter
+// of the brightness of a so the picture can still be made out.  It also
+// returns the number of pixels that differ.  The images must be the same
+// size, but their bounds need not start in the same place; the result has the
+// bounds of a.
+func Diff(a, b image.Image) (*image.NRGBA, int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		return nil, 0, fmt.Errorf("%w: %dx%d and %dx%d", ErrSizeMismatch, ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())
+	}
+
+	out := image.NewNRGBA(ab)
+	changed := 0
+	comparePixels(a, b, func(i int, ca, cb [4]uint32) {
+		p := pixelPoint(ab, i)
+		if ca != cb {
+			out.SetNRGBA(p.X, p.Y, diff_colour)
+			changed++
+			return
+		}
+		// The luminance, weighted as color.GrayModel does, over 4
+		y := uint8((19595*ca[0] + 38470*ca[1] + 7471*ca[2] + 1<<15) >> 26)
+		out.SetNRGBA(p.X, p.Y, color.NRGBA{R: y, G: y, B: y, A: 0xff})
+	})
+
+	return out, changed, nil
+}
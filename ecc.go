@@ -0,0 +1,252 @@
+package stego
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUncorrectable is returned by Decode when the payload of a message hidden
+// with Options.ECC has more damaged bytes than its error correction can put
+// right.
+var ErrUncorrectable = errors.New("hidden message is too damaged to correct")
+
+// ErrDamaged is returned by Decode with Options.Strict when the payload of a
+// message hidden with Options.ECC has damaged bytes, even ones it could
+// correct.
+var ErrDamaged = errors.New("hidden message is damaged")
+
+// An error corrected payload is cut into blocks of up to 255-ecc bytes, each
+// followed by ecc Reed-Solomon parity bytes over GF(2^8), so each block of up
+// to 255 bytes as hidden can have ecc/2 bytes damaged and still be corrected.
+// The last block is shortened to fit what is left of the payload.
+
+// Length of a Reed-Solomon code word over GF(2^8)
+const ecc_block_len = 255
+
+// Fewest and most parity bytes per block
+const (
+	min_ecc = 2
+	max_ecc = ecc_block_len - 1
+)
+
+// Exponents and logarithms of GF(2^8), with the primitive polynomial
+// x^8+x^4+x^3+x^2+1; gf_exp runs on to 510 so a sum of two logarithms needs
+// no reduction.
+var gf_exp, gf_log = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := range 255 {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf_exp[int(gf_log[a])+int(gf_log[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gf_exp[int(gf_log[a])+255-int(gf_log[b])]
+}
+
+// gfPow returns α^e.
+func gfPow(e int) byte {
+	return gf_exp[(e%255+255)%255]
+}
+
+// validECC reports whether ecc parity bytes can be added to each block.
+func validECC(ecc int) bool {
+	return ecc >= min_ecc && ecc <= max_ecc
+}
+
+// eccLen returns the number of bytes n payload bytes take up once ecc parity
+// bytes are added to each block.
+func eccLen(n, ecc int) int {
+	per_block := ecc_block_len - ecc
+	return n + (n+per_block-1)/per_block*ecc
+}
+
+// eccCapacity returns the most payload bytes that take up no more than n bytes
+// once ecc parity bytes are added to each block.
+func eccCapacity(n, ecc int) int {
+	return n/ecc_block_len*(ecc_block_len-ecc) + max(n%ecc_block_len-ecc, 0)
+}
+
+// rsGenerator returns the generator polynomial of a code with ecc parity
+// bytes, (x-α^0)(x-α^1)...(x-α^(ecc-1)), highest power first.
+func rsGenerator(ecc int) []byte {
+	g := []byte{1}
+	for i := range ecc {
+		next := make([]byte, len(g)+1)
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfPow(i))
+		}
+		g = next
+	}
+	return g
+}
+
+// eccEncode returns msg with ecc parity bytes after each block.
+func eccEncode(msg []byte, ecc int) []byte {
+	g := rsGenerator(ecc)
+	per_block := ecc_block_len - ecc
+	out := make([]byte, 0, eccLen(len(msg), ecc))
+	for len(msg) > 0 {
+		data := msg[:min(per_block, len(msg))]
+		msg = msg[len(data):]
+
+		// The parity is the remainder of data·x^ecc divided by g
+		parity := make([]byte, ecc)
+		for _, d := range data {
+			f := d ^ parity[0]
+			copy(parity, parity[1:])
+			parity[ecc-1] = 0
+			if f != 0 {
+				for j := range parity {
+					parity[j] ^= gfMul(g[j+1], f)
+				}
+			}
+		}
+		out = append(out, data...)
+		out = append(out, parity...)
+	}
+	return out
+}
+
+// eccDecode corrects the blocks of b, which has ecc parity bytes after each,
+// and returns the payload without them.  It returns an error wrapping
+// ErrUncorrectable if any block is too damaged, or if strict, wrapping
+// ErrDamaged if any block is damaged at all.
+func eccDecode(b []byte, ecc int, strict bool) ([]byte, error) {
+	out := make([]byte, 0, eccCapacity(len(b), ecc))
+	for i := 0; len(b) > 0; i++ {
+		block := append([]byte{}, b[:min(ecc_block_len, len(b))]...)
+		b = b[len(block):]
+		if len(block) <= ecc {
+			return nil, fmt.Errorf("%w: block %d", ErrUncorrectable, i)
+		}
+		if strict {
+			if _, clean := rsSyndromes(block, ecc); !clean {
+				return nil, fmt.Errorf("%w: block %d", ErrDamaged, i)
+			}
+		}
+		if !rsCorrect(block, ecc) {
+			return nil, fmt.Errorf("%w: block %d", ErrUncorrectable, i)
+		}
+		out = append(out, block[:len(block)-ecc]...)
+	}
+	return out, nil
+}
+
+// rsSyndromes returns the code word polynomial of block, highest power first,
+// at α^0 to α^(ecc-1), and whether they are all 0, so block is undamaged.
+func rsSyndromes(block []byte, ecc int) ([]byte, bool) {
+	s := make([]byte, ecc)
+	clean := true
+	for j := range s {
+		x := gfPow(j)
+		for _, c := range block {
+			s[j] = gfMul(s[j], x) ^ c
+		}
+		clean = clean && s[j] == 0
+	}
+	return s, clean
+}
+
+// rsCorrect puts right up to ecc/2 damaged bytes of block, a code word with
+// ecc parity bytes at the end, in place.  It reports false if there are more.
+func rsCorrect(block []byte, ecc int) bool {
+	s, clean := rsSyndromes(block, ecc)
+	if clean {
+		return true
+	}
+
+	// Berlekamp-Massey finds the error locator lambda, lowest power first,
+	// whose roots are the inverses of the positions of the errors
+	lambda, prev := []byte{1}, []byte{1}
+	errs, shift, last := 0, 1, byte(1)
+	for n := range ecc {
+		d := s[n]
+		for i := 1; i <= errs && i < len(lambda); i++ {
+			d ^= gfMul(lambda[i], s[n-i])
+		}
+		if d == 0 {
+			shift++
+			continue
+		}
+		next := append([]byte{}, lambda...)
+		for len(next) < len(prev)+shift {
+			next = append(next, 0)
+		}
+		f := gfDiv(d, last)
+		for i, c := range prev {
+			next[i+shift] ^= gfMul(f, c)
+		}
+		if 2*errs <= n {
+			prev, errs, last, shift = lambda, n+1-errs, d, 1
+		} else {
+			shift++
+		}
+		lambda = next
+	}
+	if 2*errs > ecc {
+		return false
+	}
+
+	// The error evaluator omega = s·lambda mod x^ecc
+	omega := make([]byte, ecc)
+	for i, c := range s {
+		for j, l := range lambda {
+			if i+j < ecc {
+				omega[i+j] ^= gfMul(c, l)
+			}
+		}
+	}
+
+	// Search each position for a root of lambda, and correct it by Forney's
+	// formula, e = X·omega(1/X) / lambda'(1/X)
+	found := 0
+	for i := range block {
+		power := len(block) - 1 - i
+		inv := gfPow(-power)
+		if evalPoly(lambda, inv) != 0 {
+			continue
+		}
+		var deriv byte
+		for j := 1; j < len(lambda); j += 2 {
+			deriv ^= gfMul(lambda[j], gfPow(-power*(j-1)))
+		}
+		if deriv == 0 {
+			return false
+		}
+		block[i] ^= gfMul(gfPow(power), gfDiv(evalPoly(omega, inv), deriv))
+		found++
+	}
+	if found != errs {
+		return false
+	}
+	_, clean = rsSyndromes(block, ecc)
+	return clean
+}
+
+// evalPoly returns the polynomial p, lowest power first, at x.
+func evalPoly(p []byte, x byte) byte {
+	var v byte
+	for i := len(p) - 1; i >= 0; i-- {
+		v = gfMul(v, x) ^ p[i]
+	}
+	return v
+}
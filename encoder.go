@@ -0,0 +1,53 @@
+package stego
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"image"
+)
+
+// Encoder hides the same message in any number of images, compressing and
+// encrypting it only once, for example to watermark a batch of images.  It is
+// safe for concurrent use unless opts.Rand or opts.Progress is set, as every
+// call to Embed uses them without locking.
+type Encoder struct {
+	opts Options
+	p    payload
+}
+
+// NewEncoder returns an Encoder that hides msg with opts.  The message is
+// compressed and encrypted straight away, if opts ask for that, so every image
+// carries the same payload (and, if encrypted, the same salt and nonce).
+func NewEncoder(msg []byte, opts Options) (*Encoder, error) {
+	p, err := preparePayload(bytes.NewReader(msg), len(msg), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep a plain message too, rather than the reader over it
+	if p.data == nil {
+		p.h.CRC = crc32.ChecksumIEEE(msg)
+		p.summed = true
+		p.r, p.data = nil, append([]byte{}, msg...)
+	}
+
+	return &Encoder{opts: opts, p: p}, nil
+}
+
+// Embed hides the message in img, as Encode would.
+func (e *Encoder) Embed(img image.Image) (image.Image, error) {
+	if err := e.opts.checkSize(img); err != nil {
+		return nil, err
+	}
+	l, err := e.opts.layout(img)
+	if err != nil {
+		return nil, err
+	}
+	rg, err := e.opts.region(img)
+	if err != nil {
+		return nil, err
+	}
+
+	return embed(context.Background(), img, l, rg, e.p, e.opts)
+}
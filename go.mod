@@ -0,0 +1,5 @@
+module github.com/henrythewasp/stego
+
+go 1.24
+
+require golang.org/x/image v0.30.0
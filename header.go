@@ -0,0 +1,633 @@
+package stego
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// ErrNotStego is returned by Decode when the image does not start with a stego header.
+var ErrNotStego = errors.New("no stego header found in image")
+
+// ErrChecksumMismatch is returned by Decode when the recovered message does not
+// match the checksum stored in the header, for example because the image was
+// truncated or re-compressed.
+var ErrChecksumMismatch = errors.New("recovered message does not match its checksum")
+
+// ErrCorruptHeader is returned when the header claims a longer message than
+// the image could hold, or a rectangle outside it, so it cannot have been
+// written by Encode.
+var ErrCorruptHeader = errors.New("corrupt stego header: message is longer than the image can hold")
+
+// ErrUnsupportedFormat is returned when an image has a stego header, but one
+// written by a version of stego that this one cannot read.
+var ErrUnsupportedFormat = errors.New("unsupported stego format")
+
+// ErrCarrierDowngraded is returned when an image with 8 bits per colour value
+// has a header for a message hidden in 16 bit values, so the image has been
+// re-saved at 8 bits and the message lost with the low byte of each value.
+// (Usually such a re-save loses the header too, and ErrNotStego is returned.)
+var ErrCarrierDowngraded = errors.New("stego image has been reduced to 8 bits per colour value, losing the message hidden in 16")
+
+// errShortHeader is returned by parseHeader when the header continues past the
+// bytes it was given.
+var errShortHeader = fmt.Errorf("header truncated: %w", io.ErrUnexpectedEOF)
+
+// Magic marker at the start of every stego image
+var header_magic = [4]byte{'S', 'T', 'G', '8'}
+
+// Version of the header and pixel layout written by Encode
+const header_version = 3
+
+// Version of a header with extension flags, written only when one is set, so
+// other images stay readable as version 3
+const header_version_ext = 4
+
+// FormatVersion is the version of the header and pixel layout Encode writes, as
+// stored in Header.Version.  A header with any of the ExtFlag* extension flags
+// set is written as FormatVersion+1.
+const FormatVersion = header_version
+
+// Size of the fixed part of the header in bytes.  The header is always stored in
+// R, G and B only (so it survives alpha being flattened): 8 bits per colour
+// value, so each pixel holds 3 header bytes, or 2 bits of each 8 bit colour
+// value when FlagDepth8 is set.
+const header_len = 16
+
+// Header flags
+const (
+	FlagEncrypted  = 1 << iota // message is AES-GCM encrypted; salt and nonce follow
+	FlagCompressed             // message is gzip compressed (before any encryption)
+	FlagSpread                 // message is stored in ModeSpread
+	FlagRGB                    // message is stored in R, G and B only (ChannelsRGB)
+	FlagFilename               // the original file name follows
+	FlagScatter                // message pixels are used in a password-seeded order (needs FlagEncrypted)
+	FlagDepth8                 // header and message are in the low bits of 8 bit colour values
+	FlagHMAC                   // an HMAC-SHA256 tag of the message follows
+	FlagPlane                  // the bit plane the message starts at follows
+	FlagSlot                   // the image is divided into slots; the slot number and count follow
+	FlagGray                   // the image is grayscale; header and message are in its luminance values
+	FlagBlue                   // message is stored in B only (ChannelsBlue)
+	FlagMinAlpha               // the minimum alpha a pixel needs for the message to go in it follows
+	FlagPadded                 // the message is followed by random padding; the padded length follows
+	FlagStride                 // only every stride'th message pixel is used; the stride follows
+	FlagRect                   // the message is in a rectangle of the image; its position and size follow
+
+	known_flags = FlagEncrypted | FlagCompressed | FlagSpread | FlagRGB | FlagFilename | FlagScatter | FlagDepth8 | FlagHMAC | FlagPlane | FlagSlot | FlagGray | FlagBlue | FlagMinAlpha | FlagPadded | FlagStride | FlagRect
+)
+
+// Header extension flags, for once the 16 bits of Flags ran out.  Any of them
+// makes the header version 4: XORKey, EncodeFiles, Interleave, Time or
+// Comment, ChannelBits, ECC and Match (-xor, several -f files, -interleave,
+// -timestamp or -comment, -bits-r/-g/-b/-a, -ecc and -match).
+const (
+	ExtFlagXOR         = 1 << iota // payload is XORed with a repeating key
+	ExtFlagFiles                   // message is a set of files, hidden by EncodeFiles
+	ExtFlagInterleave              // message is interleaved over the channels of each row
+	ExtFlagMeta                    // the time the message was hidden and a comment follow
+	ExtFlagChannelBits             // the bits used of each of R, G, B and A follow
+	ExtFlagECC                     // the payload has Reed-Solomon parity bytes; how many per block follows
+	ExtFlagMatch                   // the low bits were changed by LSB matching, not replaced
+
+	known_ext_flags = ExtFlagXOR | ExtFlagFiles | ExtFlagInterleave | ExtFlagMeta | ExtFlagChannelBits | ExtFlagECC | ExtFlagMatch
+)
+
+// Header describes the hidden message, and is stored in the first pixels of the
+// image.  It is serialised big-endian as
+//
+//	magic [4]byte | version uint8 | matrix uint4 | bits uint4 | flags uint16 | length uint32 | crc uint32
+//
+// followed, if the version is 4, by
+//
+//	ext_flags uint8
+//
+// then, if FlagEncrypted is set, by
+//
+//	salt [16]byte | nonce [12]byte
+//
+// then, if FlagHMAC is set, by
+//
+//	tag [32]byte
+//
+// then, if FlagPlane is set, by
+//
+//	plane uint8
+//
+// then, if FlagSlot is set, by
+//
+//	slot uint8 | slots uint8
+//
+// then, if FlagMinAlpha is set, by
+//
+//	min_alpha uint8
+//
+// then, if FlagPadded is set, by
+//
+//	padded_len uint32
+//
+// then, if FlagStride is set, by
+//
+//	stride uint16
+//
+// then, if FlagRect is set, by
+//
+//	rect_x uint16 | rect_y uint16 | rect_w uint16 | rect_h uint16
+//
+// then, if FlagFilename is set, by
+//
+//	name_len uint8 | name [name_len]byte
+//
+// then, if ExtFlagMeta is set, by
+//
+//	time uint64 | comment_len uint8 | comment [comment_len]byte
+//
+// then, if ExtFlagChannelBits is set, by
+//
+//	r_bits uint4 | g_bits uint4 | b_bits uint4 | a_bits uint4
+//
+// and then, if ExtFlagECC is set, by
+//
+//	ecc uint8
+type Header struct {
+	Magic      [4]byte
+	Version    uint8
+	Bits       uint8  // bits per colour value, in sequential mode
+	Matrix     uint8  // message bits matrix embedded in each group of 2^Matrix-1 cover bits, if not 0
+	Flags      uint16 // Flag* values
+	ExtFlags   uint8  // ExtFlag* values, if Version is 4
+	PayloadLen uint32 // bytes hidden, after any compression, encryption and error correction
+	CRC        uint32 // CRC-32 (IEEE) of the original, unencrypted and uncompressed message
+
+	Salt  [salt_len]byte
+	Nonce [nonce_len]byte
+	Tag   [hmac_len]byte
+	Plane uint8 // lowest bit of each colour value used, in sequential mode
+	Slot  uint8 // slot holding this header and message, if FlagSlot is set
+	Slots uint8 // number of slots the image is divided into, if FlagSlot is set
+
+	// Alpha values below MinAlpha (out of 255) are left alone, if FlagMinAlpha is set
+	MinAlpha uint8
+
+	// Bytes hidden including the random padding after the payload, if FlagPadded is set
+	PaddedLen uint32
+
+	Stride uint16 // pixels from one carrying the message to the next, if FlagStride is set
+
+	// Pixels carrying the message, relative to the top left of the image, if FlagRect is set
+	Rect image.Rectangle
+
+	Filename string
+
+	// Unix time the message was hidden at (0 if not recorded), and a free-text
+	// comment, if ExtFlagMeta is set
+	Time    uint64
+	Comment string
+
+	// Bits used of each of R, G, B and A, if ExtFlagChannelBits is set; Bits is
+	// then the most of them
+	ChannelBits [4]uint8
+
+	ECC uint8 // Reed-Solomon parity bytes per block of up to 255, if ExtFlagECC is set
+}
+
+// Longest file name that can be stored in the header
+const max_filename_len = 255
+
+// Longest comment that can be stored in the header
+const max_comment_len = 255
+
+func newHeader(l layout) Header {
+	h := Header{
+		Magic:   header_magic,
+		Version: header_version,
+		Bits:    uint8(l.bits),
+		Matrix:  uint8(l.matrix),
+	}
+	if l.spread {
+		h.Flags |= FlagSpread
+	}
+	switch {
+	case l.chanBits != [4]int{}:
+		h.Version = header_version_ext
+		h.ExtFlags |= ExtFlagChannelBits
+		for ch, b := range l.chanBits {
+			h.ChannelBits[ch] = uint8(b)
+		}
+	case l.gray:
+		h.Flags |= FlagGray
+	case len(l.channels) == 3:
+		h.Flags |= FlagRGB
+	case len(l.channels) == 1:
+		h.Flags |= FlagBlue
+	}
+	if l.depth8 {
+		h.Flags |= FlagDepth8
+	}
+	if l.plane != 0 {
+		h.Flags |= FlagPlane
+		h.Plane = uint8(l.plane)
+	}
+	if l.minAlpha != 0 {
+		h.Flags |= FlagMinAlpha
+		h.MinAlpha = uint8(l.minAlpha)
+	}
+	if l.stride > 1 {
+		h.Flags |= FlagStride
+		h.Stride = uint16(l.stride)
+	}
+	if !l.rect.Empty() {
+		h.Flags |= FlagRect
+		h.Rect = l.rect
+	}
+	if l.interleave {
+		h.Version = header_version_ext
+		h.ExtFlags |= ExtFlagInterleave
+	}
+	if l.match {
+		h.Version = header_version_ext
+		h.ExtFlags |= ExtFlagMatch
+	}
+	return h
+}
+
+// slots returns the slot holding the header and message, and the number of
+// slots the image is divided into.
+func (h Header) slots() (slot, slots int) {
+	if h.Flags&FlagSlot == 0 {
+		return 0, 1
+	}
+	return int(h.Slot), int(h.Slots)
+}
+
+// embeddedLen returns the number of bytes hidden after the header, including any
+// padding.
+func (h Header) embeddedLen() int {
+	if h.Flags&FlagPadded == 0 {
+		return int(h.PayloadLen)
+	}
+	return int(h.PaddedLen)
+}
+
+// layout returns the pixel layout the message was stored with.
+func (h Header) layout() layout {
+	l := layout{bits: int(h.Bits), spread: h.Flags&FlagSpread != 0, channels: rgba_channels, depth8: h.Flags&FlagDepth8 != 0, plane: int(h.Plane), minAlpha: int(h.MinAlpha), stride: int(h.Stride), matrix: int(h.Matrix)}
+	if h.Flags&FlagRect != 0 {
+		l.rect = h.Rect
+	}
+	l.interleave = h.ExtFlags&ExtFlagInterleave != 0
+	l.match = h.ExtFlags&ExtFlagMatch != 0
+	if h.Flags&FlagRGB != 0 {
+		l.channels = rgb_channels
+	}
+	if h.Flags&FlagBlue != 0 {
+		l.channels = blue_channels
+	}
+	if h.Flags&FlagGray != 0 {
+		l.gray = true
+		l.channels = gray_channels
+	}
+	if h.ExtFlags&ExtFlagChannelBits != 0 {
+		l.channels = nil
+		for ch, b := range h.ChannelBits {
+			l.chanBits[ch] = int(b)
+			if b != 0 {
+				l.channels = append(l.channels, ch)
+			}
+		}
+	}
+	return l
+}
+
+// pixelOrder returns the order the message pixels body of an image with bounds
+// are used in for the message h describes: the j'th part of it is in message
+// pixel order[j], or in message pixel j if order is nil.  It is shuffled by the
+// scatter key of k if the message is scattered, and otherwise strided, or those
+// in the rectangle first, as the layout gives.  Encode and Decode both take the
+// order from here, so they always walk the pixels the same way.
+func (h Header) pixelOrder(bounds image.Rectangle, body region, k keys) []uint32 {
+	if h.Flags&FlagScatter != 0 {
+		return scatterOrder(k.scatter, body.pixels())
+	}
+	return h.layout().order(bounds, body)
+}
+
+// size returns the length of the serialised header.
+func (h Header) size() int {
+	n := header_len
+	if h.Version == header_version_ext {
+		n++
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		n += salt_len + nonce_len
+	}
+	if h.Flags&FlagHMAC != 0 {
+		n += hmac_len
+	}
+	if h.Flags&FlagPlane != 0 {
+		n++
+	}
+	if h.Flags&FlagSlot != 0 {
+		n += 2
+	}
+	if h.Flags&FlagMinAlpha != 0 {
+		n++
+	}
+	if h.Flags&FlagPadded != 0 {
+		n += 4
+	}
+	if h.Flags&FlagStride != 0 {
+		n += 2
+	}
+	if h.Flags&FlagRect != 0 {
+		n += 8
+	}
+	if h.Flags&FlagFilename != 0 {
+		n += 1 + len(h.Filename)
+	}
+	if h.ExtFlags&ExtFlagMeta != 0 {
+		n += 8 + 1 + len(h.Comment)
+	}
+	if h.ExtFlags&ExtFlagChannelBits != 0 {
+		n += 2
+	}
+	if h.ExtFlags&ExtFlagECC != 0 {
+		n++
+	}
+	return n
+}
+
+// MarshalBinary serialises the header.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if h.Flags&FlagFilename != 0 && len(h.Filename) > max_filename_len {
+		return nil, fmt.Errorf("file name is longer than %d bytes", max_filename_len)
+	}
+	if h.ExtFlags&ExtFlagMeta != 0 && len(h.Comment) > max_comment_len {
+		return nil, fmt.Errorf("comment is longer than %d bytes", max_comment_len)
+	}
+
+	return h.bytes(), nil
+}
+
+// UnmarshalBinary reads and validates a serialised header.  b may continue past
+// the end of the header; an error wrapping io.ErrUnexpectedEOF is returned if it
+// ends before it.
+func (h *Header) UnmarshalBinary(b []byte) error {
+	parsed, err := parseHeader(b)
+	if err != nil {
+		return err
+	}
+
+	*h = parsed
+	return nil
+}
+
+// bytes serialises the header.
+func (h Header) bytes() []byte {
+	b := make([]byte, header_len, h.size())
+	copy(b[0:4], h.Magic[:])
+	b[4] = h.Version
+	b[5] = h.Matrix<<4 | h.Bits
+	binary.BigEndian.PutUint16(b[6:8], h.Flags)
+	binary.BigEndian.PutUint32(b[8:12], h.PayloadLen)
+	binary.BigEndian.PutUint32(b[12:16], h.CRC)
+
+	if h.Version == header_version_ext {
+		b = append(b, h.ExtFlags)
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		b = append(b, h.Salt[:]...)
+		b = append(b, h.Nonce[:]...)
+	}
+	if h.Flags&FlagHMAC != 0 {
+		b = append(b, h.Tag[:]...)
+	}
+	if h.Flags&FlagPlane != 0 {
+		b = append(b, h.Plane)
+	}
+	if h.Flags&FlagSlot != 0 {
+		b = append(b, h.Slot, h.Slots)
+	}
+	if h.Flags&FlagMinAlpha != 0 {
+		b = append(b, h.MinAlpha)
+	}
+	if h.Flags&FlagPadded != 0 {
+		b = binary.BigEndian.AppendUint32(b, h.PaddedLen)
+	}
+	if h.Flags&FlagStride != 0 {
+		b = binary.BigEndian.AppendUint16(b, h.Stride)
+	}
+	if h.Flags&FlagRect != 0 {
+		for _, v := range []int{h.Rect.Min.X, h.Rect.Min.Y, h.Rect.Dx(), h.Rect.Dy()} {
+			b = binary.BigEndian.AppendUint16(b, uint16(v))
+		}
+	}
+	if h.Flags&FlagFilename != 0 {
+		b = append(b, byte(len(h.Filename)))
+		b = append(b, h.Filename...)
+	}
+	if h.ExtFlags&ExtFlagMeta != 0 {
+		b = binary.BigEndian.AppendUint64(b, h.Time)
+		b = append(b, byte(len(h.Comment)))
+		b = append(b, h.Comment...)
+	}
+	if h.ExtFlags&ExtFlagChannelBits != 0 {
+		b = append(b, h.ChannelBits[0]<<4|h.ChannelBits[1], h.ChannelBits[2]<<4|h.ChannelBits[3])
+	}
+	if h.ExtFlags&ExtFlagECC != 0 {
+		b = append(b, h.ECC)
+	}
+	return b
+}
+
+// parseHeader reads and validates a serialised header.  It returns
+// errShortHeader if b holds only the start of the header.
+func parseHeader(b []byte) (Header, error) {
+	var h Header
+	if len(b) < header_len {
+		return h, errShortHeader
+	}
+
+	copy(h.Magic[:], b[0:4])
+	if h.Magic != header_magic {
+		return h, ErrNotStego
+	}
+
+	h.Version = b[4]
+	h.Bits = b[5] & 0x0f
+	h.Matrix = b[5] >> 4
+	h.Flags = binary.BigEndian.Uint16(b[6:8])
+	h.PayloadLen = binary.BigEndian.Uint32(b[8:12])
+	h.CRC = binary.BigEndian.Uint32(b[12:16])
+
+	if h.Version != header_version && h.Version != header_version_ext {
+		return h, fmt.Errorf("%w version %d", ErrUnsupportedFormat, h.Version)
+	}
+	if h.Flags&^known_flags != 0 {
+		return h, fmt.Errorf("%w: header flags %#04x", ErrUnsupportedFormat, h.Flags)
+	}
+	if h.Flags&FlagScatter != 0 && h.Flags&FlagEncrypted == 0 {
+		return h, fmt.Errorf("%w: scattered message is not encrypted", ErrUnsupportedFormat)
+	}
+	if h.Flags&FlagGray != 0 && h.Flags&(FlagSpread|FlagRGB|FlagBlue) != 0 {
+		return h, fmt.Errorf("%w: grayscale message with colour layout flags %#04x", ErrUnsupportedFormat, h.Flags)
+	}
+	if h.Flags&FlagRGB != 0 && h.Flags&FlagBlue != 0 {
+		return h, fmt.Errorf("%w: header flags %#04x give two sets of channels", ErrUnsupportedFormat, h.Flags)
+	}
+	if h.Flags&FlagSpread == 0 && (!validBits(int(h.Bits)) || h.Flags&FlagDepth8 != 0 && h.Bits == 8) {
+		return h, fmt.Errorf("invalid bits per channel %d in header", h.Bits)
+	}
+	if h.Matrix != 0 && (!validMatrix(int(h.Matrix)) || h.Bits != 1 || h.Flags&FlagSpread != 0) {
+		return h, fmt.Errorf("invalid matrix embedding %d of %d bits per channel in header", h.Matrix, h.Bits)
+	}
+
+	b = b[header_len:]
+	if h.Version == header_version_ext {
+		if len(b) < 1 {
+			return h, errShortHeader
+		}
+		h.ExtFlags = b[0]
+		b = b[1:]
+		if h.ExtFlags&^known_ext_flags != 0 {
+			return h, fmt.Errorf("%w: header extension flags %#02x", ErrUnsupportedFormat, h.ExtFlags)
+		}
+		if h.ExtFlags&ExtFlagMatch != 0 && (h.Bits != 1 || h.Flags&(FlagSpread|FlagMinAlpha) != 0 || h.ExtFlags&ExtFlagChannelBits != 0) {
+			return h, fmt.Errorf("invalid LSB matching of %d bits per channel for header flags %#04x", h.Bits, h.Flags)
+		}
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		if len(b) < salt_len+nonce_len {
+			return h, errShortHeader
+		}
+		copy(h.Salt[:], b[:salt_len])
+		copy(h.Nonce[:], b[salt_len:salt_len+nonce_len])
+		b = b[salt_len+nonce_len:]
+	}
+	if h.Flags&FlagHMAC != 0 {
+		if len(b) < hmac_len {
+			return h, errShortHeader
+		}
+		copy(h.Tag[:], b[:hmac_len])
+		b = b[hmac_len:]
+	}
+	if h.Flags&FlagPlane != 0 {
+		if len(b) < 1 {
+			return h, errShortHeader
+		}
+		h.Plane = b[0]
+		b = b[1:]
+		if h.Flags&FlagSpread != 0 || !validPlane(int(h.Bits), int(h.Plane)) {
+			return h, fmt.Errorf("invalid bit plane %d in header", h.Plane)
+		}
+	}
+	if h.Flags&FlagSlot != 0 {
+		if len(b) < 2 {
+			return h, errShortHeader
+		}
+		h.Slot, h.Slots = b[0], b[1]
+		b = b[2:]
+		if h.Slot >= h.Slots {
+			return h, fmt.Errorf("invalid slot %d of %d in header", h.Slot, h.Slots)
+		}
+	}
+	if h.Flags&FlagMinAlpha != 0 {
+		if len(b) < 1 {
+			return h, errShortHeader
+		}
+		h.MinAlpha = b[0]
+		b = b[1:]
+		if h.MinAlpha == 0 || h.Flags&(FlagRGB|FlagBlue|FlagGray) != 0 {
+			return h, fmt.Errorf("invalid minimum alpha %d for header flags %#04x", h.MinAlpha, h.Flags)
+		}
+	}
+	if h.Flags&FlagPadded != 0 {
+		if len(b) < 4 {
+			return h, errShortHeader
+		}
+		h.PaddedLen = binary.BigEndian.Uint32(b[:4])
+		b = b[4:]
+		if h.PaddedLen < h.PayloadLen {
+			return h, fmt.Errorf("invalid padded length %d for a payload of %d bytes in header", h.PaddedLen, h.PayloadLen)
+		}
+	}
+	if h.Flags&FlagStride != 0 {
+		if len(b) < 2 {
+			return h, errShortHeader
+		}
+		h.Stride = binary.BigEndian.Uint16(b[:2])
+		b = b[2:]
+		if h.Stride < 2 || h.Flags&FlagScatter != 0 {
+			return h, fmt.Errorf("invalid stride %d for header flags %#04x", h.Stride, h.Flags)
+		}
+	}
+	if h.Flags&FlagRect != 0 {
+		if len(b) < 8 {
+			return h, errShortHeader
+		}
+		x, y := int(binary.BigEndian.Uint16(b[0:2])), int(binary.BigEndian.Uint16(b[2:4]))
+		w, ht := int(binary.BigEndian.Uint16(b[4:6])), int(binary.BigEndian.Uint16(b[6:8]))
+		h.Rect = image.Rect(x, y, x+w, y+ht)
+		b = b[8:]
+		if w == 0 || ht == 0 || h.Flags&(FlagScatter|FlagStride) != 0 {
+			return h, fmt.Errorf("invalid rectangle %v for header flags %#04x", h.Rect, h.Flags)
+		}
+	}
+	if h.Flags&FlagFilename != 0 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return h, errShortHeader
+		}
+		h.Filename = string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+	}
+	if h.ExtFlags&ExtFlagMeta != 0 {
+		if len(b) < 9 || len(b) < 9+int(b[8]) {
+			return h, errShortHeader
+		}
+		h.Time = binary.BigEndian.Uint64(b[:8])
+		h.Comment = string(b[9 : 9+int(b[8])])
+		b = b[9+int(b[8]):]
+	}
+	if h.ExtFlags&ExtFlagChannelBits != 0 {
+		if len(b) < 2 {
+			return h, errShortHeader
+		}
+		h.ChannelBits = [4]uint8{b[0] >> 4, b[0] & 0x0f, b[1] >> 4, b[1] & 0x0f}
+		b = b[2:]
+		if err := checkChannelBits(h); err != nil {
+			return h, err
+		}
+	}
+	if h.ExtFlags&ExtFlagECC != 0 {
+		if len(b) < 1 {
+			return h, errShortHeader
+		}
+		h.ECC = b[0]
+		if last := int(h.PayloadLen % ecc_block_len); !validECC(int(h.ECC)) || last != 0 && last <= int(h.ECC) || h.Flags&FlagHMAC != 0 {
+			return h, fmt.Errorf("invalid error correction %d for a payload of %d bytes in header", h.ECC, h.PayloadLen)
+		}
+	}
+
+	return h, nil
+}
+
+// checkChannelBits returns an error if the bits of each channel in h are not
+// ones Encode could have chosen.
+func checkChannelBits(h Header) error {
+	most := uint8(0)
+	for _, b := range h.ChannelBits {
+		if b != 0 && (!validBits(int(b)) || h.Flags&FlagDepth8 != 0 && b == 8) {
+			most = 0xff
+			break
+		}
+		most = max(most, b)
+	}
+	if most != h.Bits || h.Flags&(FlagSpread|FlagRGB|FlagBlue|FlagGray) != 0 || h.Matrix != 0 || h.ExtFlags&ExtFlagInterleave != 0 {
+		return fmt.Errorf("invalid bits %v for each channel for header flags %#04x", h.ChannelBits, h.Flags)
+	}
+	if h.Flags&FlagMinAlpha != 0 && h.ChannelBits[3] == 0 {
+		return fmt.Errorf("invalid minimum alpha %d with no bits in alpha", h.MinAlpha)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package stego
+
+// An interleaved message fills each row of message pixels a colour value at a
+// time.  Bit k of the part of the message in a row of n pixels, with b bits in
+// each of its colour values, goes in colour value k/(n*b) of pixel k/b%n of the
+// row.  The rows are those of the image, so the first is cut short by the
+// header, and a message ending part way along a row is spread over all of it.
+//
+// It is done by reordering the bits of the message into those the pixels hold
+// in turn, so the pixel loops need not know about it.
+
+// interleaveRows calls f with the first message pixel, the number of pixels
+// and the number of message bits of each row of the message pixels body of an
+// image width pixels wide that n message bits interleaved reach.
+func (l layout) interleaveRows(width int, body region, n int, f func(start, pixels, bits int)) {
+	p := l.pixelBits()
+	for done, start := 0, body.start; done < n && start < body.end; {
+		end := min((start/width+1)*width, body.end)
+		bits := min((end-start)*p, n-done)
+		f(start, end-start, bits)
+		done += bits
+		start = end
+	}
+}
+
+// interleavedLen returns the number of bytes of bits, in the order the message
+// pixels body of an image width pixels wide hold them, that hide n message
+// bytes interleaved: up to the end of the last row the message reaches.
+func (l layout) interleavedLen(n, width int, body region) int {
+	end := body.start
+	l.interleaveRows(width, body, n*8, func(start, pixels, _ int) {
+		end = start + pixels
+	})
+	return ((end-body.start)*l.pixelBits() + 7) / 8
+}
+
+// interleaveBits calls f with the position of each of the n bits of a message
+// interleaved in the message pixels body of an image width pixels wide, and
+// the position of the bit in the order the pixels hold them.
+func (l layout) interleaveBits(width int, body region, n int, f func(k, s int)) {
+	p := l.pixelBits()
+	done := 0
+	l.interleaveRows(width, body, n, func(start, pixels, bits int) {
+		base := (start - body.start) * p
+		for k := range bits {
+			ch, pixel := k/(pixels*l.bits), k/l.bits%pixels
+			f(done+k, base+pixel*p+ch*l.bits+k%l.bits)
+		}
+		done += bits
+	})
+}
+
+// interleaveMessage returns the bits cover, held in turn by the first message
+// pixels body of an image width pixels wide, with msg interleaved into them.
+func (l layout) interleaveMessage(cover, msg []byte, width int, body region) []byte {
+	stored := make([]byte, l.interleavedLen(len(msg), width, body))
+	copy(stored, cover)
+	l.interleaveBits(width, body, len(msg)*8, func(k, s int) {
+		mask := byte(0x80 >> (s % 8))
+		if bitAt(msg, k) != 0 {
+			stored[s/8] |= mask
+		} else {
+			stored[s/8] &^= mask
+		}
+	})
+	return stored
+}
+
+// deinterleaveMessage recovers the n message bytes interleaved in the bits
+// stored, held in turn by the message pixels body of an image width pixels
+// wide.
+func (l layout) deinterleaveMessage(stored []byte, n, width int, body region) []byte {
+	msg := make([]byte, n)
+	l.interleaveBits(width, body, n*8, func(k, s int) {
+		if bitAt(stored, s) != 0 {
+			msg[k/8] |= 0x80 >> (k % 8)
+		}
+	})
+	return msg
+}
+
+// storedLen returns the number of bytes of bits, in the order the pixels hold
+// them, taken up by the message described by h in the message pixels body of
+// an image width pixels wide.
+func (h Header) storedLen(width int, body region) int {
+	l := h.layout()
+	if l.interleave {
+		return l.interleavedLen(h.embeddedLen(), width, body)
+	}
+	return l.storedLen(int(h.PayloadLen))
+}
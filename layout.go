@@ -0,0 +1,472 @@
+package stego
+
+import (
+	"image"
+	"image/color"
+)
+
+// Ways of laying the message out over the colour values of each pixel
+const (
+	ModeSequential = "sequential" // the message bits fill each colour value in turn
+	ModeSpread     = "spread"     // each pixel holds one byte, split positionally over its colour values
+)
+
+// Colour values of each pixel that carry the message
+const (
+	ChannelsRGBA = "rgba"
+	ChannelsRGB  = "rgb" // alpha is left untouched
+	ChannelsBlue = "b"   // blue only, the colour the eye is least sensitive to
+)
+
+// layout describes where the message bits go in each pixel.
+type layout struct {
+	bits       int   // low bits of each colour value used, in sequential mode
+	spread     bool  // each pixel holds exactly one byte
+	channels   []int // colour values carrying the message (0=R, 1=G, 2=B, 3=A), in order
+	depth8     bool  // the low bits of 8 bit colour values are used, for an 8 bit output image
+	plane      int   // lowest bit of each colour value used, in sequential mode
+	gray       bool  // the image is grayscale, and the message is in its luminance values
+	minAlpha   int   // alpha values below this (out of 255) are left alone, if the message is in alpha
+	stride     int   // only every stride'th message pixel is used, if more than 1
+	matrix     int   // message bits matrix embedded in each group of 2^matrix-1 cover bits, if not 0
+	opaque     bool  // the alpha of every pixel of the output is set to fully opaque
+	interleave bool  // each row of message pixels is filled a colour value at a time
+	match      bool  // a low bit is changed by adding or subtracting 1 at random, not by setting it
+
+	// Bits of each of R, G, B and A used, if set; bits is then the most of
+	// them, and channels those with any
+	chanBits [4]int
+
+	// Seed of the random choices of LSB matching, read by seedMatch
+	matchSeed [32]byte
+
+	// Only the pixels in rect (relative to the top left of the image) carry the
+	// message, if it is not empty
+	rect image.Rectangle
+}
+
+// Longest stride between the pixels carrying the message
+const max_stride = 1<<16 - 1
+
+// Furthest from the top left of the image, and largest, a rectangle can be
+const max_rect = 1<<16 - 1
+
+// Bits per colour value used when Options.Bits is 0: a whole byte of each 16 bit
+// value, or half of each 8 bit value with KeepDepth
+const default_bits = 8
+const default_bits_depth8 = 4
+
+var rgba_channels = []int{0, 1, 2, 3}
+var rgb_channels = []int{0, 1, 2}
+var blue_channels = []int{2}
+var gray_channels = []int{0} // grayscale images are read with the luminance in R
+
+// validBits reports whether bits is a supported number of bits per colour channel.
+func validBits(bits int) bool {
+	return bits == 1 || bits == 2 || bits == 4 || bits == 8
+}
+
+// validPlane reports whether bits bits starting at bit plane fit in the low
+// byte of a colour value.
+func validPlane(bits, plane int) bool {
+	return plane >= 0 && plane+bits <= 8
+}
+
+// bitsMask returns the mask that clears the low bits of a colour value.
+func bitsMask(bits int) uint32 {
+	return ^(uint32(1)<<bits - 1)
+}
+
+// layout checks the options and works out the pixel layout they describe for
+// hiding a message in img.
+func (o Options) layout(img image.Image) (layout, error) {
+	var l layout
+
+	switch o.Channels {
+	case "", ChannelsRGBA:
+		l.channels = rgba_channels
+	case ChannelsRGB:
+		l.channels = rgb_channels
+	case ChannelsBlue:
+		l.channels = blue_channels
+	default:
+		return l, optionsErrorf("invalid channels %q (want %s, %s or %s)", o.Channels, ChannelsRGBA, ChannelsRGB, ChannelsBlue)
+	}
+
+	if o.Opaque {
+		if o.Channels == ChannelsRGBA {
+			return l, optionsErrorf("the message cannot go in alpha in an opaque image (want %s or %s channels)", ChannelsRGB, ChannelsBlue)
+		}
+		if o.Channels == "" {
+			l.channels = rgb_channels
+		}
+		l.opaque = true
+	}
+
+	l.depth8 = o.KeepDepth && !is16Bit(img)
+
+	// A grayscale image has a single value per pixel to hide the message in
+	if isGray(img) {
+		l.gray = true
+		l.channels = gray_channels
+	}
+	if o.MinAlpha < 0 || o.MinAlpha > 255 {
+		return l, optionsErrorf("invalid minimum alpha %d (want 0 to 255)", o.MinAlpha)
+	}
+	if len(l.channels) == 4 {
+		l.minAlpha = o.MinAlpha
+	}
+	if o.Stride < 0 || o.Stride > max_stride {
+		return l, optionsErrorf("invalid stride %d (want 0 to %d)", o.Stride, max_stride)
+	}
+	if o.Stride > 1 {
+		if o.Scatter {
+			return l, optionsErrorf("a stride cannot be combined with scatter")
+		}
+		l.stride = o.Stride
+	}
+	if !o.Rect.Empty() {
+		b := img.Bounds()
+		if !o.Rect.In(image.Rect(0, 0, b.Dx(), b.Dy())) {
+			return l, optionsErrorf("rectangle %v is not within the %dx%d image", o.Rect, b.Dx(), b.Dy())
+		}
+		if o.Rect.Min.X > max_rect || o.Rect.Min.Y > max_rect || o.Rect.Dx() > max_rect || o.Rect.Dy() > max_rect {
+			return l, optionsErrorf("rectangle %v is more than %d pixels across", o.Rect, max_rect)
+		}
+		if o.Scatter || l.stride > 1 {
+			return l, optionsErrorf("a rectangle cannot be combined with scatter or a stride")
+		}
+		l.rect = o.Rect
+	}
+
+	switch o.Mode {
+	case "", ModeSequential:
+		bits := o.Bits
+		if bits == 0 {
+			bits = default_bits
+			if l.depth8 {
+				bits = default_bits_depth8
+			}
+		}
+		if o.Matrix != 0 {
+			if !validMatrix(o.Matrix) {
+				return l, optionsErrorf("invalid matrix embedding %d (want 2 to %d bits per group)", o.Matrix, max_matrix)
+			}
+			if o.Bits != 0 && o.Bits != 1 {
+				return l, optionsErrorf("matrix embedding needs 1 bit per channel, not %d", o.Bits)
+			}
+			bits = 1
+			l.matrix = o.Matrix
+		}
+		if o.Match {
+			if o.Bits != 0 && o.Bits != 1 {
+				return l, optionsErrorf("LSB matching needs 1 bit per channel, not %d", o.Bits)
+			}
+			bits = 1
+			l.match = true
+		}
+		if o.ChannelBits != [4]int{} {
+			if o.Bits != 0 || l.matrix != 0 || l.match {
+				return l, optionsErrorf("bits for each channel cannot be combined with Bits, matrix embedding or LSB matching")
+			}
+			if l.gray {
+				return l, optionsErrorf("a grayscale image has one value per pixel, so needs Bits rather than bits for each channel")
+			}
+			if o.Channels != "" && o.Channels != ChannelsRGBA {
+				return l, optionsErrorf("bits for each channel choose the channels, so cannot be used with %s channels", o.Channels)
+			}
+			if o.Opaque && o.ChannelBits[3] != 0 {
+				return l, optionsErrorf("the message cannot go in alpha in an opaque image")
+			}
+			bits, l.channels = 0, nil
+			for ch, b := range o.ChannelBits {
+				if b != 0 && !validBits(b) {
+					return l, optionsErrorf("invalid bits %d for channel %c (want 0, 1, 2, 4 or 8)", b, "RGBA"[ch])
+				}
+				if b != 0 {
+					l.channels = append(l.channels, ch)
+					bits = max(bits, b)
+				}
+			}
+			if o.ChannelBits[3] == 0 {
+				l.minAlpha = 0
+			}
+			l.chanBits = o.ChannelBits
+		}
+		if !validBits(bits) {
+			return l, optionsErrorf("invalid bits per channel %d (want 1, 2, 4 or 8)", bits)
+		}
+		if l.depth8 && bits == 8 {
+			return l, optionsErrorf("invalid bits per channel %d for an 8 bit image (want 1, 2 or 4)", bits)
+		}
+		if !validPlane(bits, o.Plane) {
+			return l, optionsErrorf("invalid bit plane %d for %d bits per channel (want 0 to %d)", o.Plane, bits, 8-bits)
+		}
+		l.bits = bits
+		l.plane = o.Plane
+	case ModeSpread:
+		if l.gray {
+			return l, optionsErrorf("%s mode cannot be used with a grayscale image", ModeSpread)
+		}
+		if o.Plane != 0 {
+			return l, optionsErrorf("a bit plane cannot be chosen in %s mode", ModeSpread)
+		}
+		if o.Matrix != 0 {
+			return l, optionsErrorf("matrix embedding cannot be used in %s mode", ModeSpread)
+		}
+		if o.Match {
+			return l, optionsErrorf("LSB matching cannot be used in %s mode", ModeSpread)
+		}
+		if o.ChannelBits != [4]int{} {
+			return l, optionsErrorf("bits for each channel cannot be chosen in %s mode", ModeSpread)
+		}
+		l.spread = true
+	default:
+		return l, optionsErrorf("invalid mode %q (want %s or %s)", o.Mode, ModeSequential, ModeSpread)
+	}
+
+	if o.Interleave {
+		if l.spread || l.matrix != 0 || l.minAlpha != 0 || o.Scatter || l.stride > 1 || !l.rect.Empty() || l.chanBits != [4]int{} {
+			return l, optionsErrorf("interleaving cannot be combined with %s mode, matrix embedding, a minimum alpha, scatter, a stride, a rectangle or bits for each channel", ModeSpread)
+		}
+		l.interleave = true
+	}
+	if l.match && l.minAlpha != 0 {
+		return l, optionsErrorf("LSB matching cannot be combined with a minimum alpha")
+	}
+
+	return l, nil
+}
+
+// is16Bit reports whether img has 16 bits per colour value.
+func is16Bit(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// isGray reports whether img is grayscale.
+func isGray(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// view returns the colour values the layout works on: the 16 bit values c,
+// or just their top 8 bits if the layout is for an 8 bit image.
+func (l layout) view(c [4]uint32) [4]uint32 {
+	if l.depth8 {
+		for i := range c {
+			c[i] >>= 8
+		}
+	}
+	return c
+}
+
+// opaqueAlpha returns the alpha value of a fully opaque pixel, as seen through
+// the layout.
+func (l layout) opaqueAlpha() uint32 {
+	if l.depth8 {
+		return 0xff
+	}
+	return 0xffff
+}
+
+// headerLayout returns the layout the header is stored with: a byte per R, G
+// and B value (or luminance value, if grayscale), or 2 bits of each for an 8
+// bit image.
+func (l layout) headerLayout() layout {
+	hl := layout{bits: 8, channels: rgb_channels, depth8: l.depth8, gray: l.gray}
+	if l.depth8 {
+		hl.bits = 2
+	}
+	if l.gray {
+		hl.channels = gray_channels
+	}
+	return hl
+}
+
+// headerPixels returns the number of pixels needed to store n header bytes.
+func (l layout) headerPixels(n int) int {
+	bits := l.headerLayout().pixelBits()
+	return (n*8 + bits - 1) / bits
+}
+
+// capacity returns the number of message bytes that fit in the given number of pixels.
+func (l layout) capacity(pixels int) int {
+	if l.spread {
+		return pixels
+	}
+	return pixels * l.pixelBits() / 8
+}
+
+// messagePixels returns the number of the n message pixels that can carry the
+// message: every stride'th one, or those in the rectangle.
+func (l layout) messagePixels(n int) int {
+	if !l.rect.Empty() {
+		return min(l.rect.Dx()*l.rect.Dy(), n)
+	}
+	if l.stride > 1 {
+		return (n + l.stride - 1) / l.stride
+	}
+	return n
+}
+
+// order returns the order the message pixels body of an image with bounds are
+// used in: every stride'th one first, or those in the rectangle first, or nil to
+// use them in turn.
+func (l layout) order(bounds image.Rectangle, body region) []uint32 {
+	switch {
+	case !l.rect.Empty():
+		return rectOrder(bounds.Dx(), body, l.rect)
+	case l.stride > 1:
+		return strideOrder(max(body.pixels(), 0), l.stride)
+	}
+	return nil
+}
+
+// checkRect reports whether the rectangle, if any, lies within the message
+// pixels body of an image with bounds, so clear of the header.
+func (l layout) checkRect(bounds image.Rectangle, body region) bool {
+	if l.rect.Empty() {
+		return true
+	}
+	first := l.rect.Min.Y*bounds.Dx() + l.rect.Min.X
+	last := (l.rect.Max.Y-1)*bounds.Dx() + l.rect.Max.X - 1
+	return l.rect.Max.X <= bounds.Dx() && first >= body.start && last < body.end
+}
+
+// pixelBits returns the number of message bits each pixel holds.
+func (l layout) pixelBits() int {
+	if l.spread {
+		return 8
+	}
+	return l.channelsBits(l.channels)
+}
+
+// bitsOf returns the number of low bits of colour value ch used, in sequential
+// mode.
+func (l layout) bitsOf(ch int) int {
+	if l.chanBits == [4]int{} {
+		return l.bits
+	}
+	return l.chanBits[ch]
+}
+
+// channelsBits returns the number of message bits the colour values chs hold.
+func (l layout) channelsBits(chs []int) int {
+	if l.chanBits == [4]int{} {
+		return len(chs) * l.bits
+	}
+	n := 0
+	for _, ch := range chs {
+		n += l.chanBits[ch]
+	}
+	return n
+}
+
+// keepsAlpha reports whether the alpha of a pixel with colour values c is left
+// alone, because it is below the minimum.  Only the bits of alpha that cannot
+// carry the message are looked at, so the answer is the same when decoding.
+func (l layout) keepsAlpha(c [4]uint32) bool {
+	if l.minAlpha == 0 {
+		return false
+	}
+
+	a := c[3] & l.planeMask(3)
+	if l.spread {
+		bits, _ := spreadBits(3, len(rgba_channels))
+		a = c[3] & bitsMask(bits)
+	}
+	if !l.depth8 {
+		a >>= 8
+	}
+	return int(a) < l.minAlpha
+}
+
+// pixelChannels returns the colour values of a pixel with colour values c that
+// carry the message.
+func (l layout) pixelChannels(c [4]uint32) []int {
+	if l.keepsAlpha(c) {
+		return l.channels[:len(l.channels)-1]
+	}
+	return l.channels
+}
+
+// bitsIn returns the number of message bits a pixel with colour values c holds.
+func (l layout) bitsIn(c [4]uint32) int {
+	if l.spread {
+		return 8
+	}
+	return l.channelsBits(l.pixelChannels(c))
+}
+
+// spreadBits returns how many bits of each byte the i'th of n message channels
+// holds in spread mode, and the position of the lowest of them: the 8 bits are
+// shared out as evenly as possible, lowest bits first, eg. 2/2/2/2 over RGBA
+// and 3/3/2 over RGB.
+func spreadBits(i, n int) (bits, shift int) {
+	for j := 0; j <= i; j++ {
+		shift += bits
+		bits = 8 / n
+		if j < 8%n {
+			bits++
+		}
+	}
+	return bits, shift
+}
+
+// planeMask returns the mask that clears the bits of colour value ch used in
+// sequential mode.
+func (l layout) planeMask(ch int) uint32 {
+	return ^(^bitsMask(l.bitsOf(ch)) << l.plane)
+}
+
+// encodePixel hides the next part of the message in the colour values c of a pixel.
+func (l layout) encodePixel(br *bitReader, c [4]uint32) [4]uint32 {
+	chs := l.pixelChannels(c)
+	if l.spread {
+		mb, ok := br.nextByte()
+		if !ok {
+			return c
+		}
+		for i, ch := range chs {
+			bits, shift := spreadBits(i, len(chs))
+			c[ch] = (uint32(mb>>shift) & ^bitsMask(bits)) | (c[ch] & bitsMask(bits))
+		}
+		return c
+	}
+
+	for _, ch := range chs {
+		if mb, ok := br.next(l.bitsOf(ch)); ok {
+			c[ch] = (mb << l.plane) | (c[ch] & l.planeMask(ch))
+		}
+	}
+	return c
+}
+
+// decodePixel recovers the part of the message hidden in the colour values c of
+// a pixel, appending any bytes it completes to out.
+func (l layout) decodePixel(bw *bitWriter, c [4]uint32, out []byte) []byte {
+	chs := l.pixelChannels(c)
+	if l.spread {
+		var b uint32
+		for i, ch := range chs {
+			bits, shift := spreadBits(i, len(chs))
+			b |= (c[ch] & ^bitsMask(bits)) << shift
+		}
+		return append(out, byte(b))
+	}
+
+	for _, ch := range chs {
+		bits := l.bitsOf(ch)
+		if b, done := bw.add((c[ch]>>l.plane) & ^bitsMask(bits), bits); done {
+			out = append(out, byte(b))
+		}
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package stego
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+)
+
+// LSB matching changes a colour value whose low bit must change by adding or
+// subtracting 1 (at the bit plane) at random, rather than by setting the bit.
+// Setting it pairs the values 2k and 2k+1, which swap into each other and are
+// evened out in number, the pattern the chi-square attack finds; adding or
+// subtracting 1 moves values to both neighbours instead.  The bit read back is
+// the same, so Decode need not know.
+
+// seedMatch reads the seed of the random choices of LSB matching from rnd into
+// l, if l matches.
+func (l *layout) seedMatch(rnd io.Reader) error {
+	if !l.match {
+		return nil
+	}
+	_, err := io.ReadFull(rnd, l.matchSeed[:])
+	return err
+}
+
+// matcher returns the source of the random choices of LSB matching for row y,
+// or nil if l does not match.  Each row has its own, so the choices are the
+// same however the rows are split into bands to be encoded concurrently.
+func (l layout) matcher(y int) *rand.ChaCha8 {
+	if !l.match {
+		return nil
+	}
+	seed := l.matchSeed
+	binary.BigEndian.PutUint64(seed[24:], binary.BigEndian.Uint64(seed[24:])^uint64(y))
+	return rand.NewChaCha8(seed)
+}
+
+// matchValues returns the colour values c of a pixel with each that
+// encodePixel changed to enc instead moved up or down by 1 at the bit plane, at
+// random unless that would take it out of range, so its low bit is enc's.
+func (l layout) matchValues(c, enc [4]uint32, src *rand.ChaCha8) [4]uint32 {
+	step, top := uint32(1)<<l.plane, l.opaqueAlpha()
+	for ch := range c {
+		if c[ch] == enc[ch] {
+			continue
+		}
+		up := src.Uint64()&1 == 0
+		if c[ch] < step {
+			up = true
+		} else if c[ch] > top-step {
+			up = false
+		}
+		if up {
+			c[ch] += step
+		} else {
+			c[ch] -= step
+		}
+	}
+	return c
+}
@@ -0,0 +1,124 @@
+package stego
+
+import "io"
+
+// Matrix embedding hides k message bits in each group of n = 2^k-1 cover bits
+// (the bits of the colour values the message goes in, in the order they are
+// used) with a Hamming code: the syndrome of a group, the XOR of the positions
+// (from 1) of its set bits, is the k message bits, and any syndrome can be made
+// by flipping at most one bit of the group.  So k bits cost at most one change
+// in n, rather than about half a change per bit with plain LSB embedding, at
+// the cost of hiding k bits in n rather than in k.
+
+// Most message bits hidden in each group of cover bits
+const max_matrix = 8
+
+// validMatrix reports whether k message bits per group can be matrix embedded.
+func validMatrix(k int) bool {
+	return k >= 2 && k <= max_matrix
+}
+
+// groupBits returns the number of cover bits in each group.
+func (l layout) groupBits() int {
+	return 1<<l.matrix - 1
+}
+
+// matrixCapacity returns the number of message bytes that can be hidden in n
+// bytes of cover bits.
+func (l layout) matrixCapacity(n int) int {
+	if l.matrix == 0 {
+		return n
+	}
+	return n * 8 / l.groupBits() * l.matrix / 8
+}
+
+// storedLen returns the number of bytes of cover bits needed to hide n message
+// bytes.
+func (l layout) storedLen(n int) int {
+	if l.matrix == 0 {
+		return n
+	}
+	groups := (n*8 + l.matrix - 1) / l.matrix
+	return (groups*l.groupBits() + 7) / 8
+}
+
+// bitAt returns bit i of b, counting from the most significant bit of b[0], or
+// 0 past the end of b.
+func bitAt(b []byte, i int) int {
+	if i/8 >= len(b) {
+		return 0
+	}
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// matrixEmbed returns the cover bits cover altered to hide msg, k bits to each
+// group of 2^k-1 bits.  Any bits past the last group are left as they are.
+func matrixEmbed(cover, msg []byte, k int) []byte {
+	stored := append([]byte(nil), cover...)
+	n := 1<<k - 1
+	for g := range (len(msg)*8 + k - 1) / k {
+		m := 0
+		for i := range k {
+			m = m<<1 | bitAt(msg, g*k+i)
+		}
+		s := 0
+		for i := 1; i <= n; i++ {
+			if bitAt(stored, g*n+i-1) != 0 {
+				s ^= i
+			}
+		}
+		if d := s ^ m; d != 0 {
+			j := g*n + d - 1
+			stored[j/8] ^= 0x80 >> (j % 8)
+		}
+	}
+	return stored
+}
+
+// matrixWriter recovers the message from the cover bits written to it, and
+// writes the first left bytes of it to w.
+type matrixWriter struct {
+	w    io.Writer
+	k, n int
+	left int
+
+	syndrome, have int    // syndrome of the cover bits of the group so far
+	cur            uint32 // message bits not yet making up a byte
+	bits           int
+	out            []byte
+}
+
+func newMatrixWriter(w io.Writer, k, length int) *matrixWriter {
+	return &matrixWriter{w: w, k: k, n: 1<<k - 1, left: length}
+}
+
+func (mw *matrixWriter) Write(p []byte) (int, error) {
+	mw.out = mw.out[:0]
+	for i := range len(p) * 8 {
+		mw.have++
+		if bitAt(p, i) != 0 {
+			mw.syndrome ^= mw.have
+		}
+		if mw.have < mw.n {
+			continue
+		}
+
+		mw.cur = mw.cur<<mw.k | uint32(mw.syndrome)
+		mw.bits += mw.k
+		mw.syndrome, mw.have = 0, 0
+		for mw.bits >= 8 {
+			mw.bits -= 8
+			mw.out = append(mw.out, byte(mw.cur>>mw.bits))
+			mw.cur &= 1<<mw.bits - 1
+		}
+	}
+
+	out := mw.out[:min(len(mw.out), mw.left)]
+	mw.left -= len(out)
+	if len(out) > 0 {
+		if _, err := mw.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
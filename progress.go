@@ -0,0 +1,53 @@
+package stego
+
+import "sync"
+
+// progress reports how much of the message has been hidden or recovered to an
+// Options.Progress callback.  A nil *progress reports nothing.
+type progress struct {
+	mu         sync.Mutex
+	fn         func(done, total int)
+	total      int // bytes of the message as hidden
+	pixel_bits int
+	pixels     int // message pixels encoded so far
+	done       int // bytes last reported
+}
+
+// newProgress returns a progress reporting to fn, or nil if fn is nil.
+func newProgress(fn func(done, total int), total, pixel_bits int) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn, total: total, pixel_bits: pixel_bits, done: -1}
+}
+
+// addPixels records that n more message pixels have been encoded.  The bands
+// of the image are encoded concurrently, so this may be called from several
+// goroutines, but fn is only ever called from one at a time.
+func (p *progress) addPixels(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pixels += n
+	p.report(min(p.pixels*p.pixel_bits/8, p.total))
+}
+
+// setDone records that the first done bytes of the message have been recovered.
+func (p *progress) setDone(done int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report(done)
+}
+
+// report calls fn if done has changed since it was last called.
+func (p *progress) report(done int) {
+	if done != p.done {
+		p.done = done
+		p.fn(done, p.total)
+	}
+}
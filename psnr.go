@@ -0,0 +1,43 @@
+package stego
+
+import (
+	"image"
+	"math"
+)
+
+// PSNR returns the peak signal-to-noise ratio of b against a, in decibels,
+// over the R, G, B and A values of every pixel on the 16 bit scale, as a
+// measure of how much hiding a message in a distorted it: the higher the
+// better, with anything over about 50 dB imperceptible.  It returns +Inf if
+// the images are identical, and 0 if they are not the same size.
+func PSNR(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		return 0
+	}
+
+	var sum float64
+	n := ab.Dx() * ab.Dy()
+	comparePixels(a, b, func(_ int, ca, cb [4]uint32) {
+		for ch := range ca {
+			d := float64(ca[ch]) - float64(cb[ch])
+			sum += d * d
+		}
+	})
+	if sum == 0 {
+		return math.Inf(1)
+	}
+
+	mse := sum / float64(n*4)
+	return 10 * math.Log10(65535*65535/mse)
+}
+
+// comparePixels calls f with the colour values of each pixel i of a and the
+// same pixel of b, which must be the same size, counting from the top left of
+// each.
+func comparePixels(a, b image.Image, f func(i int, ca, cb [4]uint32)) {
+	ab, bb := a.Bounds(), b.Bounds()
+	for i := range ab.Dx() * ab.Dy() {
+		f(i, colourAt(a, pixelPoint(ab, i)), colourAt(b, pixelPoint(bb, i)))
+	}
+}
@@ -0,0 +1,84 @@
+package stego
+
+import (
+	"image"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// scatterOrder returns the order in which the n message pixels are used when
+// the message is scattered: the j'th part of the message is hidden in message
+// pixel order[j].  The order is a Fisher-Yates shuffle driven by ChaCha8 seeded
+// from the password, so the same password always gives the same order.
+func scatterOrder(seed [32]byte, n int) []uint32 {
+	order := make([]uint32, n)
+	for i := range order {
+		order[i] = uint32(i)
+	}
+
+	src := rand.NewChaCha8(seed)
+	for i := n - 1; i > 0; i-- {
+		j := uniform(src, uint64(i+1))
+		order[i], order[j] = order[j], order[i]
+	}
+
+	return order
+}
+
+// strideOrder returns the order in which the n message pixels are used when
+// the message is hidden in every stride'th one: those first, and then (where
+// nothing more is hidden) the pixels in between, a column of strides at a time.
+func strideOrder(n, stride int) []uint32 {
+	order := make([]uint32, 0, n)
+	for first := range min(stride, n) {
+		for p := first; p < n; p += stride {
+			order = append(order, uint32(p))
+		}
+	}
+
+	return order
+}
+
+// rectOrder returns the order in which the message pixels body of an image
+// width pixels wide are used when the message is hidden in the rectangle rect:
+// its pixels first, a row at a time, and then (where nothing more is hidden)
+// the rest.  rect must lie within body.
+func rectOrder(width int, body region, rect image.Rectangle) []uint32 {
+	order := make([]uint32, 0, body.pixels())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			order = append(order, uint32(y*width+x-body.start))
+		}
+	}
+	for p := body.start; p < body.end; p++ {
+		if !image.Pt(p%width, p/width).In(rect) {
+			order = append(order, uint32(p-body.start))
+		}
+	}
+
+	return order
+}
+
+// uniform returns an unbiased random number in [0, n), using Lemire's
+// multiply-and-reject method.  This is done here rather than with rand.Rand, so
+// the order does not change if the standard library changes its algorithm.
+func uniform(src *rand.ChaCha8, n uint64) uint64 {
+	threshold := -n % n
+	for {
+		hi, lo := bits.Mul64(src.Uint64(), n)
+		if lo >= threshold {
+			return hi
+		}
+	}
+}
+
+// scatterSlots inverts order, giving the part of the message each message pixel
+// holds.
+func scatterSlots(order []uint32) []uint32 {
+	slots := make([]uint32, len(order))
+	for j, p := range order {
+		slots[p] = uint32(j)
+	}
+
+	return slots
+}
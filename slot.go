@@ -0,0 +1,48 @@
+package stego
+
+import "image"
+
+// Most slots an image can be divided into
+const max_slots = 255
+
+// region is a run of pixels, counting along each row in turn, from start up to
+// (but not including) end.
+type region struct {
+	start, end int
+}
+
+// pixels returns the number of pixels in the region.
+func (r region) pixels() int {
+	return max(r.end-r.start, 0)
+}
+
+// slotRegion returns the pixels of slot of the slots equal parts bounds is
+// divided into.  Each slot holds its own header and message.
+func slotRegion(bounds image.Rectangle, slot, slots int) region {
+	total := bounds.Dx() * bounds.Dy()
+	return region{start: total * slot / slots, end: total * (slot + 1) / slots}
+}
+
+// slots returns the slot and the number of slots given in the options, after
+// checking them.
+func (o Options) slots() (slot, slots int, err error) {
+	slots = max(o.Slots, 1)
+	if slots > max_slots {
+		return 0, 0, optionsErrorf("invalid number of slots %d (want at most %d)", o.Slots, max_slots)
+	}
+	if o.Slot < 0 || o.Slot >= slots {
+		return 0, 0, optionsErrorf("invalid slot %d (want 0 to %d)", o.Slot, slots-1)
+	}
+
+	return o.Slot, slots, nil
+}
+
+// region returns the pixels of img the options select.
+func (o Options) region(img image.Image) (region, error) {
+	slot, slots, err := o.slots()
+	if err != nil {
+		return region{}, err
+	}
+
+	return slotRegion(img.Bounds(), slot, slots), nil
+}
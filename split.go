@@ -0,0 +1,201 @@
+package stego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+)
+
+// ErrNotSplit is returned by DecodeJoin when an image does not hold a part of
+// the same split message as the others.
+var ErrNotSplit = errors.New("image does not hold a part of the split message")
+
+// ErrChunkMissing is returned by DecodeJoin when none of the images hold one of
+// the parts of the split message.
+var ErrChunkMissing = errors.New("part of the split message is missing")
+
+// Marker at the start of each part of a split message
+var chunk_magic = [4]byte{'S', 'T', 'G', 'C'}
+
+// Each part of a split message starts with a chunk header, serialised
+// big-endian as
+//
+//	magic [4]byte | flags uint8 | index uint8 | count uint8 | length uint32 | crc uint32
+//
+// where length is that of the whole message after any compression, and crc
+// that of the message as given to EncodeSplit.  It goes inside the message
+// hidden in each image, so each image still has an ordinary stego header.
+const chunk_header_len = 15
+
+// Chunk header flags
+const chunk_compressed = 1 // the joined message is gzip compressed
+
+// Most images a message can be split over
+const max_chunks = 255
+
+// chunkHeader describes one part of a split message.
+type chunkHeader struct {
+	flags, index, count uint8
+	length, crc         uint32
+}
+
+func (c chunkHeader) bytes() []byte {
+	b := append(chunk_magic[:0:0], chunk_magic[:]...)
+	b = append(b, c.flags, c.index, c.count)
+	b = binary.BigEndian.AppendUint32(b, c.length)
+	return binary.BigEndian.AppendUint32(b, c.crc)
+}
+
+// parseChunk splits a part of a split message into its chunk header and data.
+func parseChunk(b []byte) (chunkHeader, []byte, bool) {
+	if len(b) < chunk_header_len || !bytes.Equal(b[:4], chunk_magic[:]) {
+		return chunkHeader{}, nil, false
+	}
+	c := chunkHeader{
+		flags:  b[4],
+		index:  b[5],
+		count:  b[6],
+		length: binary.BigEndian.Uint32(b[7:11]),
+		crc:    binary.BigEndian.Uint32(b[11:15]),
+	}
+	return c, b[chunk_header_len:], c.index < c.count
+}
+
+// EncodeSplit hides msg in as many of imgs as it needs, in order, filling each
+// before moving on to the next, for a message too big for any one image.  It
+// returns the stego images, which may be fewer than imgs; DecodeJoin recovers
+// the message from them, given in any order.  Each image must hold at least one
+// byte of the message, and at most 255 images are used.  With opts.Compress the
+// whole message is compressed before it is split.
+func EncodeSplit(imgs []image.Image, msg []byte, opts Options) ([]image.Image, error) {
+	c := chunkHeader{crc: crc32.ChecksumIEEE(msg)}
+	data := msg
+	if opts.Compress {
+		packed, err := compress(msg)
+		if err != nil {
+			return nil, err
+		}
+		c.flags |= chunk_compressed
+		data = packed
+		opts.Compress = false
+	}
+	if int64(len(data)) > int64(^uint32(0)) {
+		return nil, optionsErrorf("invalid message length %d", len(data))
+	}
+	c.length = uint32(len(data))
+
+	// Work out how much of the message goes in each image
+	var sizes []int
+	room := 0
+	for i, img := range imgs {
+		if len(sizes) > 0 && room >= len(data) {
+			break
+		}
+		if i == max_chunks {
+			return nil, optionsErrorf("a message can be split over at most %d images", max_chunks)
+		}
+		n := Capacity(img, opts) - chunk_header_len
+		if n <= 0 {
+			return nil, fmt.Errorf("image %d: %w", i, &CapacityError{Payload: chunk_header_len + 1, Capacity: max(n+chunk_header_len, 0)})
+		}
+		sizes = append(sizes, min(n, len(data)-room))
+		room += n
+	}
+	if room < len(data) {
+		return nil, &CapacityError{Payload: len(data), Capacity: room}
+	}
+
+	outs := make([]image.Image, len(sizes))
+	c.count = uint8(len(sizes))
+	for i, n := range sizes {
+		c.index = uint8(i)
+		out, err := Encode(imgs[i], append(c.bytes(), data[:n]...), opts)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		outs[i] = out
+		data = data[n:]
+	}
+
+	return outs, nil
+}
+
+// DecodeJoin recovers a message hidden by EncodeSplit from the stego images
+// holding its parts, given in any order.  It returns an error wrapping
+// ErrChunkMissing if one of the parts is not among them, and one wrapping
+// ErrNotSplit if an image holds something else.
+func DecodeJoin(imgs []image.Image, opts Options) ([]byte, error) {
+	var first chunkHeader
+	var parts [][]byte
+	for i, img := range imgs {
+		msg, err := Decode(img, opts)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		c, data, ok := parseChunk(msg)
+		if parts == nil && ok {
+			first, parts = c, make([][]byte, c.count)
+		}
+		if !ok || c.flags != first.flags || c.count != first.count || c.length != first.length || c.crc != first.crc {
+			return nil, fmt.Errorf("image %d: %w", i, ErrNotSplit)
+		}
+		if parts[c.index] != nil && !bytes.Equal(parts[c.index], data) {
+			return nil, fmt.Errorf("image %d: %w (a second, different, part %d)", i, ErrNotSplit, c.index+1)
+		}
+		parts[c.index] = data
+	}
+	if parts == nil {
+		return nil, fmt.Errorf("%w: no images given", ErrChunkMissing)
+	}
+
+	var joined []byte
+	for i, part := range parts {
+		if part == nil {
+			return nil, fmt.Errorf("%w: part %d of %d", ErrChunkMissing, i+1, len(parts))
+		}
+		joined = append(joined, part...)
+	}
+	if len(joined) != int(first.length) {
+		return nil, ErrChecksumMismatch
+	}
+	if first.flags&chunk_compressed != 0 {
+		var err error
+		if joined, err = decompress(joined); err != nil {
+			return nil, err
+		}
+	}
+	if crc32.ChecksumIEEE(joined) != first.crc {
+		return nil, ErrChecksumMismatch
+	}
+
+	return joined, nil
+}
+
+// EncodeFrames hides msg over the frames of an animation, as EncodeSplit does,
+// filling each in turn, for a message too big for one frame.  It returns every
+// frame, those the message did not need as they were, so the animation keeps
+// its length; DecodeFrames recovers the message from them.
+func EncodeFrames(frames []image.Image, msg []byte, opts Options) ([]image.Image, error) {
+	outs, err := EncodeSplit(frames, msg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return append(outs, frames[len(outs):]...), nil
+}
+
+// DecodeFrames recovers a message hidden by EncodeFrames from the frames of
+// the animation, as DecodeJoin does, skipping any frames without a part of
+// it.
+func DecodeFrames(frames []image.Image, opts Options) ([]byte, error) {
+	var parts []image.Image
+	for _, frame := range frames {
+		if _, err := ReadSlotHeader(frame, opts); errors.Is(err, ErrNotStego) {
+			continue
+		}
+		parts = append(parts, frame)
+	}
+	return DecodeJoin(parts, opts)
+}
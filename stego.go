@@ -0,0 +1,1570 @@
+// STEGO8 - store 8 bits in each colour byte!
+
+// Package stego hides arbitrary binary content in the colour information of
+// an image, and recovers it again.
+package stego
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Default number of message bytes handed over at a time, on encode and decode
+const default_buffer_len = 32 << 10
+
+// bitReader hands out the bits of a message a few at a time, most significant
+// bits first, starting from bit pos.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// nextByte returns the next whole byte of the message.  ok is false when the
+// message has been used up.
+func (br *bitReader) nextByte() (b byte, ok bool) {
+	v, ok := br.next(8)
+	return byte(v), ok
+}
+
+// next returns the next bits bits of the message (up to 8), with zeros for any
+// past its end.  ok is false when the message has been used up.
+func (br *bitReader) next(bits int) (v uint32, ok bool) {
+	i := br.pos / 8
+	if i >= len(br.data) {
+		return 0, false
+	}
+	shift := 8 - br.pos%8 - bits
+	br.pos += bits
+	if shift >= 0 {
+		return uint32(br.data[i]>>shift) & ^bitsMask(bits), true
+	}
+
+	// The bits straddle a byte boundary, when channels hold different numbers
+	v = uint32(br.data[i]) << -shift
+	if i+1 < len(br.data) {
+		v |= uint32(br.data[i+1]) >> (8 + shift)
+	}
+	return v & ^bitsMask(bits), true
+}
+
+// bitWriter builds message bytes up from the bits recovered from each colour value.
+type bitWriter struct {
+	cur  uint32
+	have int
+}
+
+// add appends bits bits (up to 8) to the current byte, and returns the byte once
+// it is complete, keeping any bits past it for the next.
+func (bw *bitWriter) add(v uint32, bits int) (b uint32, done bool) {
+	bw.cur = bw.cur<<bits | v
+	bw.have += bits
+	if bw.have < 8 {
+		return 0, false
+	}
+	bw.have -= 8
+	b = bw.cur >> bw.have & 255
+	bw.cur &= ^bitsMask(bw.have)
+	return b, true
+}
+
+// ------------------------------------------------------------------------
+// Ideas
+// + Common up the image-reading code (same in both cases)
+// + Can we increase the amount of data hidden - store 4 bits instead of 2 per colour byte? - yes ** stego4.go ** AND stego8.go!!
+// + Calculate how much data can be stored in the image ahead of time (allowing for the header)
+// + How about storing the size of the hidden data in the first few image bytes, so we don't have to use an end-marker (0) and we can then hide
+//     arbitrary data, and not just ascii text.  Use first byte and use all 4 RGBA colours (can store up to 2GB length)
+// + Use a reader for binary input?  Is that more memory efficient than using ioutil.ReadFile?
+// + Find out how to get filesize when using a reader (eg for binary file)
+// + Write binary output file on decode - don't assume it's ascii text
+// + Make this into a library for re-use
+// + Store fewer bits per colour value (1, 2, 4 or 8) so the image is less visibly altered
+// + Encrypt the hidden data with a password
+// + Compress the hidden data so more fits
+// + Checksum the hidden data so a damaged image is noticed
+// + Option to spread 4 * 8 bits over the 4 RGBA values - ie. 2 bits of each data byte in R, G, B & A, positionally (ie. instead of 1 value per RGBA value)
+// + Option to leave alpha alone, so the data survives alpha being flattened
+// + Scatter the data over the image in a password-seeded order, rather than from the top left
+// + Keep an 8 bit image at 8 bits per colour value, rather than doubling its size
+// + Authenticate the hidden data with a keyed HMAC, so tampering is noticed
+// + Choose which bit plane carries the data, not just how many bits
+// + Hide several messages in one image, in separate slots
+// + Keep the colour profile (gamma, sRGB, ICC) of the original PNG
+// + Hide the data in the luminance of a grayscale image, and keep it grayscale
+// + A stealth mode: just 1 bit of blue per pixel, scattered
+// + Leave the alpha of nearly transparent pixels alone
+// + Pad the hidden data with random bytes to a fixed size, so its length does not show
+// + Hide the data in every Nth pixel, to spread a short message over the image
+// + Hide the data in just a rectangle of the image, away from flat areas
+// + Split data too big for one image over several, and join it up again
+// + Matrix (Hamming) embedding, changing at most one of every 2^k-1 low bits to hide k bits
+// + Report the PSNR of the stego image against the original, to measure the distortion
+// + Score how detectable the stego image is with the chi-square attack on its low bits
+// + Write a fully opaque image, with the data kept out of alpha
+// + Refuse images over a size limit, for use in a server
+// + XOR the payload with a repeating key, as light obfuscation
+// + Hide a message behind a decoy with a password of its own, deniably
+// + Print the version, and the format version written
+// + Show the pixels that differ between two images
+// + Hide several files as one message, with a manifest of their names
+// + Reproducible output, from a seeded source of random bytes
+// + Read and write image and message files in one call, in package stegofile
+// + Interleave the message over the colour values of each row
+// + Record when the message was hidden, and a comment, in the header
+// + LSB matching: change a value by 1 either way rather than set its low bit
+// + Generate a noise cover image just big enough for the message
+// + Choose the bits of each channel separately, eg. more in blue
+// + List the files hidden together without extracting them, like tar -t
+// + Add Reed-Solomon error correction, so a few damaged pixels do not lose the message
+// + Spread a message over the frames of an animated GIF or PNG
+// + Strict decoding, writing nothing that has not been checked
+// ------------------------------------------------------------------------
+
+// Options control how a message is hidden in, and recovered from, an image.
+// The zero value hides the message in order, unencrypted, in a byte of each of
+// the R, G, B and A values of every pixel.
+type Options struct {
+	// Bits is the number of low bits of each colour value used to carry the
+	// message, and must be 1, 2, 4 or 8, or 0 for the default of 8 (4 with
+	// KeepDepth on an 8 bit image).  Fewer bits alter the image less, at the
+	// cost of capacity.  Decode reads it from the header and ignores it.  It
+	// is also ignored in spread mode, which always uses 2 bits.
+	Bits int
+
+	// ChannelBits, if not all 0, is the number of low bits of each of the R,
+	// G, B and A values (in that order) used to carry the message instead of
+	// Bits, each 0, 1, 2, 4 or 8, so that more can go in blue, to which the eye
+	// is least sensitive, than in red and green.  The values with 0 are left
+	// alone, so it also chooses the channels: Channels must be empty or
+	// ChannelsRGBA, and Bits 0.  It is sequential mode only, and cannot be
+	// combined with Matrix, Match or Interleave.  Decode reads it from the
+	// header.
+	ChannelBits [4]int
+
+	// Plane is the lowest bit of each colour value that carries the message
+	// (0, the least significant bit, by default), so that bits above the
+	// lowest can be used instead.  Plane+Bits must be at most 8.  It cannot be
+	// used in spread mode.  Decode reads it from the header.
+	Plane int
+
+	// Mode is ModeSequential (the default if empty) or ModeSpread.  Spreading
+	// each byte over a whole pixel alters each colour value less than storing
+	// 8 bits of it in one value.  Decode reads it from the header.
+	Mode string
+
+	// Channels is ChannelsRGBA (the default if empty) or ChannelsRGB, which
+	// leaves alpha untouched so the message survives alpha being flattened or
+	// premultiplied, at the cost of a quarter of the capacity, or ChannelsBlue,
+	// which alters only blue, at the cost of three quarters.  Decode reads it
+	// from the header.  It is ignored for a grayscale image, whose single
+	// luminance value per pixel carries the message, and which stays grayscale.
+	Channels string
+
+	// Password, if set, encrypts the message with AES-256-GCM under a key
+	// derived from it.  Decode needs the same password to recover the message.
+	Password string
+
+	// HMACKey, if set, stores an HMAC-SHA256 tag of the hidden message in the
+	// header, so that Decode (given the same key) can tell whether the image
+	// has been modified.  Unlike the checksum, the tag cannot be recomputed
+	// without the key.  It can be used with or without Password.
+	HMACKey string
+
+	// XORKey, if set, XORs the hidden payload (after any compression and
+	// encryption) with the key, repeated, so the message cannot be read
+	// straight from the low bits.  This is obfuscation, not encryption: use
+	// Password to keep a message secret.  Decode needs the same key.
+	XORKey string
+
+	// Compress gzips the message before it is hidden (and before encryption),
+	// so that compressible data takes up less of the image.
+	Compress bool
+
+	// KeepDepth keeps an image with 8 bits per colour value at 8 bits, rather
+	// than writing it out with 16, so the output matches the input.  The
+	// message then goes in the low Bits (1, 2 or 4) of each 8 bit value.  An
+	// image with 16 bits per colour value is unaffected.  Decode reads it from
+	// the header.  The output image is an NRGBA (or Gray) rather than an
+	// NRGBA64 (or Gray16), which halves the memory it takes; without KeepDepth
+	// the message is in the low 8 bits of 16 bit values, so needs the 16.
+	KeepDepth bool
+
+	// Scatter hides the message in the pixels following the header in an
+	// order shuffled by a generator seeded from Password (which must be set),
+	// rather than in order from the top left, so it cannot be read back, or
+	// even found, without the password.  Decode reads it from the header.
+	Scatter bool
+
+	// Slots divides the image into that many equal parts (up to 255), each
+	// with its own header and message, and Slot chooses the part (from 0) to
+	// hide the message in or recover it from.  Encoding into one slot copies
+	// the others unchanged, so several messages, each with its own password,
+	// can be hidden in one image by encoding it once per slot.  Decode needs
+	// the same Slots and Slot.  0 Slots means the whole image is one slot.
+	Slots int
+	Slot  int
+
+	// MinAlpha, if set (up to 255), leaves alone the alpha of pixels whose alpha
+	// (out of 255) is below it, so that nearly transparent pixels stay that
+	// way; the message carries on in the next colour value instead.  It only
+	// applies when the message is hidden in alpha (ChannelsRGBA), and makes the
+	// capacity depend on the image.  Decode reads it from the header.
+	MinAlpha int
+
+	// Rect, if not empty, hides the message only in the pixels of that
+	// rectangle (relative to the top left of the image, and up to 65535
+	// pixels in from it and across), such as a busy part of the picture
+	// where the change is least visible, rather than from the top.  The
+	// header still goes in the first pixels, and the rectangle must not
+	// overlap it.  The capacity is that of the rectangle.  It cannot be
+	// combined with Scatter or Stride.  Decode reads it from the header.
+	Rect image.Rectangle
+
+	// Stride, if more than 1, hides the message in every Stride'th pixel
+	// (up to 65535) following the header, rather than in each in turn, so a
+	// small message is spread evenly over the image instead of filling a
+	// block at the top.  The capacity is divided by Stride.  It is a simpler,
+	// deterministic alternative to Scatter, and cannot be combined with it.
+	// Decode reads it from the header.
+	Stride int
+
+	// Matrix, if set (2 to 8), matrix embeds the message: Matrix bits of it
+	// are hidden in each group of 2^Matrix-1 colour values by changing the
+	// low bit (at Plane) of at most one of them, rather than the low bit of
+	// about half of them.  Far fewer values are changed, which makes the
+	// message much harder to detect, at the cost of capacity: 2 bits per 3
+	// values, down to 8 bits per 255.  Bits must be 1 or 0.  It cannot be used
+	// in spread mode.  Decode reads it from the header.
+	Matrix int
+
+	// Interleave fills each row of the image a colour value at a time: the
+	// first bits of the message go in the red value of each pixel of the row
+	// in turn, then the green, and so on, before the next row, rather than
+	// in all the values of each pixel in turn.  A short message then changes
+	// red across a whole row, rather than every value of a few pixels.  It is
+	// sequential mode only, and cannot be combined with Matrix, MinAlpha,
+	// Scatter, Stride or Rect.  Decode reads it from the header.
+	Interleave bool
+
+	// Match changes each colour value whose low bit must change by adding or
+	// subtracting 1 at random (within the range of the value), rather than by
+	// setting the bit, which is LSB matching rather than replacement.  It
+	// leaves none of the pairing of values the chi-square attack finds, so the
+	// message is harder to detect.  Bits must be 1 or 0, and it cannot be used
+	// in spread mode or with MinAlpha.  It is recorded in the header, so a
+	// message added to by the append command is hidden the same way again;
+	// Decode reads the bits as usual, so needs nothing for it.
+	Match bool
+
+	// Opaque sets the alpha of every pixel of the output image to fully
+	// opaque, rather than copying it from img, for tools and pipelines that
+	// strip alpha or demand an opaque image.  The message goes in R, G and B
+	// (ChannelsRGB, if Channels is empty) or in blue, never in alpha, and the
+	// header records that so Decode never reads alpha.  The colours of any
+	// transparent pixels of img become visible.
+	Opaque bool
+
+	// Pad, if set, fills out the payload (after any compression and
+	// encryption) with random bytes to Pad bytes, so that messages of
+	// different lengths alter the same number of pixels.  The true length is
+	// stored in the header, and Decode strips the padding.
+	Pad int
+
+	// ECC, if set (2 to 254), adds that many Reed-Solomon parity bytes to
+	// every 255-ECC bytes of the payload (after any compression and
+	// encryption), so Decode can put right up to ECC/2 bytes damaged in any
+	// 255 of them, such as by a few edited pixels.  The payload grows by about
+	// ECC/(255-ECC), which Capacity allows for.  The header itself is not
+	// protected, and it cannot be combined with HMACKey, which fails on any
+	// damage.  Decode reads it from the header.
+	ECC int
+
+	// Filename, if set, is stored in the header alongside the message, so the
+	// file can be recreated under its original name.  It is stored in the
+	// clear, even if the message is encrypted, and may be up to 255 bytes.
+	Filename string
+
+	// Time, if not zero, is stored in the header (to the second) as the time
+	// the message was hidden, and Comment, if set, alongside it, as free text
+	// of up to 255 bytes, to record where an image came from.  Both are
+	// stored in the clear, even if the message is encrypted, and ReadHeader
+	// returns them.
+	Time    time.Time
+	Comment string
+
+	// MaxPixels, if set, is the most pixels an image may have: Encode and
+	// Decode return ErrCarrierTooLarge for a larger one before allocating
+	// anything for it, so a service can refuse huge images.  (An image file
+	// that decodes to a huge image should be refused before decoding it, by
+	// checking the size from image.DecodeConfig.)
+	MaxPixels int
+
+	// Strict makes Decode refuse a message it cannot vouch for exactly as it
+	// was hidden: the whole message is recovered and checked against its
+	// checksum before any of it is written, even by DecodeTo, and one hidden
+	// with ECC returns ErrDamaged if any of it had to be corrected.  The pixels
+	// past the message keep the carrier's own bits, so there is nothing to
+	// check them against.
+	Strict bool
+
+	// BufferSize is the number of message bytes handed from the reader to the
+	// pixel loop at a time on encode, and written out at a time on decode.
+	// 0 (or less) means 32 KiB, which suits large messages; a smaller buffer
+	// saves memory.
+	BufferSize int
+
+	// Rand, if set, is read for the random bytes Encode needs instead of
+	// crypto/rand: those of any Pad, and the salt and nonce of encryption,
+	// which also decide the Scatter order.  A reader giving the same bytes
+	// every time, such as a generator with a fixed seed, makes the output the
+	// same for the same carrier, message and options, for reproducible builds
+	// and tests.  Encrypting different messages with the same password and
+	// nonce gives away how they differ, so keep to crypto/rand for secrets.
+	Rand io.Reader
+
+	// Progress, if set, is called as the message is hidden or recovered, with
+	// the number of bytes done so far out of the total (both counting the
+	// message as hidden, after any compression, encryption and matrix
+	// embedding).  It is called about once a row of the image, never
+	// concurrently, and lastly with done equal to total.
+	Progress func(done, total int)
+
+	// files is set by EncodeFiles, to record that the message is a set of files
+	files bool
+}
+
+// random returns the source of the random bytes Encode needs.
+func (o Options) random() io.Reader {
+	if o.Rand != nil {
+		return o.Rand
+	}
+	return rand.Reader
+}
+
+// bufferLen returns the number of message bytes to hand over at a time.
+func (o Options) bufferLen() int {
+	if o.BufferSize <= 0 {
+		return default_buffer_len
+	}
+	return o.BufferSize
+}
+
+// checkECC returns an error if o ask for error correction that cannot be given.
+func (o Options) checkECC() error {
+	if o.ECC == 0 {
+		return nil
+	}
+	if !validECC(o.ECC) {
+		return optionsErrorf("invalid error correction %d (want %d to %d parity bytes per block)", o.ECC, min_ecc, max_ecc)
+	}
+	if o.HMACKey != "" {
+		return optionsErrorf("error correction cannot be combined with an HMAC key, which fails on any damage")
+	}
+	return nil
+}
+
+// checkSize returns ErrCarrierTooLarge if img has more pixels than o allows.
+func (o Options) checkSize(img image.Image) error {
+	bounds := img.Bounds()
+	if n := int64(bounds.Dx()) * int64(bounds.Dy()); o.MaxPixels > 0 && n > int64(o.MaxPixels) {
+		return fmt.Errorf("%w: %dx%d image has %d pixels, more than the %d allowed", ErrCarrierTooLarge, bounds.Dx(), bounds.Dy(), n, o.MaxPixels)
+	}
+	return nil
+}
+
+// StealthOptions returns the least perceptible options: 1 bit of the blue value
+// of each pixel, to which the eye is least sensitive, in an order scattered by
+// password (which also encrypts the message).  An image holds only about a
+// byte per 8 pixels this way.
+func StealthOptions(password string) Options {
+	return Options{Bits: 1, Channels: ChannelsBlue, Password: password, Scatter: true}
+}
+
+// Capacity returns the number of message bytes that can be hidden in img with
+// opts, after allowing for the header (including any opts.Filename), the
+// encryption overhead if opts.Password is set, and the parity bytes of any
+// opts.ECC.  It returns 0 if opts are invalid.  Compression is not allowed for,
+// since it depends on the message.
+func Capacity(img image.Image, opts Options) int {
+	c, overhead := payloadCapacity(img, opts)
+	if opts.ECC != 0 && c > 0 {
+		c = eccCapacity(c, opts.ECC)
+	}
+	return max(c-overhead, 0)
+}
+
+// payloadCapacity returns the number of payload bytes (after any compression,
+// encryption and error correction) that can be hidden in img with opts after
+// the header, or -1 if the header does not fit or opts are invalid, and the
+// number of bytes encryption adds to the message.
+func payloadCapacity(img image.Image, opts Options) (int, int) {
+	overhead := 0
+	if opts.Password != "" {
+		overhead = gcm_tag_len
+	}
+	l, err := opts.layout(img)
+	if err != nil {
+		return -1, overhead
+	}
+	if opts.checkECC() != nil {
+		return -1, overhead
+	}
+	rg, err := opts.region(img)
+	if err != nil {
+		return -1, overhead
+	}
+
+	h := newHeader(l)
+	setSlot(&h, opts)
+	setExtFlags(&h, opts)
+	if opts.Filename != "" {
+		h.Flags |= FlagFilename
+		h.Filename = opts.Filename
+	}
+	if opts.HMACKey != "" {
+		h.Flags |= FlagHMAC
+	}
+	if opts.Password != "" {
+		h.Flags |= FlagEncrypted
+	}
+	if bodyRegion(rg, l, h.size()).start > rg.end {
+		return -1, overhead
+	}
+
+	return capacityIn(img, rg, l, h.size()), overhead
+}
+
+// capacityIn returns the number of message bytes that fit in the pixels rg of
+// img with layout l, after a header of hdr_len bytes.
+func capacityIn(img image.Image, rg region, l layout, hdr_len int) int {
+	if l.minAlpha == 0 {
+		return capacity(rg, l, hdr_len)
+	}
+
+	body := bodyRegion(rg, l, hdr_len)
+	offsets := bitOffsets(img, body, l, l.order(img.Bounds(), body))
+	return l.matrixCapacity(offsets[len(offsets)-1] / 8)
+}
+
+// bitOffsets returns the position in the message (in bits) of the part each
+// message pixel of body holds, when the pixels hold different numbers of bits,
+// followed by the total number of bits those that can carry the message hold.
+// If order is not nil the message is scattered, or strided, with part j in
+// message pixel order[j].
+func bitOffsets(img image.Image, body region, l layout, order []uint32) []int {
+	bounds := img.Bounds()
+	offsets := make([]int, max(body.pixels(), 0)+1)
+	usable := l.messagePixels(body.pixels())
+	pos := 0
+	for j := range body.pixels() {
+		p := j
+		if order != nil {
+			p = int(order[j])
+		}
+		offsets[p] = pos
+		pos += l.bitsIn(l.view(colourAt(img, pixelPoint(bounds, body.start+p))))
+		if j == usable-1 {
+			offsets[len(offsets)-1] = pos
+		}
+	}
+
+	return offsets
+}
+
+// capacity returns the number of message bytes that fit in the pixels rg with
+// layout l, after a header of hdr_len bytes.  Where pixels hold different
+// numbers of bits, this is the most that could fit.
+func capacity(rg region, l layout, hdr_len int) int {
+	pixels := bodyRegion(rg, l, hdr_len).pixels()
+	if pixels <= 0 {
+		return 0
+	}
+
+	return l.matrixCapacity(l.capacity(l.messagePixels(pixels)))
+}
+
+// bodyRegion returns the pixels of rg that follow a header of hdr_len bytes
+// stored with layout l.
+func bodyRegion(rg region, l layout, hdr_len int) region {
+	return region{start: rg.start + l.headerPixels(hdr_len), end: rg.end}
+}
+
+// setSlot records the slot chosen in opts in h, if the image is divided.
+func setSlot(h *Header, opts Options) {
+	if slot, slots, _ := opts.slots(); slots > 1 {
+		h.Flags |= FlagSlot
+		h.Slot, h.Slots = uint8(slot), uint8(slots)
+	}
+}
+
+// setExtFlags records in h that the payload is XORed with a key, if opts give
+// one, that the message is a set of files, if it is, any error correction, and
+// any time and comment.
+func setExtFlags(h *Header, opts Options) {
+	if opts.XORKey != "" {
+		h.ExtFlags |= ExtFlagXOR
+	}
+	if opts.files {
+		h.ExtFlags |= ExtFlagFiles
+	}
+	if opts.ECC != 0 {
+		h.ExtFlags |= ExtFlagECC
+		h.ECC = uint8(opts.ECC)
+	}
+	if !opts.Time.IsZero() || opts.Comment != "" {
+		h.ExtFlags |= ExtFlagMeta
+		h.Comment = opts.Comment
+		if !opts.Time.IsZero() {
+			h.Time = uint64(opts.Time.Unix())
+		}
+	}
+	if h.ExtFlags != 0 {
+		h.Version = header_version_ext
+	}
+}
+
+// pixelPoint returns the coordinates of the i'th pixel of bounds, counting
+// along each row in turn.
+func pixelPoint(bounds image.Rectangle, i int) image.Point {
+	return image.Pt(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx())
+}
+
+// Encode hides msg in the colour information of img and returns the resulting
+// image.  A header holding the length of msg and the settings needed to recover
+// it is stored in the first pixels, and the message itself in the pixels that
+// follow.  A paletted image is converted to full colour, since changing the low
+// bits of its palette indices would pick unrelated colours.
+//
+// The pixels are counted from the top left of img's bounds, which need not be
+// at (0, 0), so a sub-image can be used as the carrier and the output moved or
+// saved without losing the message.  The output has the bounds of img.  It is
+// a new image: img itself is never modified, so it can be reused.
+func Encode(img image.Image, msg []byte, opts Options) (image.Image, error) {
+	return encodeFrom(context.Background(), img, bytes.NewReader(msg), len(msg), opts)
+}
+
+// EncodeContext is like Encode, but gives up and returns ctx.Err() if ctx is
+// cancelled before the image is complete.
+func EncodeContext(ctx context.Context, img image.Image, msg []byte, opts Options) (image.Image, error) {
+	return encodeFrom(ctx, img, bytes.NewReader(msg), len(msg), opts)
+}
+
+// EncodeFrom is like Encode, but hides the length bytes read from r, so the
+// message can come from a pipe or network connection rather than memory.  A
+// plain message is hidden as it is read; a compressed or encrypted one has to
+// be read in full first.  It returns io.ErrUnexpectedEOF if r holds fewer than
+// length bytes.
+func EncodeFrom(img image.Image, r io.Reader, length int, opts Options) (image.Image, error) {
+	return encodeFrom(context.Background(), img, r, length, opts)
+}
+
+// encodeFrom hides the length bytes read from r in img, stopping early if ctx
+// is cancelled.
+func encodeFrom(ctx context.Context, img image.Image, r io.Reader, length int, opts Options) (image.Image, error) {
+	if err := opts.checkSize(img); err != nil {
+		return nil, err
+	}
+	l, err := opts.layout(img)
+	if err != nil {
+		return nil, err
+	}
+
+	rg, err := opts.region(img)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := preparePayload(r, length, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return embed(ctx, img, l, rg, p, opts)
+}
+
+// payload is a message ready to be hidden, after any compression and
+// encryption.
+type payload struct {
+	h      Header    // the flags and fields that describe the message itself
+	r      io.Reader // the payload, if it is to be read as it is hidden
+	data   []byte    // otherwise the payload itself
+	length int
+	k      keys
+	summed bool // h.CRC is already set
+}
+
+// reader returns the payload to hide.
+func (p payload) reader() io.Reader {
+	if p.data != nil {
+		return bytes.NewReader(p.data)
+	}
+	return p.r
+}
+
+// preparePayload checks opts and the message, and compresses, encrypts and
+// adds error correction to the length bytes read from r, if opts ask for that.
+// A plain message is left to be read as it is hidden.
+func preparePayload(r io.Reader, length int, opts Options) (payload, error) {
+	var p payload
+	if opts.Scatter && opts.Password == "" {
+		return p, optionsErrorf("scatter needs a password")
+	}
+	if length < 0 || int64(length) > math.MaxUint32 {
+		return p, optionsErrorf("invalid message length %d", length)
+	}
+	if opts.Pad < 0 || int64(opts.Pad) > math.MaxUint32 {
+		return p, optionsErrorf("invalid padded length %d", opts.Pad)
+	}
+
+	if opts.Filename != "" {
+		if len(opts.Filename) > max_filename_len {
+			return p, optionsErrorf("file name is longer than %d bytes", max_filename_len)
+		}
+		p.h.Flags |= FlagFilename
+		p.h.Filename = opts.Filename
+	}
+	if len(opts.Comment) > max_comment_len {
+		return p, optionsErrorf("comment is longer than %d bytes", max_comment_len)
+	}
+	if !opts.Time.IsZero() && opts.Time.Unix() <= 0 {
+		return p, optionsErrorf("time %v is not after 1970", opts.Time)
+	}
+	if err := opts.checkECC(); err != nil {
+		return p, err
+	}
+
+	// Compression, encryption and error correction need the whole message
+	p.r, p.length = r, length
+	if !opts.Compress && opts.Password == "" && opts.ECC == 0 {
+		return p, nil
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return p, readError(err)
+	}
+
+	p.h.CRC = crc32.ChecksumIEEE(msg)
+	p.summed = true
+	if opts.Compress {
+		packed, err := compress(msg)
+		if err != nil {
+			return p, err
+		}
+		p.h.Flags |= FlagCompressed
+		msg = packed
+	}
+	if opts.Password != "" {
+		sealed, derived, err := encrypt(&p.h, msg, opts.Password, opts.random())
+		if err != nil {
+			return p, err
+		}
+		msg, p.k = sealed, derived
+	}
+	if opts.ECC != 0 {
+		if int64(eccLen(len(msg), opts.ECC)) > math.MaxUint32 {
+			return p, optionsErrorf("message of %d bytes is too long with error correction", length)
+		}
+		msg = eccEncode(msg, opts.ECC)
+	}
+	p.r, p.data, p.length = nil, msg, len(msg)
+
+	return p, nil
+}
+
+// embed hides the payload p in the pixels rg of img with layout l, stopping
+// early if ctx is cancelled.
+func embed(ctx context.Context, img image.Image, l layout, rg region, p payload, opts Options) (image.Image, error) {
+	h := newHeader(l)
+	h.Flags |= p.h.Flags
+	setExtFlags(&h, opts)
+	h.CRC, h.Salt, h.Nonce, h.Filename = p.h.CRC, p.h.Salt, p.h.Nonce, p.h.Filename
+	r, length, k := p.reader(), p.length, p.k
+
+	if opts.Scatter {
+		h.Flags |= FlagScatter
+	}
+	if opts.HMACKey != "" {
+		h.Flags |= FlagHMAC
+	}
+	setSlot(&h, opts)
+	h.PayloadLen = uint32(length)
+	if opts.Pad != 0 {
+		if opts.Pad < length {
+			return nil, optionsErrorf("payload of %d bytes is longer than the padded length %d", length, opts.Pad)
+		}
+		h.Flags |= FlagPadded
+		h.PaddedLen = uint32(opts.Pad)
+	}
+	if err := l.seedMatch(opts.random()); err != nil {
+		return nil, err
+	}
+	total := h.embeddedLen()
+	stored := l.storedLen(total)
+	body := bodyRegion(rg, l, h.size())
+	if l.interleave {
+		stored = l.interleavedLen(total, img.Bounds().Dx(), body)
+	}
+	if !l.checkRect(img.Bounds(), body) {
+		return nil, optionsErrorf("rectangle %v overlaps the header in the first %d pixels, or is outside the slot", l.rect, body.start-rg.start)
+	}
+
+	// Check the size of the image to work out how many bytes we can hide
+	if body.start > rg.end {
+		return nil, fmt.Errorf("%w: the header needs %d pixels, more than the %d there are", ErrInsufficientCapacity, body.start-rg.start, rg.pixels())
+	}
+	if c := capacityIn(img, rg, l, h.size()); c < total {
+		return nil, &CapacityError{Payload: total, Capacity: c}
+	}
+
+	// Get the bounds of the image
+	bounds := img.Bounds()
+
+	// Work out which part of the message each message pixel holds, and where it
+	// starts if pixels hold different numbers of bits
+	var slots []uint32
+	order := h.pixelOrder(bounds, body, k)
+	if order != nil {
+		slots = scatterSlots(order)
+	}
+	var offsets []int
+	if l.minAlpha != 0 {
+		offsets = bitOffsets(img, body, l, order)
+	}
+
+	// Create output image, at 8 bits per colour value if the message is hidden in
+	// those, and grayscale if the input is
+	output_image := newImage(bounds, l)
+
+	// Pass the message over in chunks of up to buffer_len bytes, a few chunks
+	// ahead of the pixel loop, rather than synchronising on every byte.  A plain
+	// message is checksummed, and the message as hidden is tagged, on the way
+	// through; any padding that follows it is not.  On cancellation the reader
+	// stops at its next chunk; it cannot interrupt a Read that is blocked.
+	sum := crc32.NewIEEE()
+	mac := newMAC(opts.HMACKey)
+	var rerr error
+	fb := make(chan []byte, 4)
+	buffer_len := opts.bufferLen()
+	go func() {
+		defer close(fb)
+		for done := 0; done < total; {
+			src, data := r, make([]byte, min(buffer_len, total-done))
+			if done < length {
+				data = data[:min(len(data), length-done)]
+			} else {
+				src = opts.random()
+			}
+			n, err := io.ReadFull(src, data)
+			if done < length {
+				sum.Write(data[:n])
+				if opts.XORKey != "" {
+					xorBytes(data[:n], opts.XORKey, done)
+				}
+				mac.Write(data[:n])
+			}
+			if n > 0 {
+				select {
+				case fb <- data[:n]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				rerr = readError(err)
+				return
+			}
+			done += n
+		}
+	}()
+
+	// A matrix embedded or interleaved message needs the cover bits it goes in,
+	// and the whole message, before the bits to store can be worked out
+	hidden := (<-chan []byte)(fb)
+	if l.matrix != 0 || l.interleave {
+		var cover bytes.Buffer
+		if err := streamBits(ctx, img, l, stored, body, order, &cover, buffer_len, nil); err != nil {
+			return nil, err
+		}
+		mb := make(chan []byte, 1)
+		go func() {
+			defer close(mb)
+			msg := make([]byte, 0, total)
+			for chunk := range fb {
+				msg = append(msg, chunk...)
+			}
+			var bits []byte
+			if l.interleave {
+				bits = l.interleaveMessage(cover.Bytes(), msg, bounds.Dx(), body)
+			} else {
+				bits = matrixEmbed(cover.Bytes(), msg, l.matrix)
+			}
+			select {
+			case mb <- bits:
+			case <-ctx.Done():
+			}
+		}()
+		hidden = mb
+	}
+
+	prog := newProgress(opts.Progress, stored, l.pixelBits())
+	if err := encodePixels(ctx, img, output_image, body, l, stored, slots, offsets, hidden, prog); err != nil {
+		// The reader may still be running, so leave rerr alone
+		return nil, err
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	// The header goes in last, once the checksum of a plain message and the tag
+	// are known
+	if !p.summed {
+		h.CRC = sum.Sum32()
+	}
+	if opts.HMACKey != "" {
+		copy(h.Tag[:], mac.Sum(nil))
+	}
+	storeHeader(output_image, l, h.bytes(), rg.start)
+	prog.setDone(stored)
+
+	return output_image, nil
+}
+
+// ErrInsufficientCapacity is matched by the *CapacityError Encode returns when
+// the message does not fit in the image, for callers that only need errors.Is.
+// It is returned wrapped when the image is too small even for the header.
+var ErrInsufficientCapacity = errors.New("message does not fit in the image")
+
+// ErrCarrierTooLarge is returned when an image has more pixels than
+// Options.MaxPixels allows.
+var ErrCarrierTooLarge = errors.New("image is too large")
+
+// CapacityError is returned by Encode when the message does not fit in the
+// image.
+type CapacityError struct {
+	Payload  int // bytes to hide, after any compression and encryption
+	Capacity int // bytes the image can hold with the options given
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("payload %d bytes exceeds capacity %d bytes by %d bytes", e.Payload, e.Capacity, e.Payload-e.Capacity)
+}
+
+// Is reports whether target is ErrInsufficientCapacity.
+func (e *CapacityError) Is(target error) bool {
+	return target == ErrInsufficientCapacity
+}
+
+// ErrInvalidOptions is matched by the errors returned when the options cannot
+// be used, such as an unknown mode or a slot out of range, or cannot be used
+// with the image or message given.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// optionsError describes options that cannot be used.
+type optionsError struct {
+	msg string
+}
+
+// optionsErrorf returns an error matching ErrInvalidOptions, formatted as by
+// fmt.Sprintf.
+func optionsErrorf(format string, args ...any) error {
+	return &optionsError{fmt.Sprintf(format, args...)}
+}
+
+func (e *optionsError) Error() string {
+	return e.msg
+}
+
+// Is reports whether target is ErrInvalidOptions.
+func (e *optionsError) Is(target error) bool {
+	return target == ErrInvalidOptions
+}
+
+// readError reports a message that ended early as io.ErrUnexpectedEOF.
+func readError(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// storeHeader stores hdr in the pixels of img from start, for a message with
+// layout l, using the header layout for l.
+func storeHeader(img draw.Image, l layout, hdr []byte, start int) {
+	hl := l.headerLayout()
+	bounds := img.Bounds()
+	br := &bitReader{data: hdr}
+	for pixel := start; pixel < start+l.headerPixels(len(hdr)); pixel++ {
+		p := pixelPoint(bounds, pixel)
+		setPixel(img, p.X, p.Y, hl, hl.encodePixel(br, hl.view(colourAt(img, p))))
+	}
+}
+
+// newImage returns the image to write the output with layout l into: an
+// *image.NRGBA64, or *image.NRGBA for an 8 bit layout, or their grayscale
+// equivalents for a grayscale one.
+func newImage(bounds image.Rectangle, l layout) draw.Image {
+	switch {
+	case l.gray && l.depth8:
+		return image.NewGray(bounds)
+	case l.gray:
+		return image.NewGray16(bounds)
+	case l.depth8:
+		return image.NewNRGBA(bounds)
+	}
+	return image.NewNRGBA64(bounds)
+}
+
+// setPixel stores the colour values c, as seen through layout l, in pixel (x, y)
+// of img, which was made by newImage for l.  A grayscale image takes only the
+// luminance, from c[0].
+func setPixel(img draw.Image, x, y int, l layout, c [4]uint32) {
+	switch {
+	case l.gray && l.depth8:
+		img.(*image.Gray).SetGray(x, y, color.Gray{uint8(c[0])})
+	case l.gray:
+		img.(*image.Gray16).SetGray16(x, y, color.Gray16{uint16(c[0])})
+	case l.depth8:
+		img.(*image.NRGBA).SetNRGBA(x, y, color.NRGBA{uint8(c[0]), uint8(c[1]), uint8(c[2]), uint8(c[3])})
+	default:
+		img.(*image.NRGBA64).SetNRGBA64(x, y, color.NRGBA64{uint16(c[0]), uint16(c[1]), uint16(c[2]), uint16(c[3])})
+	}
+}
+
+// encodePixels copies img into output_image, hiding the length bytes of message
+// arriving on fb in the pixels body as it goes.  The image is split into
+// horizontal bands which are encoded concurrently; each band starts as soon as
+// the part of the message it holds has arrived.  If slots is not nil the
+// message is scattered, with message pixel i holding part slots[i] of it, and
+// every band waits for the whole message.  If offsets is not nil, message pixel
+// i holds the bits of the message from offsets[i].  Progress is reported to
+// prog.  It returns ctx.Err() if ctx is cancelled first.
+func encodePixels(ctx context.Context, img image.Image, output_image draw.Image, body region, l layout, length int, slots []uint32, offsets []int, fb <-chan []byte, prog *progress) error {
+	bounds := img.Bounds()
+	pixel_bits := l.pixelBits()
+
+	bands := min(runtime.GOMAXPROCS(0), bounds.Dy())
+	band_rows := 0
+	if bands > 0 {
+		band_rows = (bounds.Dy() + bands - 1) / bands
+	}
+
+	msg := make([]byte, length)
+	filled := 0
+
+	var wg sync.WaitGroup
+	type band struct {
+		need  int // bytes of the message needed before the band can be encoded
+		ready chan struct{}
+	}
+	waiting := make([]band, 0, bands)
+
+	for y0 := bounds.Min.Y; y0 < bounds.Max.Y; y0 += band_rows {
+		y1 := min(y0+band_rows, bounds.Max.Y)
+
+		// Work out where in the message the band starts and ends, from the number of
+		// message pixels before it
+		first := min(max((y0-bounds.Min.Y)*bounds.Dx()-body.start, 0), body.pixels())
+		last := min(max((y1-bounds.Min.Y)*bounds.Dx()-body.start, 0), body.pixels())
+		start, end := first*pixel_bits, last*pixel_bits
+		if offsets != nil {
+			start, end = offsets[first], offsets[last]
+		}
+		b := band{
+			need:  min((end+7)/8, length),
+			ready: make(chan struct{}),
+		}
+		if slots != nil {
+			b.need = length
+		}
+		waiting = append(waiting, b)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-b.ready
+			br := &bitReader{data: msg[:b.need], pos: start}
+			encodeBand(ctx, img, output_image, body, l, br, slots, offsets, y0, y1, prog)
+		}()
+	}
+
+	// Gather the message as it arrives, letting each band go once it can
+	release := func() {
+		for len(waiting) > 0 && waiting[0].need <= filled {
+			close(waiting[0].ready)
+			waiting = waiting[1:]
+		}
+	}
+	release()
+gather:
+	for {
+		select {
+		case chunk, ok := <-fb:
+			if !ok {
+				break gather
+			}
+			filled += copy(msg[filled:], chunk)
+			release()
+		case <-ctx.Done():
+			break gather
+		}
+	}
+	for _, b := range waiting {
+		close(b.ready)
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// encodeBand encodes rows y0 to y1 of img into output_image, taking the message
+// bits for them from br (from wherever slots or offsets say, if given).
+// Only the pixels body carry the message; the rest, including the header
+// pixels, are copied unchanged.  The message pixels of each row are added to
+// prog.  It stops early if ctx is cancelled.
+func encodeBand(ctx context.Context, img image.Image, output_image draw.Image, body region, l layout, br *bitReader, slots []uint32, offsets []int, y0, y1 int, prog *progress) {
+	bounds := img.Bounds()
+	pixel := (y0 - bounds.Min.Y) * bounds.Dx()
+	msg_bits := len(br.data) * 8
+
+	// Loop over rows
+	for y := y0; y < y1; y++ {
+		if ctx.Err() != nil {
+			return
+		}
+		held := 0
+		match := l.matcher(y)
+
+		// Loop over cols
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Get the rgba values from the input image (all uint32)
+			c := l.view(colourAt(img, image.Pt(x, y)))
+
+			if pixel >= body.start && pixel < body.end {
+				// Message data to hide
+				switch {
+				case offsets != nil:
+					br.pos = offsets[pixel-body.start]
+				case slots != nil:
+					br.pos = int(slots[pixel-body.start]) * l.pixelBits()
+				}
+				if br.pos < msg_bits {
+					held++
+				}
+				enc := l.encodePixel(br, c)
+				if match != nil {
+					enc = l.matchValues(c, enc, match)
+				}
+				c = enc
+			}
+			if l.opaque {
+				c[3] = l.opaqueAlpha()
+			}
+			pixel++
+
+			// Store in the image
+			setPixel(output_image, x, y, l, c)
+		}
+		prog.addPixels(held)
+	}
+}
+
+// Detect reports whether img carries a stego payload, by reading only the header
+// from its first pixels, and returns the number of bytes hidden (after any
+// compression and encryption).  It returns ErrNotStego if there is no header,
+// and an error wrapping ErrUnsupportedFormat if the header comes from a version
+// of stego that cannot be read.
+func Detect(img image.Image) (int, error) {
+	return PayloadLength(img)
+}
+
+// PayloadLength returns the number of bytes hidden in img (after any
+// compression and encryption, not counting padding), reading only the header in
+// its first pixels, so a buffer can be allocated or the size shown before the
+// message is decoded.  For a plain message it is the length Decode returns.  It
+// returns ErrNotStego if there is no valid header.
+func PayloadLength(img image.Image) (int, error) {
+	h, err := ReadHeader(img)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(h.PayloadLen), nil
+}
+
+// PixelsUsed returns the number of pixels of img that carry the header and
+// message hidden in the slot chosen by opts, out of those Encode could have
+// altered.  opts.Password is needed if the message was scattered with
+// MinAlpha set.
+func PixelsUsed(img image.Image, opts Options) (int, error) {
+	h, rg, err := readSlotHeader(img, opts)
+	if err != nil {
+		return 0, err
+	}
+	l := h.layout()
+	body := bodyRegion(rg, l, h.size())
+	hdr_pixels := min(l.headerPixels(h.size()), rg.pixels())
+	bits := l.storedLen(h.embeddedLen()) * 8
+	if l.interleave {
+		bits = h.storedLen(img.Bounds().Dx(), body) * 8
+	}
+
+	if l.minAlpha == 0 {
+		return hdr_pixels + min((bits+l.pixelBits()-1)/l.pixelBits(), l.messagePixels(body.pixels())), nil
+	}
+
+	// Pixels hold different numbers of bits, so count those the message reaches
+	var k keys
+	if h.Flags&FlagScatter != 0 {
+		if opts.Password == "" {
+			return 0, ErrPasswordRequired
+		}
+		var err error
+		if k, err = deriveKeys(opts.Password, h.Salt[:]); err != nil {
+			return 0, err
+		}
+	}
+	used := 0
+	for _, offset := range bitOffsets(img, body, l, h.pixelOrder(img.Bounds(), body, k))[:body.pixels()] {
+		if offset < bits {
+			used++
+		}
+	}
+	return hdr_pixels + used, nil
+}
+
+// Filename returns the file name stored alongside the message hidden in img, or
+// "" if none was stored.
+func Filename(img image.Image) (string, error) {
+	h, err := ReadHeader(img)
+	if err != nil {
+		return "", err
+	}
+
+	return h.Filename, nil
+}
+
+// Decode extracts a message previously hidden in img by Encode.  opts.Password
+// must be set if the message was encrypted; the other settings are read from
+// the header.  The header is looked for at the top left of img's bounds, so a
+// part cropped from a stego image decodes only if it starts at the same pixel.
+func Decode(img image.Image, opts Options) ([]byte, error) {
+	return DecodeContext(context.Background(), img, opts)
+}
+
+// DecodeTo extracts the message hidden in img by Encode and writes it to w, as it
+// is recovered, so a large message need not be held in memory.  It returns the
+// number of bytes written, which on success is the length of the message as
+// given to Encode: for one neither compressed, encrypted nor error corrected,
+// PayloadLength.
+//
+// A plain message is streamed, and only checked against its checksum at the
+// end, so when ErrChecksumMismatch is returned the damaged message has already
+// been written.  An encrypted, compressed or error corrected message, or any
+// message with opts.Strict, is recovered in full and checked before anything
+// is written.
+func DecodeTo(img image.Image, w io.Writer, opts Options) (int, error) {
+	cw := &countingWriter{w: w}
+	err := decodeTo(context.Background(), img, cw, opts)
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// DecodeContext is like Decode, but gives up and returns ctx.Err() if ctx is
+// cancelled before the message has been recovered.
+func DecodeContext(ctx context.Context, img image.Image, opts Options) ([]byte, error) {
+	var out bytes.Buffer
+	if err := decodeTo(ctx, img, &out, opts); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// decodeTo extracts the hidden message from img and writes it to w, stopping
+// early if ctx is cancelled.
+func decodeTo(ctx context.Context, img image.Image, w io.Writer, opts Options) error {
+	if err := opts.checkSize(img); err != nil {
+		return err
+	}
+	h, rg, err := readSlotHeader(img, opts)
+	if err != nil {
+		return err
+	}
+	body := bodyRegion(rg, h.layout(), h.size())
+	prog := newProgress(opts.Progress, h.storedLen(img.Bounds().Dx(), body), h.layout().pixelBits())
+
+	var mac hash.Hash
+	if h.Flags&FlagHMAC != 0 {
+		if opts.HMACKey == "" {
+			return ErrAuthKeyRequired
+		}
+		mac = newMAC(opts.HMACKey)
+	}
+	xor := h.ExtFlags&ExtFlagXOR != 0
+	if xor && opts.XORKey == "" {
+		return ErrXORKeyRequired
+	}
+
+	ecc := h.ExtFlags&ExtFlagECC != 0
+	if h.Flags&(FlagEncrypted|FlagCompressed) == 0 && !ecc && !opts.Strict {
+		// Check the message as it goes past; it has already been written by the
+		// time a mismatch is noticed.  The tag is of the message as hidden.  A
+		// plain message is never scattered, so needs no keys for its order.
+		sum := crc32.NewIEEE()
+		var ws []io.Writer
+		if mac != nil {
+			ws = append(ws, mac)
+		}
+		if xor {
+			ws = append(ws, &xorWriter{w: io.MultiWriter(w, sum), key: opts.XORKey})
+		} else {
+			ws = append(ws, w, sum)
+		}
+		if err := streamMessage(ctx, img, h, body, h.pixelOrder(img.Bounds(), body, keys{}), io.MultiWriter(ws...), opts.bufferLen(), prog); err != nil {
+			return err
+		}
+		if mac != nil {
+			if err := checkMAC(h, mac); err != nil {
+				return err
+			}
+		}
+		if sum.Sum32() != h.CRC {
+			return ErrChecksumMismatch
+		}
+		return nil
+	}
+
+	// Encrypted, compressed or error corrected messages have to be recovered in
+	// full before they can be corrected, decrypted and inflated, and a strict
+	// decode checks the message before writing it
+	var k keys
+	if h.Flags&FlagEncrypted != 0 {
+		if opts.Password == "" {
+			return ErrPasswordRequired
+		}
+		if k, err = deriveKeys(opts.Password, h.Salt[:]); err != nil {
+			return err
+		}
+	}
+
+	var embedded bytes.Buffer
+	if err := streamMessage(ctx, img, h, body, h.pixelOrder(img.Bounds(), body, k), &embedded, opts.bufferLen(), prog); err != nil {
+		return err
+	}
+	msg := embedded.Bytes()
+
+	if mac != nil {
+		mac.Write(msg)
+		if err := checkMAC(h, mac); err != nil {
+			return err
+		}
+	}
+	if xor {
+		xorBytes(msg, opts.XORKey, 0)
+	}
+	if ecc {
+		if msg, err = eccDecode(msg, int(h.ECC), opts.Strict); err != nil {
+			return err
+		}
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		if msg, err = decrypt(h, msg, k); err != nil {
+			// The password may be that of a message hidden behind a decoy
+			if err == ErrDecrypt && canHideBehind(h) {
+				if msg, err = decodeHidden(ctx, img, h, rg, opts.Password); err == nil {
+					_, err = w.Write(msg)
+				}
+			}
+			return err
+		}
+	}
+	if h.Flags&FlagCompressed != 0 {
+		if msg, err = decompress(msg); err != nil {
+			return err
+		}
+	}
+	if crc32.ChecksumIEEE(msg) != h.CRC {
+		return ErrChecksumMismatch
+	}
+
+	_, err = w.Write(msg)
+	return err
+}
+
+// ReadHeader reads the header from the first pixels of img (the header of slot
+// 0, if the image is divided into slots), and checks that the message it
+// describes fits in img.  It returns ErrNotStego if there is no header.  The
+// header is looked for both as a byte per 16 bit colour value, and as 2 bits
+// per 8 bit colour value, in R, G and B or in the luminance of a grayscale
+// image.
+func ReadHeader(img image.Image) (Header, error) {
+	return readHeaderAt(img, 0)
+}
+
+// ReadSlotHeader reads the header of the slot of img chosen by opts.Slots and
+// opts.Slot, as ReadHeader does for slot 0.
+func ReadSlotHeader(img image.Image, opts Options) (Header, error) {
+	h, _, err := readSlotHeader(img, opts)
+	return h, err
+}
+
+// readSlotHeader reads the header of the slot chosen in opts, and returns it
+// with the pixels of the slot.
+func readSlotHeader(img image.Image, opts Options) (Header, region, error) {
+	slot, slots, err := opts.slots()
+	if err != nil {
+		return Header{}, region{}, err
+	}
+	rg := slotRegion(img.Bounds(), slot, slots)
+	h, err := readHeaderAt(img, rg.start)
+	if err != nil {
+		return h, rg, err
+	}
+	if hs, hn := h.slots(); hs != slot || hn != slots {
+		return h, rg, fmt.Errorf("header found is for slot %d of %d, not slot %d of %d", hs, hn, slot, slots)
+	}
+
+	return h, rg, nil
+}
+
+// readHeaderAt reads the header stored in the pixels of img from start, and
+// checks that the message it describes fits in its slot.
+func readHeaderAt(img image.Image, start int) (Header, error) {
+	for _, l := range []layout{{}, {depth8: true}, {gray: true}, {gray: true, depth8: true}} {
+		h, err := readHeaderWith(img, l.headerLayout(), start)
+		if err == ErrNotStego {
+			continue
+		}
+		if err != nil {
+			return h, err
+		}
+
+		// Never trust a length that could not fit, or decode would read the whole
+		// image as the message
+		slot, slots := h.slots()
+		rg := slotRegion(img.Bounds(), slot, slots)
+		if rg.start != start || int64(h.embeddedLen()) > int64(capacity(rg, h.layout(), h.size())) {
+			return h, ErrCorruptHeader
+		}
+		if !h.layout().checkRect(img.Bounds(), bodyRegion(rg, h.layout(), h.size())) {
+			return h, ErrCorruptHeader
+		}
+
+		// A message hidden in 16 bit colour values cannot have survived in an
+		// image that has only 8
+		if !h.layout().depth8 && !is16Bit(img) {
+			return h, ErrCarrierDowngraded
+		}
+		return h, nil
+	}
+
+	return Header{}, ErrNotStego
+}
+
+// readHeaderWith reads the header from the pixels of img from start, stored
+// with header layout hl.
+func readHeaderWith(img image.Image, hl layout, start int) (Header, error) {
+	bounds := img.Bounds()
+	header_bytes := make([]byte, 0, header_len)
+	var bw bitWriter
+
+	for pixel := start; pixel < bounds.Dx()*bounds.Dy(); pixel++ {
+		c := hl.view(colourAt(img, pixelPoint(bounds, pixel)))
+
+		// Build the header from the color bytes
+		header_bytes = hl.decodePixel(&bw, c, header_bytes)
+
+		if len(header_bytes) < header_len {
+			continue
+		}
+		h, err := parseHeader(header_bytes)
+		if err == errShortHeader {
+			continue
+		}
+		if err != nil {
+			return h, err
+		}
+		if l := h.layout(); l.depth8 != hl.depth8 || l.gray != hl.gray {
+			return h, ErrNotStego
+		}
+		return h, nil
+	}
+
+	return Header{}, ErrNotStego
+}
+
+// colourAt returns the non-premultiplied 16-bit R, G, B and A values of the
+// pixel at p, whatever the colour model of img.  (The RGBA method of a colour
+// returns premultiplied values, which would lose the low bits of R, G and B in
+// any pixel that is not fully opaque.)
+func colourAt(img image.Image, p image.Point) [4]uint32 {
+	// Read the common image types straight from their pixels, rather than
+	// allocating a color.Color for every pixel
+	switch m := img.(type) {
+	case *image.NRGBA:
+		s := m.Pix[m.PixOffset(p.X, p.Y):]
+		return [4]uint32{uint32(s[0]) * 0x101, uint32(s[1]) * 0x101, uint32(s[2]) * 0x101, uint32(s[3]) * 0x101}
+	case *image.NRGBA64:
+		s := m.Pix[m.PixOffset(p.X, p.Y):]
+		return [4]uint32{uint32(s[0])<<8 | uint32(s[1]), uint32(s[2])<<8 | uint32(s[3]), uint32(s[4])<<8 | uint32(s[5]), uint32(s[6])<<8 | uint32(s[7])}
+	case *image.Gray:
+		y := uint32(m.Pix[m.PixOffset(p.X, p.Y)]) * 0x101
+		return [4]uint32{y, y, y, 0xffff}
+	case *image.Gray16:
+		s := m.Pix[m.PixOffset(p.X, p.Y):]
+		y := uint32(s[0])<<8 | uint32(s[1])
+		return [4]uint32{y, y, y, 0xffff}
+	}
+
+	// Converting an 8 bit colour goes through premultiplied values too, so read
+	// it directly; otherwise a fully transparent pixel would lose its R, G and B
+	if c, ok := img.At(p.X, p.Y).(color.NRGBA); ok {
+		return [4]uint32{uint32(c.R) * 0x101, uint32(c.G) * 0x101, uint32(c.B) * 0x101, uint32(c.A) * 0x101}
+	}
+
+	c := color.NRGBA64Model.Convert(img.At(p.X, p.Y)).(color.NRGBA64)
+	return [4]uint32{uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)}
+}
+
+// streamMessage writes the message described by h, hidden in the pixels body of
+// img, to w in writes of up to buffer_len bytes, reporting progress to prog.  If
+// the message is scattered, order gives the message pixels it is hidden in.
+func streamMessage(ctx context.Context, img image.Image, h Header, body region, order []uint32, w io.Writer, buffer_len int, prog *progress) error {
+	l := h.layout()
+	if l.interleave {
+		// The bits of any padding are interleaved with the message's
+		var stored bytes.Buffer
+		if err := streamBits(ctx, img, l, h.storedLen(img.Bounds().Dx(), body), body, order, &stored, buffer_len, prog); err != nil {
+			return err
+		}
+		msg := l.deinterleaveMessage(stored.Bytes(), h.embeddedLen(), img.Bounds().Dx(), body)[:h.PayloadLen]
+		for len(msg) > 0 {
+			n := min(len(msg), buffer_len)
+			if _, err := w.Write(msg[:n]); err != nil {
+				return err
+			}
+			msg = msg[n:]
+		}
+		return nil
+	}
+	if l.matrix != 0 {
+		w = newMatrixWriter(w, l.matrix, int(h.PayloadLen))
+	}
+	return streamBits(ctx, img, l, l.storedLen(int(h.PayloadLen)), body, order, w, buffer_len, prog)
+}
+
+// streamBits writes the first length bytes held in the pixels body of img with
+// layout l (in the given order, if not nil) to w, as streamMessage does.
+func streamBits(ctx context.Context, img image.Image, l layout, length int, body region, order []uint32, w io.Writer, buffer_len int, prog *progress) error {
+	// Setup channels for writing decoded message data out, a buffer at a time
+	bo := make(chan []byte, 2)
+	ex := make(chan error)
+
+	// Anon func to write message out to w
+	go func() {
+		var werr error
+
+		// Write to the exit channel on completion, to let the decoding goroutine know
+		defer func() {
+			ex <- werr
+		}()
+
+		for buffer := range bo {
+			if werr == nil {
+				_, werr = w.Write(buffer)
+			}
+		}
+	}()
+
+	err := decodePixels(ctx, img, l, length, body, order, bo, buffer_len, prog)
+
+	// Close the binary output channel and wait for goroutine to finish (and flush to output)
+	close(bo)
+	werr := <-ex
+	if err != nil {
+		return err
+	}
+
+	return werr
+}
+
+// decodePixels walks the message pixels body of img (in the given order, if not
+// nil), and sends the first length bytes hidden in them with layout l to bo in
+// buffers of up to buffer_len bytes, reporting progress to prog once a row.  It
+// returns ctx.Err() if ctx is cancelled first.
+func decodePixels(ctx context.Context, img image.Image, l layout, length int, body region, order []uint32, bo chan<- []byte, buffer_len int, prog *progress) error {
+	message_index := 0
+	var bw bitWriter
+	out := make([]byte, 0, 4)
+	buffer := make([]byte, 0, min(buffer_len, length))
+
+	// Get the bounds of the image
+	bounds := img.Bounds()
+
+	// Loop over the pixels following the header - return here when finished decoding
+	for pixel := body.start; pixel < body.end && message_index < length; pixel++ {
+		p := pixel
+		if order != nil {
+			p = body.start + int(order[pixel-body.start])
+		}
+
+		// Check for cancellation once a row
+		if (pixel-body.start)%bounds.Dx() == 0 {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			prog.setDone(message_index)
+		}
+
+		// Get the rgba values from the input image
+		c := l.view(colourAt(img, pixelPoint(bounds, p)))
+
+		out = l.decodePixel(&bw, c, out[:0])
+		// message_index counts the bytes sent so far, so stop once it reaches the
+		// length, even part way through a pixel
+		for _, ch := range out {
+			if message_index == length {
+				break
+			}
+			buffer = append(buffer, ch)
+			message_index++
+			if len(buffer) == buffer_len {
+				bo <- buffer
+				buffer = make([]byte, 0, buffer_len)
+			}
+		}
+	}
+
+	// Send the part filled buffer, if any: a full one has already gone
+	if len(buffer) > 0 {
+		bo <- buffer
+	}
+	prog.setDone(message_index)
+
+	return nil
+}
@@ -0,0 +1,2675 @@
+package stego
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testImage returns a w x h image with a smooth colour gradient, so each pixel
+// differs from its neighbours.
+func testImage(w, h int) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(x * 0xffff / w),
+				G: uint16(y * 0xffff / h),
+				B: uint16((x + y) * 0x7fff / (w + h)),
+				A: 0xffff,
+			})
+		}
+	}
+
+	return img
+}
+
+// testMessage returns n bytes of repeatable random data.
+func testMessage(n int) []byte {
+	msg := make([]byte, n)
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := range msg {
+		msg[i] = byte(r.Uint32())
+	}
+
+	return msg
+}
+
+func TestEncodeDecodeRoundtrip(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(3000)
+
+	out, err := Encode(img, msg, Options{Bits: 8})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	got, err := Decode(out, Options{})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Decode returned %d bytes that differ from the %d bytes encoded", len(got), len(msg))
+	}
+}
+
+// TestZeroOptions checks that the zero Options hide a message with the default
+// of 8 bits per colour value.
+func TestZeroOptions(t *testing.T) {
+	img := testImage(64, 48)
+	if got, want := Capacity(img, Options{}), Capacity(img, Options{Bits: 8}); got != want {
+		t.Errorf("Capacity with zero Options is %d, want %d as with Bits 8", got, want)
+	}
+	if got, want := Capacity(testImage8(64, 48), Options{KeepDepth: true}), Capacity(testImage8(64, 48), Options{Bits: 4, KeepDepth: true}); got != want {
+		t.Errorf("Capacity with only KeepDepth is %d, want %d as with Bits 4", got, want)
+	}
+
+	msg := testMessage(3000)
+	out, err := Encode(img, msg, Options{})
+	if err != nil {
+		t.Fatalf("Encode with zero Options: %v", err)
+	}
+	h, err := ReadHeader(out)
+	if err != nil || h.Bits != 8 {
+		t.Errorf("ReadHeader returned %+v, %v, want 8 bits", h, err)
+	}
+	if got, err := Decode(out, Options{}); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("Decode returned %d bytes, %v, want the %d encoded", len(got), err, len(msg))
+	}
+}
+
+const bench_size = 1024
+const bench_payload = 256 << 10
+
+func BenchmarkEncode(b *testing.B) {
+	img := testImage(bench_size, bench_size)
+	msg := testMessage(bench_payload)
+
+	b.SetBytes(bench_payload)
+	for b.Loop() {
+		if _, err := Encode(img, msg, Options{Bits: 8}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A message of a few MiB, where handing it to the pixel loop once a byte rather
+// than a chunk at a time cost more than the encoding
+func BenchmarkEncodeLargeMessage(b *testing.B) {
+	img := testImage(bench_size, bench_size)
+	msg := testMessage(4<<20 - 64)
+
+	b.SetBytes(int64(len(msg)))
+	for b.Loop() {
+		if _, err := Encode(img, msg, Options{Bits: 8}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	img := testImage(bench_size, bench_size)
+	msg := testMessage(bench_payload)
+	out, err := Encode(img, msg, Options{Bits: 8})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(bench_payload)
+	for b.Loop() {
+		if _, err := Decode(out, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compare the memory taken by a 16 bit output image with that of an 8 bit one
+// kept at 8 bits, with -benchmem
+func BenchmarkEncodeDepth(b *testing.B) {
+	img := testImage8(bench_size, bench_size)
+	msg := testMessage(bench_payload)
+	for _, opts := range []Options{{Bits: 4}, {Bits: 4, KeepDepth: true}} {
+		b.Run(fmt.Sprintf("KeepDepth=%v", opts.KeepDepth), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(bench_payload)
+			for b.Loop() {
+				if _, err := Encode(img, msg, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Compare the buffer sizes handed over at a time, on a message of a few MiB
+func BenchmarkBufferSize(b *testing.B) {
+	img := testImage(bench_size, bench_size)
+	msg := testMessage(4<<20 - 64)
+	out, err := Encode(img, msg, Options{Bits: 8})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, n := range []int{256, default_buffer_len} {
+		opts := Options{Bits: 8, BufferSize: n}
+		b.Run(fmt.Sprintf("Encode/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			for b.Loop() {
+				if _, err := Encode(img, msg, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Decode/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			for b.Loop() {
+				if _, err := DecodeTo(out, io.Discard, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestDecodeLength checks that exactly the encoded number of bytes comes back,
+// for lengths that end part way through a pixel in each layout, and for a
+// message that fills the image.
+func TestDecodeLength(t *testing.T) {
+	layouts := []Options{
+		{Bits: 8},
+		{Bits: 4},
+		{Bits: 2},
+		{Bits: 1},
+		{Bits: 8, Channels: ChannelsRGB},
+		{Bits: 2, Channels: ChannelsRGB},
+		{Mode: ModeSpread},
+		{Mode: ModeSpread, Channels: ChannelsRGB},
+	}
+	img := testImage(64, 48)
+
+	for _, opts := range layouts {
+		for _, n := range []int{0, 1, 4, 5, 255, Capacity(img, opts)} {
+			msg := testMessage(n)
+			out, err := Encode(img, msg, opts)
+			if err != nil {
+				t.Fatalf("Encode %d bytes with %+v: %v", n, opts, err)
+			}
+
+			got, err := Decode(out, Options{})
+			if err != nil {
+				t.Fatalf("Decode %d bytes with %+v: %v", n, opts, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("Decode with %+v returned %d bytes, want the %d encoded", opts, len(got), n)
+			}
+			if got, err := PayloadLength(out); err != nil || got != n {
+				t.Errorf("PayloadLength with %+v returned %d, %v, want %d", opts, got, err, n)
+			}
+		}
+	}
+
+	if _, err := PayloadLength(img); err != ErrNotStego {
+		t.Errorf("PayloadLength of a plain image returned %v, want ErrNotStego", err)
+	}
+	out, err := Encode(img, testMessage(10), Options{Pad: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := PayloadLength(out); err != nil || got != 10 {
+		t.Errorf("PayloadLength of a padded message returned %d, %v, want 10", got, err)
+	}
+}
+
+func TestDecodeCorruptLength(t *testing.T) {
+	img := testImage(64, 48)
+	h := newHeader(layout{bits: 8, channels: rgba_channels})
+	h.PayloadLen = 1 << 30
+	storeHeader(img, h.layout(), h.bytes(), 0)
+
+	if _, err := Decode(img, Options{}); !errors.Is(err, ErrCorruptHeader) {
+		t.Fatalf("Decode of an over-long header returned %v, want ErrCorruptHeader", err)
+	}
+}
+
+func TestCarrierDowngraded(t *testing.T) {
+	out, err := Encode(testImage(64, 48), testMessage(100), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-saved at 8 bits, the low bytes holding the header and message are lost
+	resaved := image.NewNRGBA(out.Bounds())
+	draw.Draw(resaved, resaved.Bounds(), out, image.Point{}, draw.Src)
+	if _, err := Decode(resaved, Options{}); err != ErrNotStego {
+		t.Errorf("Decode of the image re-saved at 8 bits returned %v, want ErrNotStego", err)
+	}
+
+	// Unless the header happens to be in the values left, which still cannot
+	// hold the message
+	for i, v := range out.(*image.NRGBA64).Pix {
+		if i%2 == 1 {
+			resaved.Pix[i/2] = v
+		}
+	}
+	if _, err := Decode(resaved, Options{}); err != ErrCarrierDowngraded {
+		t.Errorf("Decode of an 8 bit image with a 16 bit header returned %v, want ErrCarrierDowngraded", err)
+	}
+}
+
+func TestDecodeTo(t *testing.T) {
+	msg := testMessage(1000)
+	for _, opts := range []Options{
+		{Bits: 8},
+		{Bits: 8, Compress: true},
+		{Bits: 2, Pad: 2000, XORKey: "k"},
+		{Interleave: true, Bits: 4},
+		{Password: "pw", HMACKey: "mac"},
+	} {
+		out, err := Encode(testImage(64, 48), msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+
+		var got bytes.Buffer
+		n, err := DecodeTo(out, &got, Options{Password: opts.Password, HMACKey: opts.HMACKey, XORKey: opts.XORKey})
+		if err != nil {
+			t.Fatalf("DecodeTo with %+v: %v", opts, err)
+		}
+		if n != len(msg) || !bytes.Equal(got.Bytes(), msg) {
+			t.Errorf("DecodeTo with %+v wrote %d bytes (reported %d), want the %d encoded", opts, got.Len(), n, len(msg))
+		}
+
+		// The header gives the length to expect of a message stored as is
+		if opts.Compress || opts.Password != "" {
+			continue
+		}
+		if l, err := PayloadLength(out); err != nil || l != n {
+			t.Errorf("PayloadLength with %+v is %d, %v; DecodeTo wrote %d", opts, l, err, n)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	msg := testMessage(1000)
+	for _, opts := range []Options{
+		{},
+		{Bits: 2, Pad: 2000, XORKey: "k"},
+		{Interleave: true, Bits: 4, HMACKey: "mac"},
+	} {
+		out, err := Encode(testImage(64, 48), msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		dopts := Options{HMACKey: opts.HMACKey, XORKey: opts.XORKey, Strict: true}
+		var got bytes.Buffer
+		if n, err := DecodeTo(out, &got, dopts); err != nil || n != len(msg) || !bytes.Equal(got.Bytes(), msg) {
+			t.Errorf("strict DecodeTo with %+v wrote %d bytes, %v", opts, n, err)
+		}
+		if opts.HMACKey != "" {
+			continue
+		}
+
+		// A damaged plain message is streamed out before the checksum is
+		// checked, unless the decode is strict
+		d := image.NewNRGBA64(out.Bounds())
+		draw.Draw(d, d.Bounds(), out, image.Point{}, draw.Src)
+		d.Pix[8*200+1] ^= 0xff
+		if n, err := DecodeTo(d, io.Discard, Options{XORKey: opts.XORKey}); !errors.Is(err, ErrChecksumMismatch) || n != len(msg) {
+			t.Errorf("DecodeTo of a damaged message with %+v wrote %d bytes, %v", opts, n, err)
+		}
+		if n, err := DecodeTo(d, io.Discard, dopts); !errors.Is(err, ErrChecksumMismatch) || n != 0 {
+			t.Errorf("strict DecodeTo of a damaged message with %+v wrote %d bytes, %v", opts, n, err)
+		}
+	}
+}
+
+func TestEncodeFrom(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(3000)
+
+	out, err := EncodeFrom(img, iotest.OneByteReader(bytes.NewReader(msg)), len(msg), Options{Bits: 8})
+	if err != nil {
+		t.Fatalf("EncodeFrom: %v", err)
+	}
+	got, err := Decode(out, Options{})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Decode returned %d bytes that differ from the %d bytes encoded", len(got), len(msg))
+	}
+
+	// A reader that returns its last bytes along with io.EOF, for lengths just
+	// past a whole number of chunks
+	for _, n := range []int{257, 513} {
+		out, err := EncodeFrom(img, iotest.DataErrReader(bytes.NewReader(msg[:n])), n, Options{Bits: 8, BufferSize: 256})
+		if err != nil {
+			t.Fatalf("EncodeFrom of %d bytes ending with io.EOF: %v", n, err)
+		}
+		for _, size := range []int{0, 1, 100, 256} {
+			if got, err := Decode(out, Options{BufferSize: size}); err != nil || !bytes.Equal(got, msg[:n]) {
+				t.Errorf("Decode of %d bytes ending with io.EOF, with BufferSize %d, returned %d bytes, %v", n, size, len(got), err)
+			}
+		}
+	}
+
+	// A reader that runs out early
+	for _, opts := range []Options{{Bits: 8}, {Bits: 8, Compress: true}} {
+		_, err := EncodeFrom(img, bytes.NewReader(msg[:100]), len(msg), opts)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("EncodeFrom of a short reader with %+v returned %v, want io.ErrUnexpectedEOF", opts, err)
+		}
+	}
+}
+
+func TestEncodeCapacityError(t *testing.T) {
+	img := testImage(16, 16)
+	opts := Options{Bits: 2}
+	capacity := Capacity(img, opts)
+
+	_, err := Encode(img, testMessage(capacity+10), opts)
+	var ce *CapacityError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Encode of an oversized message returned %v, want a CapacityError", err)
+	}
+	if ce.Payload != capacity+10 || ce.Capacity != capacity {
+		t.Errorf("CapacityError is %+v, want payload %d and capacity %d", *ce, capacity+10, capacity)
+	}
+}
+
+func TestErrorSentinels(t *testing.T) {
+	img := testImage(16, 16)
+	plain, err := Encode(img, testMessage(10), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Encode(img, testMessage(10), Options{Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := image.NewNRGBA64(plain.Bounds())
+	draw.Draw(damaged, damaged.Bounds(), plain, image.Point{}, draw.Src)
+	damaged.Pix[8*7+1] ^= 1 // the low byte of R in the second message pixel
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"too long", errOf(Encode(img, testMessage(2000), Options{})), ErrInsufficientCapacity},
+		{"bad mode", errOf(Encode(img, nil, Options{Mode: "diagonal"})), ErrInvalidOptions},
+		{"bad slot", errOf(Encode(img, nil, Options{Slots: 2, Slot: 2})), ErrInvalidOptions},
+		{"scatter without password", errOf(Encode(img, nil, Options{Scatter: true})), ErrInvalidOptions},
+		{"plain image", errOf(Decode(img, Options{})), ErrNotStego},
+		{"damaged", errOf(Decode(damaged, Options{})), ErrChecksumMismatch},
+		{"wrong password", errOf(Decode(sealed, Options{Password: "wrong"})), ErrDecrypt},
+		{"no password", errOf(Decode(sealed, Options{})), ErrPasswordRequired},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Errorf("%s: got %v, want an error matching %v", tc.name, tc.err, tc.want)
+		}
+	}
+}
+
+// errOf returns the error of a call returning a value and an error.
+func errOf[T any](_ T, err error) error {
+	return err
+}
+
+// testImage8 returns testImage with 8 bits per colour value.
+func testImage8(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), testImage(w, h), image.Point{}, draw.Src)
+	return img
+}
+
+func TestKeepDepth(t *testing.T) {
+	img := testImage8(64, 48)
+	msg := testMessage(500)
+	layouts := []Options{
+		{Bits: 4},
+		{Bits: 2},
+		{Bits: 1, Channels: ChannelsRGB},
+		{Mode: ModeSpread},
+		{Mode: ModeSpread, Channels: ChannelsRGB, Password: "pw", Scatter: true},
+	}
+
+	for _, opts := range layouts {
+		opts.KeepDepth = true
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		if _, ok := out.(*image.NRGBA); !ok {
+			t.Fatalf("Encode with %+v returned a %T, want an *image.NRGBA", opts, out)
+		}
+
+		// The message has to survive being saved as an 8 bit PNG
+		var b bytes.Buffer
+		if err := png.Encode(&b, out); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := png.Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Decode(saved, Options{Password: opts.Password})
+		if err != nil {
+			t.Fatalf("Decode with %+v: %v", opts, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v returned %d bytes that differ from the %d encoded", opts, len(got), len(msg))
+		}
+	}
+
+	if _, err := Encode(img, msg, Options{Bits: 8, KeepDepth: true}); err == nil {
+		t.Error("Encode with 8 bits of an 8 bit image succeeded, want an error")
+	}
+
+	// A 16 bit image keeps its depth anyway
+	out, err := Encode(testImage(64, 48), msg, Options{Bits: 8, KeepDepth: true})
+	if err != nil {
+		t.Fatalf("Encode of a 16 bit image: %v", err)
+	}
+	if _, ok := out.(*image.NRGBA64); !ok {
+		t.Errorf("Encode of a 16 bit image returned a %T, want an *image.NRGBA64", out)
+	}
+}
+
+// testImageGray16 returns a w x h 16 bit grayscale image with a smooth
+// gradient, like an X-ray.
+func testImageGray16(w, h int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetGray16(x, y, color.Gray16{uint16((x*w + y) * 0xffff / (w*w + h))})
+		}
+	}
+
+	return img
+}
+
+func TestGray(t *testing.T) {
+	msg := testMessage(1000)
+	gray8 := image.NewGray(image.Rect(0, 0, 64, 48))
+	draw.Draw(gray8, gray8.Bounds(), testImageGray16(64, 48), image.Point{}, draw.Src)
+
+	for _, tc := range []struct {
+		img  image.Image
+		opts Options
+		want image.Image
+	}{
+		{testImageGray16(64, 48), Options{Bits: 8}, &image.Gray16{}},
+		{testImageGray16(64, 48), Options{Bits: 4, Password: "pw", Scatter: true}, &image.Gray16{}},
+		{gray8, Options{Bits: 4, KeepDepth: true}, &image.Gray{}},
+		{gray8, Options{Bits: 4}, &image.Gray16{}},
+	} {
+		out, err := Encode(tc.img, msg, tc.opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", tc.opts, err)
+		}
+		if reflect.TypeOf(out) != reflect.TypeOf(tc.want) {
+			t.Fatalf("Encode with %+v returned a %T, want a %T", tc.opts, out, tc.want)
+		}
+
+		// The message has to survive being saved as a grayscale PNG
+		var b bytes.Buffer
+		if err := png.Encode(&b, out); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := png.Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(saved, tc.opts)
+		if err != nil {
+			t.Fatalf("Decode with %+v: %v", tc.opts, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v returned %d bytes that differ from the %d encoded", tc.opts, len(got), len(msg))
+		}
+	}
+
+	// One value per pixel, less the 16 pixels of the header
+	if got, want := Capacity(testImageGray16(64, 48), Options{Bits: 8}), 64*48-header_len; got != want {
+		t.Errorf("Capacity of a grayscale image is %d, want %d", got, want)
+	}
+	if _, err := Encode(testImageGray16(64, 48), msg, Options{Mode: ModeSpread}); err == nil {
+		t.Error("Encode of a grayscale image in spread mode succeeded, want an error")
+	}
+}
+
+func TestPaletted(t *testing.T) {
+	// A paletted image, with a transparent entry, is converted to full colour
+	pal := append(color.Palette{color.NRGBA{}}, palette.Plan9[:255]...)
+	img := image.NewPaletted(image.Rect(0, 0, 64, 48), pal)
+	draw.FloydSteinberg.Draw(img, img.Bounds(), testImage8(64, 48), image.Point{})
+	for x := range 10 {
+		img.SetColorIndex(x, 47, 0)
+	}
+
+	msg := testMessage(1000)
+	for _, tc := range []struct {
+		opts Options
+		want image.Image
+	}{
+		{Options{}, &image.NRGBA64{}},
+		{Options{Bits: 2, KeepDepth: true}, &image.NRGBA{}},
+		{Options{Bits: 1, Matrix: 3, KeepDepth: true, MinAlpha: 1}, &image.NRGBA{}},
+	} {
+		m := msg[:min(len(msg), Capacity(img, tc.opts))]
+		out, err := Encode(img, m, tc.opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", tc.opts, err)
+		}
+		if reflect.TypeOf(out) != reflect.TypeOf(tc.want) {
+			t.Fatalf("Encode with %+v returned a %T, want a %T", tc.opts, out, tc.want)
+		}
+		if got, err := Decode(out, Options{}); err != nil || !bytes.Equal(got, m) {
+			t.Fatalf("Decode with %+v returned %d bytes, %v", tc.opts, len(got), err)
+		}
+	}
+}
+
+func TestOpaque(t *testing.T) {
+	// A carrier with varying, partly transparent, alpha
+	img := testImage(64, 48)
+	for i := 6; i < len(img.Pix); i += 8 {
+		img.Pix[i] = byte(i)
+	}
+	img8 := testImage8(64, 48)
+	draw.Draw(img8, img8.Bounds(), img, image.Point{}, draw.Src)
+
+	msg := testMessage(1000)
+	for _, tc := range []struct {
+		img  image.Image
+		opts Options
+	}{
+		{img, Options{Opaque: true}},
+		{img, Options{Opaque: true, Channels: ChannelsBlue, Bits: 4, MinAlpha: 100}},
+		{img8, Options{Opaque: true, KeepDepth: true, Bits: 2, Password: "pw", Scatter: true}},
+	} {
+		out, err := Encode(tc.img, msg, tc.opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", tc.opts, err)
+		}
+		bounds := out.Bounds()
+		for p := range bounds.Dx() * bounds.Dy() {
+			if c := colourAt(out, pixelPoint(bounds, p)); c[3] != 0xffff {
+				t.Fatalf("Encode with %+v left pixel %d with alpha %#x", tc.opts, p, c[3])
+			}
+		}
+
+		// The message survives being saved as a PNG with no alpha channel
+		var b bytes.Buffer
+		if err := png.Encode(&b, out); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := png.Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := Decode(saved, tc.opts); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("Decode with %+v returned %d bytes, %v", tc.opts, len(got), err)
+		}
+	}
+
+	if _, err := Encode(img, msg, Options{Opaque: true, Channels: ChannelsRGBA}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Encode of an opaque image with the message in alpha returned %v, want ErrInvalidOptions", err)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	msg := testMessage(1000)
+	for _, opts := range []Options{{Bits: 8}, {Bits: 8, Password: "pw"}} {
+		opts.HMACKey = "key"
+		out, err := Encode(testImage(64, 48), msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+
+		got, err := Decode(out, opts)
+		if err != nil {
+			t.Fatalf("Decode with %+v: %v", opts, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v returned %d bytes that differ from the %d encoded", opts, len(got), len(msg))
+		}
+
+		if _, err := Decode(out, Options{Password: opts.Password}); err != ErrAuthKeyRequired {
+			t.Errorf("Decode with %+v and no key returned %v, want ErrAuthKeyRequired", opts, err)
+		}
+		if _, err := Decode(out, Options{Password: opts.Password, HMACKey: "wrong"}); err != ErrAuthFailed {
+			t.Errorf("Decode with %+v and the wrong key returned %v, want ErrAuthFailed", opts, err)
+		}
+
+		// Flip a bit of the hidden message
+		img := out.(*image.NRGBA64)
+		c := img.NRGBA64At(20, 2)
+		c.R ^= 1
+		img.SetNRGBA64(20, 2, c)
+		if _, err := Decode(img, opts); err != ErrAuthFailed {
+			t.Errorf("Decode with %+v of a modified image returned %v, want ErrAuthFailed", opts, err)
+		}
+	}
+}
+
+func TestHeaderMarshal(t *testing.T) {
+	h := newHeader(layout{bits: 2, channels: rgb_channels})
+	h.Flags |= FlagEncrypted | FlagHMAC | FlagFilename
+	h.PayloadLen = 0x01020304
+	h.CRC = 0xdeadbeef
+	h.Salt[0], h.Nonce[1], h.Tag[2] = 1, 2, 3
+	h.Filename = "report.pdf"
+	h.Version, h.ExtFlags = header_version_ext, ExtFlagXOR
+
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	var got Header
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if got != h {
+		t.Errorf("UnmarshalBinary returned %+v, want %+v", got, h)
+	}
+
+	for n := range len(b) {
+		if err := got.UnmarshalBinary(b[:n]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("UnmarshalBinary of %d of %d bytes returned %v, want io.ErrUnexpectedEOF", n, len(b), err)
+		}
+	}
+
+	h.Filename = string(make([]byte, max_filename_len+1))
+	if _, err := h.MarshalBinary(); err == nil {
+		t.Error("MarshalBinary of an over-long file name succeeded, want an error")
+	}
+}
+
+// TestHeaderLength checks that lengths with every byte significant survive the
+// trip through the header pixels, at both colour depths.
+func TestHeaderLength(t *testing.T) {
+	for _, depth8 := range []bool{false, true} {
+		for _, length := range []uint32{0, 0x01020304, 0xffffffff} {
+			l := layout{bits: 2, channels: rgba_channels, depth8: depth8}
+			h := newHeader(l)
+			h.PayloadLen = length
+
+			var img draw.Image = testImage(16, 16)
+			if depth8 {
+				img = testImage8(16, 16)
+			}
+			storeHeader(img, l, h.bytes(), 0)
+
+			got, err := readHeaderWith(img, l.headerLayout(), 0)
+			if err != nil {
+				t.Fatalf("readHeaderWith of length %#x (8 bit %v): %v", length, depth8, err)
+			}
+			if got.PayloadLen != length {
+				t.Errorf("readHeaderWith returned length %#x (8 bit %v), want %#x", got.PayloadLen, depth8, length)
+			}
+		}
+	}
+}
+
+// TestDecodeHeaderBits checks that Decode takes the bits per colour value from
+// the header, whatever the options say, and rejects a header with an invalid
+// number.
+func TestDecodeHeaderBits(t *testing.T) {
+	msg := testMessage(500)
+	for _, bits := range []int{1, 2, 4, 8} {
+		out, err := Encode(testImage(64, 48), msg, Options{Bits: bits})
+		if err != nil {
+			t.Fatalf("Encode with %d bits: %v", bits, err)
+		}
+		got, err := Decode(out, Options{Bits: 8 / bits})
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode of %d bits with Bits %d returned %d bytes, %v", bits, 8/bits, len(got), err)
+		}
+	}
+
+	img := testImage(64, 48)
+	h := newHeader(layout{bits: 8, channels: rgba_channels})
+	h.Bits = 3
+	storeHeader(img, h.layout(), h.bytes(), 0)
+	if _, err := Decode(img, Options{}); err == nil || !strings.Contains(err.Error(), "invalid bits per channel 3") {
+		t.Errorf("Decode of a header with 3 bits returned %v, want an invalid bits error", err)
+	}
+}
+
+var update_golden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestEncodeGolden compares the output of Encode against reference images
+// checked in under testdata, so any change to the header or pixel layout is
+// noticed.  The pixels are compared rather than the PNG bytes, which depend on
+// the PNG encoder.  Run with -update to rewrite them after a deliberate change.
+func TestEncodeGolden(t *testing.T) {
+	msg := []byte("The quick brown fox jumps over the lazy dog")
+	cases := []struct {
+		name string
+		img  image.Image
+		opts Options
+	}{
+		{"bits8", testImage(16, 16), Options{Bits: 8}},
+		{"bits2_rgb", testImage(16, 16), Options{Bits: 2, Channels: ChannelsRGB}},
+		{"spread", testImage(16, 16), Options{Mode: ModeSpread}},
+		{"depth8", testImage8(16, 16), Options{Bits: 2, KeepDepth: true, Filename: "fox.txt"}},
+	}
+
+	for _, tc := range cases {
+		out, err := Encode(tc.img, msg, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", tc.name, err)
+		}
+
+		golden := filepath.Join("testdata", "golden_"+tc.name+".png")
+		if *update_golden {
+			var b bytes.Buffer
+			enc := png.Encoder{CompressionLevel: png.BestCompression}
+			if err := enc.Encode(&b, out); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(golden, b.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		f, err := os.Open(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		bounds := out.Bounds()
+		if want.Bounds() != bounds {
+			t.Fatalf("%s: Encode returned a %v image, want %v", tc.name, bounds, want.Bounds())
+		}
+		for i := range bounds.Dx() * bounds.Dy() {
+			p := pixelPoint(bounds, i)
+			if got, want := colourAt(out, p), colourAt(want, p); got != want {
+				t.Fatalf("%s: pixel %v is %v, want %v", tc.name, p, got, want)
+			}
+		}
+	}
+}
+
+func TestPlane(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(200)
+	for _, opts := range []Options{{Bits: 1, Plane: 3}, {Bits: 2, Plane: 6}, {Bits: 4, Plane: 2, KeepDepth: true}} {
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		got, err := Decode(out, Options{})
+		if err != nil {
+			t.Fatalf("Decode with %+v: %v", opts, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v returned %d bytes that differ from the %d encoded", opts, len(got), len(msg))
+		}
+	}
+
+	// Only the chosen plane of the message pixels may change
+	l := layout{bits: 1, plane: 3}
+	h := newHeader(l)
+	hdr_pixels := l.headerPixels(h.size())
+	out, err := Encode(img, msg, Options{Bits: 1, Plane: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := img.Bounds()
+	for i := hdr_pixels; i < bounds.Dx()*bounds.Dy(); i++ {
+		p := pixelPoint(bounds, i)
+		a, b := colourAt(img, p), colourAt(out, p)
+		for ch := range a {
+			if d := a[ch] ^ b[ch]; d&^(1<<3) != 0 {
+				t.Fatalf("pixel %v channel %d changed by %#x, want only bit 3", p, ch, d)
+			}
+		}
+	}
+
+	for _, opts := range []Options{{Bits: 8, Plane: 1}, {Bits: 2, Plane: -1}, {Mode: ModeSpread, Plane: 1}} {
+		if _, err := Encode(img, msg, opts); err == nil {
+			t.Errorf("Encode with %+v succeeded, want an error", opts)
+		}
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	img := testImage(256, 256)
+	msg := testMessage(100000)
+	out, err := Encode(img, msg, Options{Bits: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := EncodeContext(ctx, img, msg, Options{Bits: 8}); err != context.Canceled {
+		t.Errorf("EncodeContext with a cancelled context returned %v, want context.Canceled", err)
+	}
+	if _, err := DecodeContext(ctx, out, Options{}); err != context.Canceled {
+		t.Errorf("DecodeContext with a cancelled context returned %v, want context.Canceled", err)
+	}
+
+	// The goroutines feeding and draining the pixel loops must all stop
+	for range 100 {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%d goroutines still running after cancellation, want %d", runtime.NumGoroutine(), before)
+}
+
+func TestSlots(t *testing.T) {
+	a, b := testMessage(300), []byte("the second message")
+	img, err := Encode(testImage(64, 48), a, Options{Bits: 4, Slots: 2, Slot: 0, Password: "alice"})
+	if err != nil {
+		t.Fatalf("Encode slot 0: %v", err)
+	}
+	img, err = Encode(img, b, Options{Mode: ModeSpread, Slots: 2, Slot: 1, Password: "bob", Scatter: true})
+	if err != nil {
+		t.Fatalf("Encode slot 1: %v", err)
+	}
+
+	for _, tc := range []struct {
+		opts Options
+		want []byte
+	}{
+		{Options{Slots: 2, Slot: 0, Password: "alice"}, a},
+		{Options{Slots: 2, Slot: 1, Password: "bob"}, b},
+	} {
+		got, err := Decode(img, tc.opts)
+		if err != nil {
+			t.Fatalf("Decode with %+v: %v", tc.opts, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("Decode with %+v returned %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+
+	if _, err := Decode(img, Options{Slots: 2, Slot: 1, Password: "alice"}); err != ErrDecrypt {
+		t.Errorf("Decode of slot 1 with slot 0's password returned %v, want ErrDecrypt", err)
+	}
+	if _, err := Decode(img, Options{Password: "alice"}); err == nil {
+		t.Error("Decode of a divided image without Slots succeeded, want an error")
+	}
+	if h, err := ReadSlotHeader(img, Options{Slots: 2, Slot: 1}); err != nil || h.Slot != 1 || h.Slots != 2 || h.Flags&FlagSpread == 0 {
+		t.Errorf("ReadSlotHeader of slot 1 returned %+v, %v", h, err)
+	}
+
+	// Each slot only has room for its share of the image
+	opts := Options{Bits: 8, Slots: 3, Slot: 2}
+	if _, err := Encode(img, testMessage(Capacity(img, opts)+1), opts); err == nil {
+		t.Error("Encode of more than a slot holds succeeded, want an error")
+	}
+	if Capacity(img, opts) >= Capacity(img, Options{Bits: 8})/3 {
+		t.Errorf("Capacity of a third of the image is %d, want less than a third of %d", Capacity(img, opts), Capacity(img, Options{Bits: 8}))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	msg := testMessage(3000)
+	for _, opts := range []Options{{Bits: 8}, {Bits: 2, Compress: true}, {Mode: ModeSpread, Password: "pw", Scatter: true}} {
+		var calls [][2]int
+		record := func(done, total int) { calls = append(calls, [2]int{done, total}) }
+		check := func(op string) {
+			t.Helper()
+			if len(calls) < 2 {
+				t.Fatalf("%s with %+v reported progress %d times, want several", op, opts, len(calls))
+			}
+			for i, c := range calls {
+				if c[1] != calls[0][1] || c[0] > c[1] || i > 0 && c[0] < calls[i-1][0] {
+					t.Fatalf("%s with %+v reported progress %v", op, opts, calls)
+				}
+			}
+			if last := calls[len(calls)-1]; last[0] != last[1] {
+				t.Errorf("%s with %+v last reported %d of %d bytes, want all", op, opts, last[0], last[1])
+			}
+		}
+
+		opts.Progress = record
+		out, err := Encode(testImage(64, 48), msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		check("Encode")
+
+		calls = nil
+		if _, err := Decode(out, opts); err != nil {
+			t.Fatalf("Decode with %+v: %v", opts, err)
+		}
+		check("Decode")
+	}
+}
+
+func TestStealth(t *testing.T) {
+	img := testImage(64, 48)
+	opts := StealthOptions("pw")
+	msg := testMessage(Capacity(img, opts))
+
+	out, err := Encode(img, msg, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := Decode(out, Options{Password: "pw"})
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("Decode returned %d bytes, %v, want the %d encoded", len(got), err, len(msg))
+	}
+
+	// After the header, only the lowest bit of blue may change
+	h, err := ReadHeader(out)
+	if err != nil || h.Flags&FlagBlue == 0 {
+		t.Fatalf("ReadHeader returned %+v, %v, want FlagBlue", h, err)
+	}
+	bounds := img.Bounds()
+	for i := h.layout().headerPixels(h.size()); i < bounds.Dx()*bounds.Dy(); i++ {
+		p := pixelPoint(bounds, i)
+		a, b := colourAt(img, p), colourAt(out, p)
+		if a[0] != b[0] || a[1] != b[1] || a[3] != b[3] || a[2]^b[2] > 1 {
+			t.Fatalf("pixel %v changed from %v to %v, want just the lowest bit of blue", p, a, b)
+		}
+	}
+}
+
+func TestMinAlpha(t *testing.T) {
+	// Alpha fades from transparent on the left to opaque on the right
+	img := testImage(64, 48)
+	for y := range 48 {
+		for x := range 64 {
+			c := img.NRGBA64At(x, y)
+			c.A = uint16(x * 0xffff / 63)
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	img8 := image.NewNRGBA(img.Bounds())
+	draw.Draw(img8, img8.Bounds(), img, image.Point{}, draw.Src)
+
+	msg := testMessage(1000)
+	for _, tc := range []struct {
+		img  image.Image
+		opts Options
+	}{
+		{img, Options{Bits: 8}},
+		{img, Options{Bits: 2, Plane: 3}},
+		{img, Options{Mode: ModeSpread}},
+		{img, Options{Bits: 4, Password: "pw", Scatter: true}},
+		{img8, Options{Bits: 2, KeepDepth: true}},
+		{img8, Options{Mode: ModeSpread, KeepDepth: true}},
+	} {
+		tc.opts.MinAlpha = 128
+		out, err := Encode(tc.img, msg, tc.opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", tc.opts, err)
+		}
+		got, err := Decode(out, Options{Password: tc.opts.Password})
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("Decode with %+v returned %d bytes, %v, want the %d encoded", tc.opts, len(got), err, len(msg))
+		}
+
+		// Pixels that were more than half transparent keep their alpha
+		bounds := tc.img.Bounds()
+		for i := 0; i < bounds.Dx()*bounds.Dy(); i++ {
+			p := pixelPoint(bounds, i)
+			a, b := colourAt(tc.img, p), colourAt(out, p)
+			if a[3]>>8 < 128 && a[3] != b[3] {
+				t.Fatalf("Encode with %+v changed the alpha of pixel %v from %#x to %#x", tc.opts, p, a[3], b[3])
+			}
+		}
+
+		// The alpha of about half of the pixels is not available, though in spread
+		// mode each pixel holds a byte regardless
+		if tc.opts.Mode == ModeSpread {
+			continue
+		}
+		rgba, rgb := tc.opts, tc.opts
+		rgba.MinAlpha, rgb.Channels, rgb.MinAlpha = 0, ChannelsRGB, 0
+		if c := Capacity(tc.img, tc.opts); c <= Capacity(tc.img, rgb) || c >= Capacity(tc.img, rgba) {
+			t.Errorf("Capacity with %+v is %d, want between %d and %d", tc.opts, c, Capacity(tc.img, rgb), Capacity(tc.img, rgba))
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	msg := testMessage(2000)
+	for _, opts := range []Options{{Bits: 8}, {Bits: 4, Compress: true, Password: "pw", Scatter: true}} {
+		e, err := NewEncoder(msg, opts)
+		if err != nil {
+			t.Fatalf("NewEncoder with %+v: %v", opts, err)
+		}
+
+		var salts [][salt_len]byte
+		for _, img := range []image.Image{testImage(64, 48), testImage8(80, 40), testImage(64, 48)} {
+			out, err := e.Embed(img)
+			if err != nil {
+				t.Fatalf("Embed with %+v: %v", opts, err)
+			}
+			got, err := Decode(out, opts)
+			if err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("Decode with %+v returned %d bytes, %v, want the %d embedded", opts, len(got), err, len(msg))
+			}
+			h, _ := ReadHeader(out)
+			salts = append(salts, h.Salt)
+		}
+
+		// The message was only encrypted once
+		if salts[0] != salts[1] || salts[1] != salts[2] {
+			t.Errorf("Embed with %+v used different salts %x", opts, salts)
+		}
+	}
+
+	if _, err := NewEncoder(msg, Options{Scatter: true}); err == nil {
+		t.Error("NewEncoder with Scatter but no Password succeeded, want an error")
+	}
+}
+
+func TestPixelsUsed(t *testing.T) {
+	img := testImage(64, 48)
+	for _, tc := range []struct {
+		opts Options
+		want int
+	}{
+		{Options{Bits: 8}, 6 + 250},           // 16 header bytes at 3 a pixel, then 4 bytes a pixel
+		{Options{Bits: 1}, 6 + 2000},          // then half a byte a pixel
+		{Options{Mode: ModeSpread}, 6 + 1000}, // then a byte a pixel
+		{Options{Bits: 2, MinAlpha: 100, Password: "pw", Scatter: true}, 15 + 1016}, // 45 header bytes; alpha is opaque, so still used
+	} {
+		out, err := Encode(img, testMessage(1000), tc.opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", tc.opts, err)
+		}
+		if got, err := PixelsUsed(out, tc.opts); err != nil || got != tc.want {
+			t.Errorf("PixelsUsed with %+v returned %d, %v, want %d", tc.opts, got, err, tc.want)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	img := testImage(64, 48)
+	for _, opts := range []Options{
+		{Pad: 2000},
+		{Pad: 2000, Bits: 2, HMACKey: "key"},
+		{Pad: 2000, Password: "pw", Scatter: true, Compress: true},
+		{Pad: 2000, MinAlpha: 100},
+	} {
+		used := -1
+		for _, n := range []int{0, 10, 1500} {
+			msg := testMessage(n)
+			out, err := Encode(img, msg, opts)
+			if err != nil {
+				t.Fatalf("Encode of %d bytes with %+v: %v", n, opts, err)
+			}
+			got, err := Decode(out, opts)
+			if err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("Decode of %d bytes with %+v returned %d bytes, %v", n, opts, len(got), err)
+			}
+			h, err := ReadHeader(out)
+			if err != nil || h.Flags&FlagPadded == 0 || h.PaddedLen != 2000 {
+				t.Errorf("ReadHeader with %+v returned padded length %d, flags %#04x, %v, want 2000", opts, h.PaddedLen, h.Flags, err)
+			}
+
+			// However long the message, the same pixels are used
+			u, err := PixelsUsed(out, opts)
+			if err != nil {
+				t.Fatalf("PixelsUsed with %+v: %v", opts, err)
+			}
+			if used != -1 && u != used {
+				t.Errorf("PixelsUsed of %d bytes with %+v returned %d, want %d as for shorter messages", n, opts, u, used)
+			}
+			used = u
+		}
+	}
+
+	if _, err := Encode(img, testMessage(2001), Options{Pad: 2000}); err == nil {
+		t.Error("Encode of a message longer than Pad succeeded")
+	}
+	var ce *CapacityError
+	if _, err := Encode(img, testMessage(10), Options{Pad: 20000}); !errors.As(err, &ce) || ce.Payload != 20000 {
+		t.Errorf("Encode padded beyond the capacity returned %v, want a CapacityError for 20000 bytes", err)
+	}
+}
+
+func TestStride(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(300)
+	for _, opts := range []Options{
+		{Stride: 4},
+		{Stride: 4, Bits: 2},
+		{Stride: 7, Mode: ModeSpread},
+		{Stride: 4, MinAlpha: 100, Password: "pw", Compress: true},
+	} {
+		unstrided := opts
+		unstrided.Stride = 0
+		if got, want := Capacity(img, opts), Capacity(img, unstrided)/opts.Stride; got < want-16 || got > want+16 {
+			t.Errorf("Capacity with %+v is %d, want about %d", opts, got, want)
+		}
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		if got, err := Decode(out, Options{Password: opts.Password}); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("Decode with %+v returned %d bytes, %v", opts, len(got), err)
+		}
+
+		// Only every Stride'th pixel after the header is changed
+		h, err := ReadHeader(out)
+		if err != nil || int(h.Stride) != opts.Stride {
+			t.Fatalf("ReadHeader with %+v returned stride %d, %v", opts, h.Stride, err)
+		}
+		body := bodyRegion(region{end: 64 * 48}, h.layout(), h.size())
+		bounds := img.Bounds()
+		for p := body.start; p < body.end; p++ {
+			pt := pixelPoint(bounds, p)
+			if (p-body.start)%opts.Stride != 0 && out.At(pt.X, pt.Y) != img.At(pt.X, pt.Y) {
+				t.Fatalf("Encode with %+v changed pixel %d, between the strides", opts, p-body.start)
+			}
+		}
+	}
+
+	if _, err := Encode(img, msg, Options{Stride: 4, Password: "pw", Scatter: true}); err == nil {
+		t.Error("Encode with both Stride and Scatter succeeded")
+	}
+	if _, err := Encode(img, testMessage(Capacity(img, Options{Stride: 4})+1), Options{Stride: 4}); err == nil {
+		t.Error("Encode of a message longer than the strided capacity succeeded")
+	}
+}
+
+// changedValues returns the number of colour values of out that differ from
+// those of img.
+func changedValues(img, out image.Image) int {
+	n := 0
+	bounds := img.Bounds()
+	for p := range bounds.Dx() * bounds.Dy() {
+		a, b := colourAt(img, pixelPoint(bounds, p)), colourAt(out, pixelPoint(bounds, p))
+		for ch := range a {
+			if a[ch] != b[ch] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestMatrix(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(150)
+	plain, err := Encode(img, msg, Options{Bits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []Options{
+		{Matrix: 2},
+		{Matrix: 3, Bits: 1, Plane: 2},
+		{Matrix: 4, Password: "pw", Scatter: true},
+		{Matrix: 3, MinAlpha: 100, Channels: ChannelsRGBA},
+		{Matrix: 3, KeepDepth: true, Stride: 2},
+	} {
+		c := Capacity(img, opts)
+		unmatrixed := opts
+		unmatrixed.Matrix, unmatrixed.Bits = 0, 1
+		if want := Capacity(img, unmatrixed) * 8 / (1<<opts.Matrix - 1) * opts.Matrix / 8; opts.MinAlpha == 0 && (c < want-16 || c > want) {
+			t.Errorf("Capacity with %+v is %d, want about %d", opts, c, want)
+		}
+		for _, n := range []int{0, 1, len(msg), c} {
+			out, err := Encode(img, testMessage(n), opts)
+			if err != nil {
+				t.Fatalf("Encode of %d bytes with %+v: %v", n, opts, err)
+			}
+			got, err := Decode(out, Options{Password: opts.Password})
+			if err != nil || !bytes.Equal(got, testMessage(n)) {
+				t.Fatalf("Decode of %d bytes with %+v returned %d bytes, %v", n, opts, len(got), err)
+			}
+
+			// At most one value is changed in each group of cover bits, so
+			// fewer than with plain LSB embedding
+			if n == len(msg) && !opts.KeepDepth {
+				h, _ := ReadHeader(out)
+				groups := (int(h.PayloadLen)*8 + opts.Matrix - 1) / opts.Matrix
+				if changed, plain_changed := changedValues(img, out), changedValues(img, plain); changed > groups+h.size() || changed >= plain_changed {
+					t.Errorf("Encode with %+v changed %d colour values, want at most %d plus the header, and fewer than the %d of plain LSB", opts, changed, groups, plain_changed)
+				}
+			}
+		}
+	}
+	if _, err := Encode(img, testMessage(Capacity(img, Options{Matrix: 3})+1), Options{Matrix: 3}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Encode of a message longer than the matrix capacity returned %v", err)
+	}
+
+	for _, opts := range []Options{
+		{Matrix: 1},
+		{Matrix: 9},
+		{Matrix: 3, Bits: 2},
+		{Matrix: 3, Mode: ModeSpread},
+	} {
+		if _, err := Encode(img, msg, opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Encode with %+v returned %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+}
+
+// fuzzDecode decodes img with a few sets of options, none of which may panic,
+// or return part of a message along with an error.
+func fuzzDecode(t *testing.T, img image.Image) {
+	for _, opts := range []Options{{}, {Password: "pw", HMACKey: "key"}, {Slots: 2, Slot: 1}} {
+		if msg, err := Decode(img, opts); err != nil && msg != nil {
+			t.Errorf("Decode with %+v returned %d bytes along with %v", opts, len(msg), err)
+		}
+		PayloadLength(img)
+		PixelsUsed(img, opts)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	img := testImage(16, 16)
+	for _, opts := range []Options{{}, {Bits: 2, Compress: true, Password: "pw", Scatter: true}, {Stride: 3, MinAlpha: 1}} {
+		out, err := Encode(img, testMessage(50), opts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := png.Encode(&b, out); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b.Bytes())
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		fuzzDecode(t, img)
+	})
+}
+
+// FuzzDecodePixels decodes images whose pixels are arbitrary bytes, which
+// reaches header parsing far more often than arbitrary PNG files do.
+func FuzzDecodePixels(f *testing.F) {
+	for _, opts := range []Options{{}, {Bits: 1, HMACKey: "key", Filename: "a.txt"}, {Pad: 60, Slots: 2, Slot: 1}} {
+		out, err := Encode(testImage(16, 16), testMessage(50), opts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(out.(*image.NRGBA64).Pix)
+	}
+
+	f.Fuzz(func(t *testing.T, pix []byte) {
+		w := 16
+		h := len(pix) / (8 * w)
+		fuzzDecode(t, &image.NRGBA64{Pix: pix[:8*w*h], Stride: 8 * w, Rect: image.Rect(0, 0, w, h)})
+		fuzzDecode(t, &image.NRGBA{Pix: pix[:4*w*(len(pix)/(4*w))], Stride: 4 * w, Rect: image.Rect(0, 0, w, len(pix)/(4*w))})
+	})
+}
+
+func TestRect(t *testing.T) {
+	img := testImage(64, 48)
+	rect := image.Rect(20, 10, 40, 30)
+	for _, tc := range []struct {
+		opts     Options
+		capacity int // 0 if it depends on the image
+	}{
+		{Options{Rect: rect}, 400 * 4},
+		{Options{Rect: rect, Bits: 2, Password: "pw"}, 400 - gcm_tag_len},
+		{Options{Rect: rect, MinAlpha: 100, Compress: true}, 0},
+		{Options{Rect: image.Rect(8, 30, 48, 48), Slots: 2, Slot: 1}, 720 * 4},
+	} {
+		opts := tc.opts
+		c := Capacity(img, opts)
+		if tc.capacity != 0 && c != tc.capacity {
+			t.Errorf("Capacity with %+v is %d, want %d", opts, c, tc.capacity)
+		}
+		msg := testMessage(c / 2)
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		got, err := Decode(out, Options{Password: opts.Password, Slots: opts.Slots, Slot: opts.Slot})
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("Decode with %+v returned %d bytes, %v", opts, len(got), err)
+		}
+
+		// Only the header and the rectangle are changed
+		h, err := ReadSlotHeader(out, opts)
+		if err != nil || h.Rect != opts.Rect {
+			t.Fatalf("ReadSlotHeader with %+v returned rectangle %v, %v", opts, h.Rect, err)
+		}
+		rg, _ := opts.region(img)
+		body := bodyRegion(rg, h.layout(), h.size())
+		for p := body.start; p < 64*48; p++ {
+			pt := pixelPoint(img.Bounds(), p)
+			if !pt.In(opts.Rect) && out.At(pt.X, pt.Y) != img.At(pt.X, pt.Y) {
+				t.Fatalf("Encode with %+v changed pixel %v, outside the rectangle", opts, pt)
+			}
+		}
+	}
+
+	for _, opts := range []Options{
+		{Rect: image.Rect(0, 0, 10, 10)},   // overlaps the header
+		{Rect: image.Rect(50, 40, 70, 50)}, // outside the image
+		{Rect: rect, Password: "pw", Scatter: true},
+		{Rect: rect, Stride: 2},
+		{Rect: rect, Slots: 2, Slot: 1}, // outside the slot
+	} {
+		if _, err := Encode(img, testMessage(10), opts); err == nil {
+			t.Errorf("Encode with %+v succeeded", opts)
+		}
+	}
+}
+
+// TestPixelOrder checks that Encode puts each part of the message in the pixel
+// pixelOrder gives, the one Decode reads it back from, for each way of walking
+// the pixels.  With 8 bits of each value a pixel holds exactly 4 bytes.
+func TestPixelOrder(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(1000)
+	for _, opts := range []Options{
+		{Bits: 8},
+		{Bits: 8, Stride: 3},
+		{Bits: 8, Rect: image.Rect(10, 20, 50, 40)},
+		{Bits: 8, Password: "pw", Scatter: true},
+		{Bits: 8, Slots: 2, Slot: 1, Stride: 2},
+	} {
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		h, err := ReadSlotHeader(out, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The payload as hidden, sealed the same way if encrypted
+		payload, k := msg, keys{}
+		if opts.Password != "" {
+			if k, err = deriveKeys(opts.Password, h.Salt[:]); err != nil {
+				t.Fatal(err)
+			}
+			gcm, err := newGCM(k.aes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload = gcm.Seal(nil, h.Nonce[:], msg, nil)
+		}
+
+		slot, slots := h.slots()
+		body := bodyRegion(slotRegion(out.Bounds(), slot, slots), h.layout(), h.size())
+		order := h.pixelOrder(out.Bounds(), body, k)
+		for j := range len(payload) / 4 {
+			p := body.start + j
+			if order != nil {
+				p = body.start + int(order[j])
+			}
+			c := colourAt(out, pixelPoint(out.Bounds(), p))
+			if got := [4]byte{byte(c[0]), byte(c[1]), byte(c[2]), byte(c[3])}; !bytes.Equal(got[:], payload[4*j:4*j+4]) {
+				t.Fatalf("Encode with %+v put %x in message pixel %d, the %d'th in order, want %x", opts, got, p-body.start, j, payload[4*j:4*j+4])
+			}
+		}
+		if got, err := Decode(out, opts); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v gave %d bytes, %v", opts, len(got), err)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	imgs := []image.Image{testImage(32, 32), testImage8(16, 16), testImage(32, 32), testImage(32, 32)}
+	for _, opts := range []Options{
+		{},
+		{Password: "pw", Bits: 2},
+		{Compress: true, Filename: "big.bin"},
+	} {
+		c := Capacity(imgs[0], opts) + Capacity(imgs[1], opts) - 2*chunk_header_len
+		msg := testMessage(c + 10)
+		outs, err := EncodeSplit(imgs, msg, opts)
+		if err != nil {
+			t.Fatalf("EncodeSplit with %+v: %v", opts, err)
+		}
+		if !opts.Compress && len(outs) != 3 {
+			t.Errorf("EncodeSplit with %+v used %d images, want 3", opts, len(outs))
+		}
+
+		// The parts can be given in any order
+		shuffled := append([]image.Image{}, outs...)
+		slices.Reverse(shuffled)
+		got, err := DecodeJoin(shuffled, Options{Password: opts.Password})
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("DecodeJoin with %+v returned %d bytes, %v", opts, len(got), err)
+		}
+		if len(outs) > 1 {
+			if _, err := DecodeJoin(outs[1:], Options{Password: opts.Password}); !errors.Is(err, ErrChunkMissing) {
+				t.Errorf("DecodeJoin with %+v of all but the first part returned %v, want ErrChunkMissing", opts, err)
+			}
+		}
+	}
+
+	// Parts of two different messages, or an ordinary stego image
+	a, err := EncodeSplit(imgs, testMessage(10000), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeSplit(imgs, testMessage(10001), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Encode(imgs[0], testMessage(100), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, parts := range [][]image.Image{{a[0], b[1]}, {a[0], a[1], plain}} {
+		if _, err := DecodeJoin(parts, Options{}); !errors.Is(err, ErrNotSplit) {
+			t.Errorf("DecodeJoin of unrelated images returned %v, want ErrNotSplit", err)
+		}
+	}
+
+	if _, err := EncodeSplit(imgs, testMessage(100000), Options{}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("EncodeSplit of too big a message returned %v, want ErrInsufficientCapacity", err)
+	}
+}
+
+// TestFrames checks that a message spread over the frames of an animation
+// comes back, with the frames it did not need left alone.
+func TestFrames(t *testing.T) {
+	frames := []image.Image{testImage(32, 32), testImage(32, 32), testImage(32, 32), testImage(32, 32)}
+	msg := testMessage(Capacity(frames[0], Options{}) + 10)
+	outs, err := EncodeFrames(frames, msg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != len(frames) || outs[2] != frames[2] || outs[3] != frames[3] {
+		t.Fatalf("EncodeFrames of two frames' worth returned %d frames, changing the last two", len(outs))
+	}
+	if got, err := DecodeFrames(outs, Options{}); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("DecodeFrames returned %d bytes, %v", len(got), err)
+	}
+	if _, err := DecodeFrames(append([]image.Image{outs[0]}, outs[2:]...), Options{}); !errors.Is(err, ErrChunkMissing) {
+		t.Errorf("DecodeFrames without the second frame returned %v, want ErrChunkMissing", err)
+	}
+}
+
+func TestPSNR(t *testing.T) {
+	a := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	b := image.NewNRGBA64(image.Rect(5, 5, 6, 6))
+	if got := PSNR(a, b); !math.IsInf(got, 1) {
+		t.Errorf("PSNR of identical images is %v, want +Inf", got)
+	}
+	b.SetNRGBA64(5, 5, color.NRGBA64{R: 0xffff})
+	if got, want := PSNR(a, b), 10*math.Log10(4); math.Abs(got-want) > 1e-9 {
+		t.Errorf("PSNR with one value of four changed fully is %v, want %v", got, want)
+	}
+	if got := PSNR(a, image.NewNRGBA64(image.Rect(0, 0, 2, 1))); got != 0 {
+		t.Errorf("PSNR of images of different sizes is %v, want 0", got)
+	}
+
+	// Fewer bits alter the image less
+	img := testImage8(64, 48)
+	msg := testMessage(600)
+	last := 0.0
+	for _, bits := range []int{8, 4, 2, 1} {
+		out, err := Encode(img, msg, Options{Bits: bits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := PSNR(img, out)
+		if got <= last {
+			t.Errorf("PSNR with %d bits is %v, want more than %v with %d", bits, got, last, bits*2)
+		}
+		last = got
+	}
+}
+
+func TestChiSquareLSB(t *testing.T) {
+	// A carrier whose low bits favour even values, as a natural image's
+	// differ from one value to the next
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	r := rand.New(rand.NewPCG(3, 4))
+	for i := range img.Pix {
+		img.Pix[i] = byte(r.IntN(128)) * 2
+		if r.IntN(4) == 0 {
+			img.Pix[i]++
+		}
+	}
+	if got := ChiSquareLSB(img); got > 0.05 {
+		t.Errorf("ChiSquareLSB of the carrier is %v, want at most 0.05", got)
+	}
+
+	// Filling the low bits of blue alone is caught
+	opts := Options{KeepDepth: true, Bits: 1, Channels: ChannelsBlue}
+	out, err := Encode(img, testMessage(Capacity(img, opts)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ChiSquareLSB(out); got < 0.95 {
+		t.Errorf("ChiSquareLSB of the full stego image is %v, want at least 0.95", got)
+	}
+}
+
+func TestMaxPixels(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(100)
+	out, err := Encode(img, msg, Options{MaxPixels: 64 * 48})
+	if err != nil {
+		t.Fatalf("Encode of an image at the limit: %v", err)
+	}
+
+	opts := Options{MaxPixels: 64*48 - 1}
+	if _, err := Encode(img, msg, opts); !errors.Is(err, ErrCarrierTooLarge) {
+		t.Errorf("Encode of an image over the limit returned %v, want ErrCarrierTooLarge", err)
+	}
+	enc, err := NewEncoder(msg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Embed(img); !errors.Is(err, ErrCarrierTooLarge) {
+		t.Errorf("Embed in an image over the limit returned %v, want ErrCarrierTooLarge", err)
+	}
+	if _, err := Decode(out, opts); !errors.Is(err, ErrCarrierTooLarge) {
+		t.Errorf("Decode of an image over the limit returned %v, want ErrCarrierTooLarge", err)
+	}
+}
+
+func TestXOR(t *testing.T) {
+	img := testImage(64, 48)
+	msg := []byte("meet at 5 by the old mill, and bring the map")
+
+	// lowBytes returns the low byte of every colour value of an image encoded
+	// with 8 bits per value, where a plain message is there to read
+	lowBytes := func(out image.Image) []byte {
+		var b []byte
+		for i, v := range out.(*image.NRGBA64).Pix {
+			if i%2 == 1 {
+				b = append(b, v)
+			}
+		}
+		return b
+	}
+	plain, err := Encode(img, msg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(lowBytes(plain), msg) {
+		t.Fatal("plain message cannot be read from the low bytes")
+	}
+	if h, err := ReadHeader(plain); err != nil || h.Version != header_version {
+		t.Errorf("header of a message without XOR is version %d, %v; want %d", h.Version, err, header_version)
+	}
+
+	for _, opts := range []Options{
+		{XORKey: "k3y"},
+		{XORKey: "k3y", HMACKey: "mac", Bits: 2, Scatter: true, Password: "pw"},
+		{XORKey: "k3y", Compress: true, Pad: 200, Filename: "map.txt"},
+		{XORKey: "k3y", Matrix: 3, Bits: 1, HMACKey: "mac"},
+	} {
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		if got, err := Decode(out, opts); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v returned %q, %v", opts, got, err)
+		}
+		if h, err := ReadHeader(out); err != nil || h.ExtFlags&ExtFlagXOR == 0 {
+			t.Errorf("header with %+v has extension flags %#x, %v; want ExtFlagXOR", opts, h.ExtFlags, err)
+		}
+
+		no_key := opts
+		no_key.XORKey = ""
+		if _, err := Decode(out, no_key); !errors.Is(err, ErrXORKeyRequired) {
+			t.Errorf("Decode with %+v but no XOR key returned %v, want ErrXORKeyRequired", opts, err)
+		}
+		wrong := opts
+		wrong.XORKey = "key"
+		if got, err := Decode(out, wrong); err == nil {
+			t.Errorf("Decode with %+v but the wrong XOR key returned %q", opts, got)
+		}
+	}
+
+	out, err := Encode(img, msg, Options{XORKey: "k3y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(lowBytes(out), msg) {
+		t.Error("XORed message can be read from the low bytes")
+	}
+}
+
+// recordingWriter keeps each write made to it.
+type recordingWriter struct {
+	writes [][]byte
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.writes = append(rw.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+// TestDecodeBufferMultiple checks that a message filling a whole number of
+// buffers is written out exactly, with no empty write or lost byte at the end.
+func TestDecodeBufferMultiple(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(2048)
+	for _, size := range []int{1, 256, 1024} {
+		for _, n := range []int{size - 1, size, size + 1, 2 * size} {
+			if n == 0 {
+				continue
+			}
+			out, err := Encode(img, msg[:n], Options{Bits: 8})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw recordingWriter
+			if written, err := DecodeTo(out, &rw, Options{BufferSize: size}); err != nil || written != n {
+				t.Fatalf("DecodeTo of %d bytes with BufferSize %d wrote %d bytes, %v", n, size, written, err)
+			}
+			if want := (n + size - 1) / size; len(rw.writes) != want {
+				t.Errorf("DecodeTo of %d bytes with BufferSize %d made %d writes, want %d", n, size, len(rw.writes), want)
+			}
+			for i, w := range rw.writes {
+				if len(w) == 0 || len(w) > size {
+					t.Errorf("DecodeTo of %d bytes with BufferSize %d wrote %d bytes in write %d", n, size, len(w), i)
+				}
+			}
+			if got := bytes.Join(rw.writes, nil); !bytes.Equal(got, msg[:n]) {
+				t.Errorf("DecodeTo of %d bytes with BufferSize %d gave %d bytes that differ", n, size, len(got))
+			}
+		}
+	}
+}
+
+func TestDecoy(t *testing.T) {
+	decoy := []byte("shopping: milk, eggs")
+	msg := testMessage(500)
+	for _, opts := range []Options{
+		{Password: "decoy", Bits: 2, Compress: true, Filename: "list.txt"},
+		{Password: "decoy", Mode: ModeSpread, Pad: 100},
+		{Password: "decoy", Match: true},
+	} {
+		out, err := EncodeDecoy(testImage(64, 48), decoy, msg, "real", opts)
+		if err != nil {
+			t.Fatalf("EncodeDecoy with %+v: %v", opts, err)
+		}
+		if got, err := Decode(out, Options{Password: "decoy"}); err != nil || !bytes.Equal(got, decoy) {
+			t.Errorf("Decode with the decoy password, after %+v, returned %q, %v", opts, got, err)
+		}
+		if got, err := Decode(out, Options{Password: "real"}); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode with the message password, after %+v, returned %d bytes, %v", opts, len(got), err)
+		}
+		if _, err := Decode(out, Options{Password: "wrong"}); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Decode with the wrong password, after %+v, returned %v, want ErrDecrypt", opts, err)
+		}
+	}
+
+	// Without a message, the pixels after the decoy are changed just the same
+	img := testImage(64, 48)
+	with, err := EncodeDecoy(img, decoy, msg, "real", Options{Password: "decoy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := EncodeDecoy(img, decoy, nil, "real", Options{Password: "decoy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := changedValues(img, with), changedValues(img, without); b < a*9/10 {
+		t.Errorf("an empty message changed %d values, against %d for one of 500 bytes", b, a)
+	}
+	if got, err := Decode(without, Options{Password: "real"}); err != nil || len(got) != 0 {
+		t.Errorf("Decode of an empty hidden message returned %q, %v", got, err)
+	}
+
+	for _, opts := range []Options{
+		{},
+		{Password: "real"},
+		{Password: "decoy", Scatter: true},
+		{Password: "decoy", HMACKey: "mac"},
+	} {
+		if _, err := EncodeDecoy(img, decoy, msg, "real", opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("EncodeDecoy with %+v returned %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+	if _, err := EncodeDecoy(img, decoy, testMessage(20000), "real", Options{Password: "decoy"}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("EncodeDecoy of a message too big returned %v, want ErrInsufficientCapacity", err)
+	}
+}
+
+// TestOutputModel checks that the output image is of the carrier's colour
+// model, at 8 bits per value only when the message is kept in those.
+func TestOutputModel(t *testing.T) {
+	rect := image.Rect(0, 0, 32, 32)
+	gray8, gray16 := image.NewGray(rect), image.NewGray16(rect)
+	for _, tc := range []struct {
+		img  image.Image
+		opts Options
+		want color.Model
+	}{
+		{testImage8(32, 32), Options{KeepDepth: true}, color.NRGBAModel},
+		{image.NewRGBA(rect), Options{KeepDepth: true, Bits: 2}, color.NRGBAModel},
+		{testImage(32, 32), Options{KeepDepth: true}, color.NRGBA64Model},
+		{gray8, Options{KeepDepth: true}, color.GrayModel},
+		{gray16, Options{}, color.Gray16Model},
+		{testImage8(32, 32), Options{}, color.NRGBA64Model},
+		{gray8, Options{}, color.Gray16Model},
+	} {
+		out, err := Encode(tc.img, []byte("meet at 5"), tc.opts)
+		if err != nil {
+			t.Fatalf("Encode of a %T with %+v: %v", tc.img, tc.opts, err)
+		}
+		if out.ColorModel() != tc.want {
+			t.Errorf("Encode of a %T with %+v gave a %T", tc.img, tc.opts, out)
+		}
+	}
+}
+
+// TestColourAt checks that reading the pixels of the common image types
+// directly gives the colours the generic conversion does.
+func TestColourAt(t *testing.T) {
+	rect := image.Rect(3, 5, 11, 9)
+	r := rand.New(rand.NewPCG(5, 6))
+	imgs := []draw.Image{image.NewNRGBA(rect), image.NewNRGBA64(rect), image.NewGray(rect), image.NewGray16(rect)}
+	for _, img := range imgs {
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				img.Set(x, y, color.NRGBA64{uint16(r.Uint32()), uint16(r.Uint32()), uint16(r.Uint32()), uint16(r.Uint32())})
+			}
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				want := [4]uint32{uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)}
+				if nc, ok := img.At(x, y).(color.NRGBA); ok {
+					want = [4]uint32{uint32(nc.R) * 0x101, uint32(nc.G) * 0x101, uint32(nc.B) * 0x101, uint32(nc.A) * 0x101}
+				}
+				if got := colourAt(img, image.Pt(x, y)); got != want {
+					t.Fatalf("colourAt of a %T at (%d, %d) is %v, want %v", img, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// moveToOrigin returns a copy of img, of the same type if it is one of the
+// common ones, with its bounds moved to start at (0, 0).
+func moveToOrigin(img image.Image) draw.Image {
+	rect := image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+	var moved draw.Image
+	switch img.(type) {
+	case *image.NRGBA:
+		moved = image.NewNRGBA(rect)
+	case *image.Gray:
+		moved = image.NewGray(rect)
+	case *image.RGBA:
+		moved = image.NewRGBA(rect)
+	default:
+		moved = image.NewNRGBA64(rect)
+	}
+	draw.Draw(moved, rect, img, img.Bounds().Min, draw.Src)
+	return moved
+}
+
+// TestOffsetBounds checks that a carrier whose bounds do not start at (0, 0),
+// such as a cropped sub-image, is used just as the same image at (0, 0) is:
+// from its top left pixel, wherever that is, so the message decodes wherever
+// the image is moved to.
+func TestOffsetBounds(t *testing.T) {
+	crop := image.Rect(7, 5, 71, 53)
+	big8 := testImage8(80, 60)
+	rgba := image.NewRGBA(big8.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), big8, image.Point{}, draw.Src)
+	gray := image.NewGray(big8.Bounds())
+	draw.Draw(gray, gray.Bounds(), big8, image.Point{}, draw.Src)
+	carriers := []image.Image{
+		testImage(80, 60).SubImage(crop),
+		big8.SubImage(crop),
+		rgba.SubImage(crop),
+		gray.SubImage(crop),
+	}
+	msg := testMessage(300)
+
+	for _, tc := range []struct {
+		carrier image.Image
+		opts    Options
+	}{
+		{carriers[0], Options{}},
+		{carriers[0], Options{Bits: 2, Mode: ModeSpread}},
+		{carriers[0], Options{Password: "pw", Scatter: true}},
+		{carriers[0], Options{Stride: 3}},
+		{carriers[0], Options{Rect: image.Rect(10, 20, 50, 40)}},
+		{carriers[0], Options{Slots: 3, Slot: 2}},
+		{carriers[0], Options{Matrix: 3}},
+		{carriers[0], Options{MinAlpha: 128}},
+		{carriers[0], Options{Channels: ChannelsRGB, Opaque: true}},
+		{carriers[1], Options{}},
+		{carriers[1], Options{KeepDepth: true, Bits: 4}},
+		{carriers[2], Options{KeepDepth: true, Bits: 2}},
+		{carriers[3], Options{Bits: 4}},
+		{carriers[3], Options{KeepDepth: true, Bits: 4}},
+	} {
+		name := fmt.Sprintf("%T with %+v", tc.carrier, tc.opts)
+		moved := moveToOrigin(tc.carrier)
+		if got, want := Capacity(tc.carrier, tc.opts), Capacity(moved, tc.opts); got != want {
+			t.Errorf("Capacity of a %s is %d, want %d", name, got, want)
+		}
+		out, err := Encode(tc.carrier, msg, tc.opts)
+		if err != nil {
+			t.Fatalf("Encode of a %s: %v", name, err)
+		}
+		if out.Bounds() != crop {
+			t.Errorf("Encode of a %s gave bounds %v, want %v", name, out.Bounds(), crop)
+		}
+		if got, err := Decode(out, tc.opts); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode of a %s gave %d bytes, %v", name, len(got), err)
+		}
+
+		// The same pixels change as in the image moved to (0, 0)
+		if tc.opts.Password == "" {
+			want, err := Encode(moved, msg, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range crop.Dx() * crop.Dy() {
+				if g, w := colourAt(out, pixelPoint(crop, i)), colourAt(want, pixelPoint(want.Bounds(), i)); g != w {
+					t.Fatalf("Encode of a %s gave %v at pixel %d, want %v", name, g, i, w)
+				}
+			}
+		}
+
+		// And the message decodes once the output is moved
+		if got, err := Decode(moveToOrigin(out), tc.opts); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode of a moved %s gave %d bytes, %v", name, len(got), err)
+		}
+	}
+
+	// Measures of the output do not depend on where it is
+	out, err := Encode(carriers[0], msg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := PSNR(carriers[0], out), PSNR(moveToOrigin(carriers[0]), moveToOrigin(out)); got != want {
+		t.Errorf("PSNR of a sub-image is %v, want %v", got, want)
+	}
+	if got, want := ChiSquareLSB(out), ChiSquareLSB(moveToOrigin(out)); got != want {
+		t.Errorf("ChiSquareLSB of a sub-image is %v, want %v", got, want)
+	}
+}
+
+// TestDiff checks that Diff marks exactly the pixels a message changed.
+func TestDiff(t *testing.T) {
+	img := testImage(64, 48)
+	out, err := Encode(img, []byte("meet at 5"), Options{Stride: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, n, err := Diff(img, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for i := range 64 * 48 {
+		p := pixelPoint(img.Bounds(), i)
+		changed := colourAt(img, p) != colourAt(out, p)
+		if changed {
+			want++
+		}
+		if marked := d.NRGBAAt(p.X, p.Y) == diff_colour; marked != changed {
+			t.Fatalf("Diff marked pixel %v as changed %v, want %v", p, marked, changed)
+		}
+	}
+	if n != want || n == 0 {
+		t.Errorf("Diff found %d pixels changed, want %d", n, want)
+	}
+
+	if _, n, err := Diff(img, img); err != nil || n != 0 {
+		t.Errorf("Diff of an image with itself found %d pixels, %v", n, err)
+	}
+	if _, _, err := Diff(img, testImage(48, 64)); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Diff of images of different sizes returned %v, want ErrSizeMismatch", err)
+	}
+}
+
+// TestFiles checks that a set of files hidden together comes back as it was.
+func TestFiles(t *testing.T) {
+	img := testImage(64, 48)
+	files := []File{
+		{Name: "notes.txt", Data: []byte("meet at 5")},
+		{Name: "empty", Data: nil},
+		{Name: "data.bin", Data: testMessage(2000)},
+	}
+	for _, opts := range []Options{{}, {Password: "pw", Compress: true}, {XORKey: "k", Slots: 2, Slot: 1}} {
+		out, err := EncodeFiles(img, files, opts)
+		if err != nil {
+			t.Fatalf("EncodeFiles with %+v: %v", opts, err)
+		}
+		got, err := DecodeFiles(out, opts)
+		if err != nil {
+			t.Fatalf("DecodeFiles with %+v: %v", opts, err)
+		}
+		if len(got) != len(files) {
+			t.Fatalf("DecodeFiles with %+v gave %d files, want %d", opts, len(got), len(files))
+		}
+		for i, f := range got {
+			if f.Name != files[i].Name || !bytes.Equal(f.Data, files[i].Data) {
+				t.Errorf("DecodeFiles with %+v gave file %d as %s of %d bytes, want %s of %d", opts, i, f.Name, len(f.Data), files[i].Name, len(files[i].Data))
+			}
+		}
+		list, err := ListFiles(out, opts)
+		if err != nil {
+			t.Fatalf("ListFiles with %+v: %v", opts, err)
+		}
+		if len(list) != len(files) {
+			t.Fatalf("ListFiles with %+v gave %d files, want %d", opts, len(list), len(files))
+		}
+		for i, f := range list {
+			if f.Name != files[i].Name || f.Size != len(files[i].Data) {
+				t.Errorf("ListFiles with %+v gave file %d as %s of %d bytes, want %s of %d", opts, i, f.Name, f.Size, files[i].Name, len(files[i].Data))
+			}
+		}
+	}
+
+	// Listing reads only the manifest, so damage to the contents goes unseen
+	out, err := EncodeFiles(img, files, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := image.NewNRGBA64(out.Bounds())
+	draw.Draw(damaged, damaged.Bounds(), out, image.Point{}, draw.Src)
+	damaged.Pix[8*400+1] ^= 1 // the low byte of R in a pixel of data.bin
+	if _, err := DecodeFiles(damaged, Options{}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("DecodeFiles of damaged contents returned %v, want ErrChecksumMismatch", err)
+	}
+	if list, err := ListFiles(damaged, Options{}); err != nil || len(list) != len(files) {
+		t.Errorf("ListFiles of damaged contents gave %d files, %v", len(list), err)
+	}
+
+	// A plain message is not a set of files, even if it looks like one
+	msg, err := bundleFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = Encode(img, msg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeFiles(out, Options{}); !errors.Is(err, ErrNotFiles) {
+		t.Errorf("DecodeFiles of a plain message returned %v, want ErrNotFiles", err)
+	}
+	if _, err := ListFiles(out, Options{}); !errors.Is(err, ErrNotFiles) {
+		t.Errorf("ListFiles of a plain message returned %v, want ErrNotFiles", err)
+	}
+	for _, n := range []int{0, 1, 10, len(msg) - 1} {
+		if _, err := unbundleFiles(msg[:n]); !errors.Is(err, ErrNotFiles) {
+			t.Errorf("unbundleFiles of %d of the %d bytes returned %v, want ErrNotFiles", n, len(msg), err)
+		}
+	}
+
+	for _, bad := range [][]File{
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: ""}},
+		{{Name: strings.Repeat("x", 256)}},
+	} {
+		if _, err := EncodeFiles(img, bad, Options{}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("EncodeFiles of %d files returned %v, want ErrInvalidOptions", len(bad), err)
+		}
+	}
+	if _, err := EncodeFiles(img, files, Options{Filename: "x"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("EncodeFiles with a Filename returned %v, want ErrInvalidOptions", err)
+	}
+}
+
+// TestReproducible checks that encoding the same message twice gives the same
+// PNG, byte for byte, without randomness or with the same Rand.
+func TestReproducible(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(1000)
+	encodePNG := func(opts Options) []byte {
+		t.Helper()
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		var b bytes.Buffer
+		if err := png.Encode(&b, out); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	seeded := func(seed byte) io.Reader {
+		return rand.NewChaCha8([32]byte{seed})
+	}
+
+	for _, opts := range []Options{
+		{},
+		{Compress: true, KeepDepth: true, Bits: 2},
+		{Pad: 2000, Rand: seeded(1)},
+		{Password: "pw", Scatter: true, Pad: 2000, Rand: seeded(1)},
+	} {
+		a := encodePNG(opts)
+		if opts.Rand != nil {
+			opts.Rand = seeded(1)
+		}
+		if b := encodePNG(opts); !bytes.Equal(a, b) {
+			t.Errorf("encoding twice with %+v gave different images", opts)
+		}
+	}
+
+	// A different seed gives a different image, which still decodes
+	opts := Options{Password: "pw", Scatter: true, Rand: seeded(1)}
+	a := encodePNG(opts)
+	opts.Rand = seeded(2)
+	if bytes.Equal(a, encodePNG(opts)) {
+		t.Error("encoding with different seeds gave the same image")
+	}
+	opts.Rand = seeded(2)
+	out, err := Encode(img, msg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Decode(out, Options{Password: "pw"}); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("Decode of a seeded image gave %d bytes, %v", len(got), err)
+	}
+}
+
+// TestInterleave checks that an interleaved message round trips, and that a
+// short one goes in the red values of a whole row.
+func TestInterleave(t *testing.T) {
+	img := testImage(64, 48)
+	for _, opts := range []Options{
+		{Interleave: true},
+		{Interleave: true, Bits: 1, Channels: ChannelsRGB},
+		{Interleave: true, Bits: 2, Pad: 2500, Password: "pw"},
+		{Interleave: true, KeepDepth: true, Bits: 4, Slots: 2, Slot: 1, XORKey: "k"},
+	} {
+		for _, n := range []int{0, 1, 7, 101, 1000} {
+			msg := testMessage(n)
+			out, err := Encode(img, msg, opts)
+			if err != nil {
+				t.Fatalf("Encode of %d bytes with %+v: %v", n, opts, err)
+			}
+			if got, err := Decode(out, Options{Password: opts.Password, XORKey: opts.XORKey, Slots: opts.Slots, Slot: opts.Slot}); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("Decode of %d bytes with %+v gave %d bytes, %v", n, opts, len(got), err)
+			}
+			if want, err := PixelsUsed(out, opts); err != nil || want == 0 {
+				t.Errorf("PixelsUsed of %d bytes with %+v is %d, %v", n, opts, want, err)
+			}
+		}
+	}
+
+	// A message that fits in the red values of the first row, at 8 bits per
+	// value, changes only those
+	opts := Options{Interleave: true, Bits: 8}
+	h := newHeader(layout{bits: 8, channels: rgba_channels, interleave: true})
+	body := bodyRegion(slotRegion(img.Bounds(), 0, 1), h.layout(), h.size())
+	out, err := Encode(img, testMessage(64-body.start), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := 0
+	for i := body.start; i < 2*64; i++ {
+		a, b := colourAt(img, pixelPoint(img.Bounds(), i)), colourAt(out, pixelPoint(img.Bounds(), i))
+		for ch := range a {
+			if a[ch] == b[ch] {
+				continue
+			}
+			if ch != 0 || i >= 64 {
+				t.Fatalf("interleaving changed colour value %d of pixel %d", ch, i)
+			}
+			red++
+		}
+	}
+	if red < (64-body.start)/2 {
+		t.Errorf("interleaving changed the red of only %d pixels of the first row", red)
+	}
+
+	for _, opts := range []Options{
+		{Interleave: true, Mode: ModeSpread},
+		{Interleave: true, Matrix: 3},
+		{Interleave: true, Stride: 2},
+		{Interleave: true, Scatter: true, Password: "pw"},
+	} {
+		if _, err := Encode(img, []byte("x"), opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Encode with %+v returned %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	img := testImage(64, 48)
+	when := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	msg := testMessage(100)
+	for _, opts := range []Options{
+		{Time: when, Comment: "batch 2024"},
+		{Time: when},
+		{Comment: "batch 2024", Filename: "hide.txt", Password: "pw", HMACKey: "k"},
+		{Comment: strings.Repeat("c", max_comment_len), Filename: "hide.txt", XORKey: "x"},
+	} {
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		h, err := ReadHeader(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want uint64
+		if !opts.Time.IsZero() {
+			want = uint64(when.Unix())
+		}
+		if h.Time != want || h.Comment != opts.Comment || h.Filename != opts.Filename || h.Version != header_version_ext {
+			t.Errorf("header of %+v has time %d, comment %q, file name %q, version %d", opts, h.Time, h.Comment, h.Filename, h.Version)
+		}
+		if got, err := Decode(out, Options{Password: opts.Password, HMACKey: opts.HMACKey, XORKey: opts.XORKey}); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v gave %d bytes, %v", opts, len(got), err)
+		}
+	}
+
+	// The metadata takes its room from the capacity
+	if got, plain := Capacity(img, Options{Comment: "abc"}), Capacity(img, Options{}); got >= plain {
+		t.Errorf("Capacity with a comment is %d, not less than the %d without", got, plain)
+	}
+
+	for _, opts := range []Options{
+		{Comment: strings.Repeat("c", max_comment_len+1)},
+		{Time: time.Unix(-1, 0)},
+	} {
+		if _, err := Encode(img, msg, opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Encode with time %v and a %d byte comment returned %v, want ErrInvalidOptions", opts.Time, len(opts.Comment), err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(200)
+	for _, opts := range []Options{
+		{Match: true},
+		{Match: true, Bits: 1, KeepDepth: true},
+		{Match: true, Plane: 3, Channels: ChannelsRGB},
+		{Match: true, Password: "pw", Scatter: true},
+		{Match: true, Matrix: 3},
+		{Match: true, Interleave: true, Pad: 300},
+	} {
+		out, err := Encode(img, msg, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		if got, err := Decode(out, Options{Password: opts.Password}); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Decode with %+v gave %d bytes, %v", opts, len(got), err)
+		}
+		if h, err := ReadHeader(out); err != nil || h.ExtFlags&ExtFlagMatch == 0 {
+			t.Errorf("header of a message hidden with %+v has extension flags %#02x, %v; want LSB matching recorded", opts, h.ExtFlags, err)
+		}
+	}
+	if plain, err := Encode(img, msg, Options{}); err != nil {
+		t.Fatal(err)
+	} else if h, err := ReadHeader(plain); err != nil || h.ExtFlags&ExtFlagMatch != 0 {
+		t.Errorf("header of a message hidden without Match has extension flags %#02x, %v", h.ExtFlags, err)
+	}
+
+	// Each value changed moves by 1, and some that needed their low bit cleared
+	// went up rather than down, as replacement never would
+	out, err := Encode(img, msg, Options{Match: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ReadHeader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bodyRegion(slotRegion(img.Bounds(), 0, 1), h.layout(), h.size())
+	up := 0
+	for i := body.start; i < body.end; i++ {
+		a, b := colourAt(img, pixelPoint(img.Bounds(), i)), colourAt(out, pixelPoint(img.Bounds(), i))
+		for ch := range a {
+			switch {
+			case a[ch] == b[ch]:
+			case a[ch]+1 == b[ch]:
+				if a[ch]&1 != 0 {
+					up++
+				}
+			case a[ch] != b[ch]+1:
+				t.Fatalf("LSB matching changed colour value %d of pixel %d from %d to %d", ch, i, a[ch], b[ch])
+			}
+		}
+	}
+	if up == 0 {
+		t.Error("LSB matching never moved an odd value up")
+	}
+
+	// Values at the ends of the range move inwards
+	l := layout{bits: 1, channels: rgba_channels, match: true}
+	got := l.matchValues([4]uint32{0, 0xffff, 7, 8}, [4]uint32{1, 0xfffe, 6, 8}, l.matcher(0))
+	if got[0] != 1 || got[1] != 0xfffe || got[2] != 6 && got[2] != 8 || got[3] != 8 {
+		t.Errorf("matchValues gave %v", got)
+	}
+
+	// The random choices come from Rand, whatever the number of bands
+	procs := []int{1, 2, 3, 4, 8}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	seeded := make([]image.Image, len(procs))
+	for i, n := range procs {
+		runtime.GOMAXPROCS(n)
+		if seeded[i], err = Encode(img, msg, Options{Match: true, Rand: rand.NewChaCha8([32]byte{1})}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(seeded[0], seeded[i]) {
+			t.Errorf("Encode with the same Rand gave different images with GOMAXPROCS %d and %d", procs[0], n)
+		}
+	}
+
+	for _, opts := range []Options{
+		{Match: true, Bits: 2},
+		{Match: true, Mode: ModeSpread},
+		{Match: true, MinAlpha: 10},
+	} {
+		if _, err := Encode(img, msg, opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Encode with %+v returned %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	img := testImage(64, 48)
+	for _, opts := range []Options{
+		{},
+		{Bits: 1, KeepDepth: true},
+		{Mode: ModeSpread},
+		{Stride: 5},
+		{Rect: image.Rect(10, 10, 30, 30)},
+		{MinAlpha: 10},
+		{Matrix: 3},
+		{Interleave: true},
+		{Match: true},
+		{Slots: 3, Slot: 2},
+		{Compress: true},
+		{Password: "pw", Scatter: true},
+		{HMACKey: "k", XORKey: "x", Pad: 20},
+	} {
+		for _, msg := range [][]byte{nil, {}} {
+			out, err := Encode(img, msg, opts)
+			if err != nil {
+				t.Fatalf("Encode of an empty message with %+v: %v", opts, err)
+			}
+			dopts := Options{Password: opts.Password, HMACKey: opts.HMACKey, XORKey: opts.XORKey, Slots: opts.Slots, Slot: opts.Slot}
+			if got, err := Decode(out, dopts); err != nil || len(got) != 0 {
+				t.Errorf("Decode of an empty message with %+v returned %q, %v", opts, got, err)
+			}
+			var w bytes.Buffer
+			if n, err := DecodeTo(out, &w, dopts); err != nil || n != 0 || w.Len() != 0 {
+				t.Errorf("DecodeTo of an empty message with %+v wrote %d bytes (%d returned), %v", opts, w.Len(), n, err)
+			}
+		}
+	}
+
+	// A plain empty message changes nothing past the header
+	out, err := Encode(img, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHeader(layout{bits: 8, channels: rgba_channels})
+	body := bodyRegion(slotRegion(img.Bounds(), 0, 1), h.layout(), h.size())
+	for i := body.start; i < body.end; i++ {
+		if p := pixelPoint(img.Bounds(), i); colourAt(img, p) != colourAt(out, p) {
+			t.Fatalf("an empty message changed pixel %d", i)
+		}
+	}
+}
+
+func TestNewCover(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{Bits: 1, KeepDepth: true},
+		{Mode: ModeSpread, Channels: ChannelsRGB},
+		{Filename: "hide.txt", HMACKey: "k"},
+		{Matrix: 4, Stride: 3},
+		{Interleave: true, Bits: 2},
+		{Slots: 3, Slot: 1, Channels: ChannelsBlue},
+		{Password: "pw", Pad: 6000, Filename: "hide.txt"},
+		StealthOptions("pw"),
+	} {
+		for _, n := range []int{0, 100, 5000} {
+			img, err := NewCover(n, opts)
+			if err != nil {
+				t.Fatalf("NewCover of %d bytes with %+v: %v", n, opts, err)
+			}
+			msg := testMessage(n)
+			out, err := Encode(img, msg, opts)
+			if err != nil {
+				t.Fatalf("Encode of %d bytes in a %v cover with %+v: %v", n, img.Bounds(), opts, err)
+			}
+			if got, err := Decode(out, Options{Password: opts.Password, HMACKey: opts.HMACKey, Slots: opts.Slots, Slot: opts.Slot}); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("Decode of %d bytes with %+v gave %d bytes, %v", n, opts, len(got), err)
+			}
+
+			// A row less would not do (which is the same with a password, and
+			// slow to show)
+			b := img.Bounds()
+			if b.Dy() > 1 && opts.Password == "" {
+				if _, err := Encode(img.SubImage(image.Rect(0, 0, b.Dx(), b.Dy()-1)), msg, opts); !errors.Is(err, ErrInsufficientCapacity) {
+					t.Errorf("%d bytes with %+v fit in a row less than the %v cover: %v", n, opts, b, err)
+				}
+			}
+		}
+	}
+
+	// A cover is noise, opaque, and from Rand if given
+	a, err := NewCover(1000, Options{Rand: rand.NewChaCha8([32]byte{1})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewCover(1000, Options{Rand: rand.NewChaCha8([32]byte{1})})
+	if err != nil || !reflect.DeepEqual(a, b) {
+		t.Errorf("NewCover with the same Rand gave different images, %v", err)
+	}
+	if c, _ := NewCover(1000, Options{}); reflect.DeepEqual(a, c) {
+		t.Error("NewCover without Rand gave the same image as with it")
+	}
+	for i := 3; i < len(a.Pix); i += 4 {
+		if a.Pix[i] != 0xff {
+			t.Fatalf("cover pixel %d has alpha %d", i/4, a.Pix[i])
+		}
+	}
+
+	// Even an empty message needs room for the header
+	if _, err := Encode(testImage(2, 2), nil, Options{}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Encode in an image too small for the header returned %v, want ErrInsufficientCapacity", err)
+	}
+
+	if _, err := NewCover(10, Options{Rect: image.Rect(0, 0, 4, 4)}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("NewCover with a rectangle returned %v, want ErrInvalidOptions", err)
+	}
+	if _, err := NewCover(10, Options{MinAlpha: 100}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("NewCover with a minimum alpha returned %v, want ErrInvalidOptions", err)
+	}
+	if _, err := NewCover(10, Options{Bits: 3}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("NewCover with 3 bits returned %v, want ErrInvalidOptions", err)
+	}
+	if _, err := NewCover(math.MaxInt32, StealthOptions("pw")); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("NewCover of 2 GiB returned %v, want ErrInsufficientCapacity", err)
+	}
+}
+
+func TestChannelBits(t *testing.T) {
+	img := testImage(64, 48)
+
+	img8 := image.NewNRGBA(img.Bounds())
+	draw.Draw(img8, img8.Bounds(), img, image.Point{}, draw.Src)
+
+	// Alpha fading in from the left, for MinAlpha
+	faded := testImage(64, 48)
+	for y := range 48 {
+		for x := range 64 {
+			c := faded.NRGBA64At(x, y)
+			c.A = uint16(x * 0xffff / 63)
+			faded.SetNRGBA64(x, y, c)
+		}
+	}
+
+	for _, tc := range []struct {
+		img  image.Image
+		opts Options
+	}{
+		{img, Options{ChannelBits: [4]int{1, 1, 2, 0}}},
+		{img, Options{ChannelBits: [4]int{0, 0, 4, 0}}},
+		{img, Options{ChannelBits: [4]int{1, 2, 4, 8}}},
+		{img, Options{ChannelBits: [4]int{2, 1, 4, 0}, Plane: 2}},
+		{img8, Options{ChannelBits: [4]int{1, 1, 2, 0}, KeepDepth: true}},
+		{img, Options{ChannelBits: [4]int{2, 1, 1, 0}, Password: "pw", Scatter: true}},
+		{img, Options{ChannelBits: [4]int{1, 2, 0, 4}, Stride: 3, Slots: 2, Slot: 1}},
+		{img, Options{ChannelBits: [4]int{0, 1, 2, 0}, Rect: image.Rect(8, 8, 40, 40), Opaque: true}},
+		{faded, Options{ChannelBits: [4]int{1, 1, 2, 2}, MinAlpha: 128}},
+	} {
+		opts := tc.opts
+		for _, n := range []int{0, 1, 7, 300, Capacity(tc.img, opts)} {
+			msg := testMessage(n)
+			out, err := Encode(tc.img, msg, opts)
+			if err != nil {
+				t.Fatalf("Encode of %d bytes with %+v: %v", n, opts, err)
+			}
+			if got, err := Decode(out, Options{Password: opts.Password, Slots: opts.Slots, Slot: opts.Slot}); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("Decode of %d bytes with %+v gave %d bytes, %v", n, opts, len(got), err)
+			}
+		}
+		if _, err := Encode(tc.img, testMessage(Capacity(tc.img, opts)+1), opts); !errors.Is(err, ErrInsufficientCapacity) {
+			t.Errorf("Encode of more than the capacity with %+v returned %v", opts, err)
+		}
+	}
+
+	// Only the bits chosen of each channel change, and the header records them
+	opts := Options{ChannelBits: [4]int{0, 1, 2, 0}}
+	out, err := Encode(img, testMessage(500), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ReadHeader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ChannelBits != [4]uint8{0, 1, 2, 0} || h.Bits != 2 || h.ExtFlags&ExtFlagChannelBits == 0 {
+		t.Errorf("header has bits %v for each channel, and %d", h.ChannelBits, h.Bits)
+	}
+	body := bodyRegion(slotRegion(img.Bounds(), 0, 1), h.layout(), h.size())
+	for i := body.start; i < body.end; i++ {
+		a, b := colourAt(img, pixelPoint(img.Bounds(), i)), colourAt(out, pixelPoint(img.Bounds(), i))
+		for ch, bits := range opts.ChannelBits {
+			if a[ch]>>bits != b[ch]>>bits {
+				t.Fatalf("colour value %d of pixel %d changed from %#x to %#x, beyond its %d bits", ch, i, a[ch], b[ch], bits)
+			}
+		}
+	}
+	if got, want := Capacity(img, opts), Capacity(img, Options{Bits: 1, Channels: ChannelsRGB}); got < want-2 || got > want {
+		t.Errorf("Capacity with 3 bits a pixel is %d, want about %d", got, want)
+	}
+
+	for _, opts := range []Options{
+		{ChannelBits: [4]int{3, 0, 0, 0}},
+		{ChannelBits: [4]int{1, 1, 1, 0}, Bits: 2},
+		{ChannelBits: [4]int{1, 1, 1, 0}, Channels: ChannelsBlue},
+		{ChannelBits: [4]int{1, 1, 1, 0}, Mode: ModeSpread},
+		{ChannelBits: [4]int{1, 1, 1, 0}, Matrix: 3},
+		{ChannelBits: [4]int{1, 1, 1, 0}, Interleave: true},
+		{ChannelBits: [4]int{1, 1, 1, 1}, Opaque: true},
+	} {
+		if _, err := Encode(img, []byte("x"), opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Encode with %+v returned %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+	if _, err := Encode(image.NewNRGBA(img.Bounds()), []byte("x"), Options{ChannelBits: [4]int{8, 1, 1, 0}, KeepDepth: true}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Encode in an 8 bit image kept at 8 bits with 8 bits of red returned %v, want ErrInvalidOptions", err)
+	}
+	if _, err := Encode(image.NewGray(img.Bounds()), []byte("x"), Options{ChannelBits: [4]int{1, 1, 1, 0}}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Encode in a grayscale image with bits for each channel returned %v, want ErrInvalidOptions", err)
+	}
+}
+
+func TestECC(t *testing.T) {
+	img := testImage(64, 48)
+	msg := testMessage(1000)
+	for _, opts := range []Options{
+		{ECC: 32},
+		{ECC: 2, Bits: 2},
+		{ECC: 16, Password: "pw", Compress: true, Filename: "f.bin"},
+		{ECC: 8, XORKey: "k", Matrix: 3, Bits: 1},
+		{ECC: 20, Interleave: true, Pad: 2000},
+	} {
+		m := testMessage(min(Capacity(img, opts)/2, 1500))
+		out, err := Encode(img, m, opts)
+		if err != nil {
+			t.Fatalf("Encode with %+v: %v", opts, err)
+		}
+		if got, err := Decode(out, Options{Password: opts.Password, XORKey: opts.XORKey}); err != nil || !bytes.Equal(got, m) {
+			t.Errorf("Decode with %+v gave %d bytes, %v", opts, len(got), err)
+		}
+		if got, err := Decode(out, Options{Password: opts.Password, XORKey: opts.XORKey, Strict: true}); err != nil || !bytes.Equal(got, m) {
+			t.Errorf("strict Decode with %+v gave %d bytes, %v", opts, len(got), err)
+		}
+	}
+
+	// A few damaged pixels are put right, unless there are too many in a block
+	damage := func(out image.Image, pixels ...int) image.Image {
+		d := image.NewNRGBA64(out.Bounds())
+		draw.Draw(d, d.Bounds(), out, image.Point{}, draw.Src)
+		for _, p := range pixels {
+			for ch := range 4 {
+				d.Pix[8*p+2*ch+1] ^= 0x5a
+			}
+		}
+		return d
+	}
+	plain, err := Encode(img, msg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(damage(plain, 30, 31, 32), Options{}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Decode of damaged pixels without ECC returned %v, want ErrChecksumMismatch", err)
+	}
+	out, err := Encode(img, msg, Options{ECC: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Decode(damage(out, 30, 31, 32, 150, 250), Options{}); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("Decode of damaged pixels with ECC gave %d bytes, %v", len(got), err)
+	}
+	if _, err := Decode(damage(out, 250), Options{Strict: true}); !errors.Is(err, ErrDamaged) {
+		t.Errorf("strict Decode of a damaged pixel with ECC returned %v, want ErrDamaged", err)
+	}
+	if _, err := Decode(damage(out, 30, 31, 32, 33, 34), Options{}); !errors.Is(err, ErrUncorrectable) {
+		t.Errorf("Decode of too many damaged pixels returned %v, want ErrUncorrectable", err)
+	}
+
+	// Capacity allows for the parity bytes
+	n := Capacity(img, Options{ECC: 32})
+	if n >= Capacity(img, Options{}) {
+		t.Errorf("Capacity with ECC is %d, no less than without", n)
+	}
+	if _, err := Encode(img, testMessage(n), Options{ECC: 32}); err != nil {
+		t.Errorf("Encode of %d bytes, the capacity with ECC: %v", n, err)
+	}
+	if _, err := Encode(img, testMessage(n+1), Options{ECC: 32}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Encode of %d bytes, past the capacity with ECC, returned %v", n+1, err)
+	}
+
+	cover, err := NewCover(n, Options{ECC: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encode(cover, testMessage(n), Options{ECC: 32}); err != nil {
+		t.Errorf("Encode of %d bytes in a cover made for them with ECC: %v", n, err)
+	}
+
+	for _, opts := range []Options{{ECC: 1}, {ECC: 255}, {ECC: -1}, {ECC: 8, HMACKey: "k"}} {
+		if _, err := Encode(img, msg[:10], opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Encode with %+v returned %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+
+	// Any ecc/2 damaged bytes of each block are put right, with the last
+	// block shortened
+	r := rand.New(rand.NewPCG(3, 4))
+	for _, ecc := range []int{2, 3, 32, 254} {
+		for _, n := range []int{0, 1, 255 - ecc, 256 - ecc, 600} {
+			enc := eccEncode(msg[:n], ecc)
+			if len(enc) != eccLen(n, ecc) || eccCapacity(len(enc), ecc) != n {
+				t.Fatalf("eccEncode of %d bytes with %d parity gave %d, capacity %d", n, ecc, len(enc), eccCapacity(len(enc), ecc))
+			}
+			for b := 0; b < len(enc); b += ecc_block_len {
+				block := enc[b:min(b+ecc_block_len, len(enc))]
+				for _, i := range r.Perm(len(block))[:ecc/2] {
+					block[i] ^= byte(1 + r.IntN(255))
+				}
+			}
+			if got, err := eccDecode(enc, ecc, false); err != nil || !bytes.Equal(got, msg[:n]) {
+				t.Errorf("eccDecode of %d bytes with %d parity and %d errors a block gave %d bytes, %v", n, ecc, ecc/2, len(got), err)
+			}
+		}
+	}
+}
+
+// TestEncodeLeavesInput checks that Encode writes a new image, leaving the
+// carrier as it was, so a caller can reuse it.
+func TestEncodeLeavesInput(t *testing.T) {
+	pal := append(color.Palette{color.NRGBA{}}, palette.Plan9[:255]...)
+	paletted := image.NewPaletted(image.Rect(0, 0, 64, 48), pal)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), testImage8(64, 48), image.Point{})
+	msg := testMessage(300)
+
+	pixels := func(img image.Image) [][4]uint32 {
+		var c [][4]uint32
+		for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+			for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+				c = append(c, colourAt(img, image.Pt(x, y)))
+			}
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		img    image.Image
+		encode func(img image.Image) (image.Image, error)
+	}{
+		{testImage(64, 48), func(img image.Image) (image.Image, error) { return Encode(img, msg, Options{}) }},
+		{testImage(64, 48).SubImage(image.Rect(8, 8, 56, 40)), func(img image.Image) (image.Image, error) { return Encode(img, msg, Options{Bits: 2}) }},
+		{testImage8(64, 48), func(img image.Image) (image.Image, error) {
+			return Encode(img, msg, Options{Bits: 2, KeepDepth: true, Slots: 2, Slot: 1})
+		}},
+		{testImage8(64, 48), func(img image.Image) (image.Image, error) {
+			return Encode(img, msg, Options{Match: true, Interleave: true, Opaque: true, Channels: ChannelsRGB})
+		}},
+		{testImageGray16(64, 48), func(img image.Image) (image.Image, error) { return Encode(img, msg, Options{Bits: 8, ECC: 8}) }},
+		{paletted, func(img image.Image) (image.Image, error) {
+			return Encode(img, msg, Options{Password: "pw", Scatter: true})
+		}},
+		{testImage(64, 48), func(img image.Image) (image.Image, error) {
+			e, err := NewEncoder(msg, Options{Matrix: 3, Bits: 1})
+			if err != nil {
+				return nil, err
+			}
+			return e.Embed(img)
+		}},
+		{testImage(64, 48), func(img image.Image) (image.Image, error) {
+			return EncodeDecoy(img, msg[:10], msg, "other", Options{Password: "pw"})
+		}},
+	} {
+		before := pixels(tc.img)
+		out, err := tc.encode(tc.img)
+		if err != nil {
+			t.Fatalf("Encode into a %T: %v", tc.img, err)
+		}
+		if out == tc.img {
+			t.Errorf("Encode into a %T returned the carrier itself", tc.img)
+		}
+		if !reflect.DeepEqual(pixels(tc.img), before) {
+			t.Errorf("Encode into a %T changed the carrier", tc.img)
+		}
+	}
+}
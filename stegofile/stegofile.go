@@ -0,0 +1,179 @@
+// Package stegofile wraps the stego library in functions that read and write
+// image and message files, for programs that want what the stego command does
+// in one call.  The stego package itself never touches the filesystem, so it
+// builds for GOOS=js GOARCH=wasm.
+package stegofile
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/henrythewasp/stego"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// ErrLossyOutput is returned by EncodeFile if the output file is named for a
+// format (JPEG, GIF or BMP) that cannot hold the hidden message.
+var ErrLossyOutput = errors.New("output format cannot hold the hidden message (use .png or .tif)")
+
+// EncodeFile hides the file msgPath in the image file inPath (a PNG, TIFF,
+// BMP, JPEG or GIF) and writes the stego image to outPath, as a TIFF if it is
+// named .tif or .tiff, and otherwise as a PNG.  The base name of msgPath is
+// stored alongside the message unless opts.Filename is set.  Errors from the
+// stego package, such as ErrInsufficientCapacity, are returned as is, so
+// errors.Is works on them.
+func EncodeFile(inPath, outPath, msgPath string, opts stego.Options) error {
+	switch strings.ToLower(filepath.Ext(outPath)) {
+	case ".jpg", ".jpeg", ".gif", ".bmp":
+		return fmt.Errorf("%s: %w", outPath, ErrLossyOutput)
+	}
+
+	msg, err := os.ReadFile(msgPath)
+	if err != nil {
+		return fmt.Errorf("cannot read message file: %w", err)
+	}
+	img, err := readImage(inPath, opts)
+	if err != nil {
+		return err
+	}
+	if opts.Filename == "" {
+		opts.Filename = filepath.Base(msgPath)
+	}
+
+	out, err := stego.Encode(img, msg, opts)
+	if err != nil {
+		return err
+	}
+	return writeImage(outPath, out)
+}
+
+// DecodeFile recovers the message hidden in the image file inPath and writes it
+// to outPath, or, if outPath is a directory, to the file name stored in the
+// image within it.  The files of a message hidden by stego.EncodeFiles are
+// each written under their own names, so outPath must be a directory for one.
+// Nothing is left at outPath if the message cannot be recovered.  Errors from
+// the stego package, such as ErrDecrypt, are returned as is, so errors.Is
+// works on them.
+func DecodeFile(inPath, outPath string, opts stego.Options) error {
+	img, err := readImage(inPath, opts)
+	if err != nil {
+		return err
+	}
+	h, err := stego.ReadSlotHeader(img, opts)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(outPath)
+	dir := err == nil && fi.IsDir()
+	if h.ExtFlags&stego.ExtFlagFiles != 0 {
+		if !dir {
+			return fmt.Errorf("image holds several files, so %s must be a directory to write them to", outPath)
+		}
+		files, err := stego.DecodeFiles(img, opts)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			name, err := storedPath(outPath, f.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(name, f.Data, 0o666); err != nil {
+				return fmt.Errorf("cannot write message file: %w", err)
+			}
+		}
+		return nil
+	}
+	if dir {
+		if outPath, err = storedPath(outPath, h.Filename); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("cannot create message file: %w", err)
+	}
+	if _, err := stego.DecodeTo(img, f, opts); err != nil {
+		f.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write message file: %w", err)
+	}
+	return nil
+}
+
+// storedPath returns the path of the file named stored, as stored in an image,
+// in the directory dir.  The name comes from the image, so it is never let
+// out of dir.
+func storedPath(dir, stored string) (string, error) {
+	name := filepath.Base(stored)
+	if stored == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("no valid file name stored in image to write into directory %s", dir)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// readImage decodes the image file name, refusing one with more pixels than
+// opts.MaxPixels allows before decoding it.
+func readImage(name string, opts stego.Options) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open input image: %w", err)
+	}
+	defer f.Close()
+
+	if opts.MaxPixels > 0 {
+		cfg, _, err := image.DecodeConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode input image: %w", err)
+		}
+		if n := int64(cfg.Width) * int64(cfg.Height); n > int64(opts.MaxPixels) {
+			return nil, fmt.Errorf("%w: %dx%d image has %d pixels, more than the %d allowed", stego.ErrCarrierTooLarge, cfg.Width, cfg.Height, n, opts.MaxPixels)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("cannot read input image: %w", err)
+		}
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode input image: %w", err)
+	}
+	return img, nil
+}
+
+// writeImage writes img to the file name, as a TIFF or a PNG.
+func writeImage(name string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("cannot create output image: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tif", ".tiff":
+		err = tiff.Encode(f, img, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		err = png.Encode(f, img)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write output image: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write output image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package stegofile
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrythewasp/stego"
+)
+
+func TestEncodeDecodeFile(t *testing.T) {
+	dir := t.TempDir()
+	carrier := filepath.Join(dir, "carrier.png")
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 32, 32))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(carrier, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hidden in a file")
+	if err := os.WriteFile(filepath.Join(dir, "note.txt"), msg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, out := range []string{"steg.png", "steg.tif"} {
+		steg := filepath.Join(dir, out)
+		if err := EncodeFile(carrier, steg, filepath.Join(dir, "note.txt"), stego.Options{Password: "pw"}); err != nil {
+			t.Fatalf("EncodeFile to %s: %v", out, err)
+		}
+
+		// To a file, and to the stored name in a directory
+		if err := DecodeFile(steg, filepath.Join(dir, "got.txt"), stego.Options{Password: "pw"}); err != nil {
+			t.Fatalf("DecodeFile of %s: %v", out, err)
+		}
+		sub := filepath.Join(dir, "out")
+		os.Mkdir(sub, 0o755)
+		if err := DecodeFile(steg, sub, stego.Options{Password: "pw"}); err != nil {
+			t.Fatalf("DecodeFile of %s to a directory: %v", out, err)
+		}
+		for _, name := range []string{filepath.Join(dir, "got.txt"), filepath.Join(sub, "note.txt")} {
+			if got, err := os.ReadFile(name); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("DecodeFile of %s wrote %q to %s, %v; want %q", out, got, name, err, msg)
+			}
+		}
+
+		// The library's errors come through, and leave nothing behind
+		bad := filepath.Join(dir, "bad.txt")
+		if err := DecodeFile(steg, bad, stego.Options{Password: "wrong"}); !errors.Is(err, stego.ErrDecrypt) {
+			t.Errorf("DecodeFile with the wrong password returned %v, want ErrDecrypt", err)
+		}
+		if _, err := os.Stat(bad); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("DecodeFile with the wrong password left %s behind", bad)
+		}
+	}
+
+	if err := DecodeFile(carrier, filepath.Join(dir, "none.txt"), stego.Options{}); !errors.Is(err, stego.ErrNotStego) {
+		t.Errorf("DecodeFile of the carrier returned %v, want ErrNotStego", err)
+	}
+	if err := EncodeFile(carrier, filepath.Join(dir, "steg.jpg"), filepath.Join(dir, "note.txt"), stego.Options{}); !errors.Is(err, ErrLossyOutput) {
+		t.Errorf("EncodeFile to a JPEG returned %v, want ErrLossyOutput", err)
+	}
+	if err := EncodeFile(carrier, filepath.Join(dir, "big.png"), filepath.Join(dir, "note.txt"), stego.Options{MaxPixels: 100}); !errors.Is(err, stego.ErrCarrierTooLarge) {
+		t.Errorf("EncodeFile of an image over MaxPixels returned %v, want ErrCarrierTooLarge", err)
+	}
+}
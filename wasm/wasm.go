@@ -0,0 +1,45 @@
+// Package wasm wraps the stego library in functions that take and return
+// encoded image files as bytes, for use where there is no filesystem, such as
+// a browser running the encoder compiled with GOOS=js GOARCH=wasm.
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+
+	"github.com/henrythewasp/stego"
+)
+
+// Encode hides msg in the image file image_bytes (a PNG, JPEG or GIF), with the
+// default stego.Options, and returns the stego image as a PNG file.
+func Encode(image_bytes, msg []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(image_bytes))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode input image: %w", err)
+	}
+
+	out, err := stego.Encode(img, msg, stego.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, out); err != nil {
+		return nil, fmt.Errorf("cannot write output image: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// Decode extracts the message hidden by Encode in the PNG file image_bytes.
+func Decode(image_bytes []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(image_bytes))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode input image: %w", err)
+	}
+
+	return stego.Decode(img, stego.Options{})
+}
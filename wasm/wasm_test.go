@@ -0,0 +1,32 @@
+package wasm
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewNRGBA(image.Rect(0, 0, 32, 32))); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hidden in the browser")
+
+	out, err := Encode(src.Bytes(), msg)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := Decode(out)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("Decode returned %q, want %q", got, msg)
+	}
+
+	if _, err := Encode([]byte("not an image"), msg); err == nil {
+		t.Error("Encode of something that is not an image succeeded, want an error")
+	}
+}
@@ -0,0 +1,34 @@
+package stego
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrXORKeyRequired is returned by Decode if the payload is XORed with a key and
+// Options.XORKey is not set.
+var ErrXORKeyRequired = errors.New("message is XOR obfuscated: a key is required")
+
+// xorBytes XORs b in place with the repeating key, starting at byte offset of
+// the key stream.
+func xorBytes(b []byte, key string, offset int) {
+	for i := range b {
+		b[i] ^= key[(offset+i)%len(key)]
+	}
+}
+
+// xorWriter undoes the XOR of the payload with key as it is written through to
+// w.
+type xorWriter struct {
+	w   io.Writer
+	key string
+	n   int // bytes written so far
+	buf []byte
+}
+
+func (xw *xorWriter) Write(p []byte) (int, error) {
+	xw.buf = append(xw.buf[:0], p...)
+	xorBytes(xw.buf, xw.key, xw.n)
+	xw.n += len(p)
+	return xw.w.Write(xw.buf)
+}